@@ -0,0 +1,206 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const apiKeyPrefix = "ds_"
+
+type APIKey struct {
+	ID           int        `json:"id"`
+	Name         string     `json:"name"`
+	Scopes       []string   `json:"scopes"`
+	Tenant       string     `json:"tenant,omitempty"`
+	Key          string     `json:"key,omitempty"`
+	CreationTime time.Time  `json:"creation_time"`
+	RevokedTime  *time.Time `json:"revoked_time,omitempty"`
+}
+
+var apiKeyRepository APIKeyRepository
+
+// generateAPIKey returns a new random key, it is only ever shown to the caller once
+func generateAPIKey() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// hashAPIKey hashes a key for storage. Keys carry 256 bits of entropy so a fast hash is sufficient.
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func validateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required")
+	}
+	for _, s := range scopes {
+		known := false
+		for _, k := range knownScopes {
+			if s == k {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown scope %q", s)
+		}
+	}
+	return nil
+}
+
+// APIKeyAuthenticator accepts keys issued through the admin endpoint, plus an optional bootstrap
+// admin key taken from configuration so the first keys can be issued
+type APIKeyAuthenticator struct {
+	repo     APIKeyRepository
+	adminKey string
+}
+
+func (a APIKeyAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return Principal{}, err
+	}
+	if a.adminKey != "" && subtle.ConstantTimeCompare([]byte(token), []byte(a.adminKey)) == 1 {
+		return Principal{Subject: "admin", Scopes: []string{ScopeAdmin}}, nil
+	}
+	if !strings.HasPrefix(token, apiKeyPrefix) {
+		return Principal{}, ErrInvalidCredentials
+	}
+	key, err := a.repo.FindAPIKeyByHash(hashAPIKey(token))
+	if err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			return Principal{}, ErrInvalidCredentials
+		}
+		slog.ErrorContext(r.Context(), "Error finding api key", "error", err)
+		return Principal{}, ErrInvalidCredentials
+	}
+	if key.RevokedTime != nil {
+		return Principal{}, ErrInvalidCredentials
+	}
+	return Principal{Subject: "api-key:" + strconv.Itoa(key.ID), Tenant: key.Tenant, Scopes: key.Scopes}, nil
+}
+
+// CrudAPIKeysHandler lists and issues api keys. Admins bound to a tenant only see and issue keys of their tenant,
+// an unbound key could pick any tenant with X-Tenant-ID.
+func CrudAPIKeysHandler(w http.ResponseWriter, r *http.Request) {
+	principal, _ := principalFromContext(r.Context())
+	switch r.Method {
+	case http.MethodGet:
+		var keys []APIKey
+		var err error
+		if principal.Tenant != "" {
+			keys, err = apiKeyRepository.FindAPIKeysByTenant(principal.Tenant)
+		} else {
+			keys, err = apiKeyRepository.FindAllAPIKeys()
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error finding api keys", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(keys)
+
+	case http.MethodPost:
+		var newKey APIKey
+		err := json.NewDecoder(r.Body).Decode(&newKey)
+		if err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if newKey.Name == "" {
+			http.Error(w, "Name is required", http.StatusBadRequest)
+			return
+		}
+		if err := validateScopes(newKey.Scopes); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if newKey.Tenant != "" && !tenantIDPattern.MatchString(newKey.Tenant) {
+			http.Error(w, "Invalid tenant ID", http.StatusBadRequest)
+			return
+		}
+		if principal.Tenant != "" && newKey.Tenant != principal.Tenant {
+			http.Error(w, fmt.Sprintf("Only keys of tenant %v may be issued", principal.Tenant), http.StatusForbidden)
+			return
+		}
+		plaintext, err := generateAPIKey()
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error generating api key", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		newKey, err = apiKeyRepository.SaveAPIKey(newKey, hashAPIKey(plaintext))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error adding api key", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "API key issued", "api_key_id", newKey.ID, "name", newKey.Name, "scopes", newKey.Scopes)
+		newKey.Key = plaintext
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(newKey)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func CrudAPIKeyHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/admin/api-keys/")
+	keyID, err := strconv.Atoi(path)
+	if err != nil {
+		http.Error(w, "Invalid api key ID", http.StatusBadRequest)
+		return
+	}
+	// keys of other tenants are not found for admins bound to a tenant
+	if principal, _ := principalFromContext(r.Context()); principal.Tenant != "" {
+		key, err := apiKeyRepository.FindAPIKeyByID(keyID)
+		if err == nil && key.Tenant != principal.Tenant {
+			err = sql.ErrNoRows
+		}
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				http.Error(w, fmt.Sprintf("API key with id %v not found", keyID), http.StatusNotFound)
+				return
+			}
+			slog.ErrorContext(r.Context(), "Error finding api key", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+	}
+	err = apiKeyRepository.RevokeAPIKey(keyID)
+	if err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			http.Error(w, fmt.Sprintf("API key with id %v not found", keyID), http.StatusNotFound)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Error revoking api key", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	slog.InfoContext(r.Context(), "API key revoked", "api_key_id", keyID)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+type APIKeyRepository interface {
+	SaveAPIKey(key APIKey, keyHash string) (APIKey, error)
+	FindAPIKeyByHash(keyHash string) (APIKey, error)
+	FindAPIKeyByID(id int) (APIKey, error)
+	FindAllAPIKeys() ([]APIKey, error)
+	// FindAPIKeysByTenant finds the keys bound to tenant
+	FindAPIKeysByTenant(tenant string) ([]APIKey, error)
+	RevokeAPIKey(id int) error
+}
+
+type APIKeyRepositoryImpl struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+const apiKeyColumns = "id, name, scopes, tenant_id, creation_time, revoked_time"
+
+func scanAPIKey(row rowScanner) (APIKey, error) {
+	var key APIKey
+	var scopes string
+	var tenant sql.NullString
+	var revokedTime sql.NullTime
+	err := row.Scan(&key.ID, &key.Name, &scopes, &tenant, &key.CreationTime, &revokedTime)
+	if err != nil {
+		return APIKey{}, err
+	}
+	key.Scopes = strings.Split(scopes, ",")
+	key.Tenant = tenant.String
+	if revokedTime.Valid {
+		key.RevokedTime = &revokedTime.Time
+	}
+	return key, nil
+}
+
+func (r APIKeyRepositoryImpl) SaveAPIKey(key APIKey, keyHash string) (APIKey, error) {
+	var tenant sql.NullString
+	if key.Tenant != "" {
+		tenant = sql.NullString{String: key.Tenant, Valid: true}
+	}
+	query := "INSERT INTO api_keys (name, key_hash, scopes, tenant_id, creation_time) VALUES (?, ?, ?, ?, NOW())"
+	keyID, err := r.dialect.insertID(context.Background(), r.db, query, key.Name, keyHash, strings.Join(key.Scopes, ","), tenant)
+	if err != nil {
+		return APIKey{}, err
+	}
+	query = "SELECT " + apiKeyColumns + " FROM api_keys WHERE id = ?"
+	return scanAPIKey(r.db.QueryRow(r.dialect.bind(query), keyID))
+}
+
+func (r APIKeyRepositoryImpl) FindAPIKeyByHash(keyHash string) (APIKey, error) {
+	query := "SELECT " + apiKeyColumns + " FROM api_keys WHERE key_hash = ?"
+	return scanAPIKey(r.db.QueryRow(r.dialect.bind(query), keyHash))
+}
+
+func (r APIKeyRepositoryImpl) FindAPIKeyByID(id int) (APIKey, error) {
+	query := "SELECT " + apiKeyColumns + " FROM api_keys WHERE id = ?"
+	return scanAPIKey(r.db.QueryRow(r.dialect.bind(query), id))
+}
+
+func (r APIKeyRepositoryImpl) FindAllAPIKeys() ([]APIKey, error) {
+	return r.findAPIKeys("SELECT " + apiKeyColumns + " FROM api_keys ORDER BY id")
+}
+
+func (r APIKeyRepositoryImpl) FindAPIKeysByTenant(tenant string) ([]APIKey, error) {
+	return r.findAPIKeys("SELECT "+apiKeyColumns+" FROM api_keys WHERE tenant_id = ? ORDER BY id", tenant)
+}
+
+func (r APIKeyRepositoryImpl) findAPIKeys(query string, args ...any) ([]APIKey, error) {
+	rows, err := r.db.Query(r.dialect.bind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		key, err := scanAPIKey(rows)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
+}
+
+func (r APIKeyRepositoryImpl) RevokeAPIKey(id int) error {
+	query := "UPDATE api_keys SET revoked_time = ? WHERE id = ? AND revoked_time IS NULL"
+	result, err := r.db.Exec(r.dialect.bind(query), time.Now().UTC(), id)
+	if err != nil {
+		return err
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		// either unknown or already revoked, report the former as not found
+		var exists int
+		return r.db.QueryRow(r.dialect.bind("SELECT 1 FROM api_keys WHERE id = ?"), id).Scan(&exists)
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ErrAssigneeHoldsDevices is returned by DeleteAssignee while devices are checked out to the assignee
+var ErrAssigneeHoldsDevices = errors.New("assignee holds devices")
+
+// Assignee is a person devices are checked out to, addressed by PublicID like devices
+type Assignee struct {
+	ID           int       `json:"-"`
+	PublicID     string    `json:"id"`
+	Name         string    `json:"name"`
+	Email        string    `json:"email,omitempty"`
+	CreationTime time.Time `json:"creation_time"`
+}
+
+// AssigneeRepository is scoped to the tenant of the context like Repository
+type AssigneeRepository interface {
+	SaveAssignee(ctx context.Context, assignee Assignee) (Assignee, error)
+	FindAssigneeByPublicID(ctx context.Context, publicID string) (Assignee, error)
+	FindAllAssignees(ctx context.Context) ([]Assignee, error)
+	// DeleteAssignee removes the assignee and its past loans, ErrAssigneeHoldsDevices while it has open ones
+	DeleteAssignee(ctx context.Context, id int) error
+}
+
+type AssigneeRepositoryImpl struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+var assigneeRepository AssigneeRepository
+
+const assigneeColumns = "id, public_id, name, email, creation_time"
+
+func scanAssignee(row rowScanner) (Assignee, error) {
+	var assignee Assignee
+	err := row.Scan(&assignee.ID, &assignee.PublicID, &assignee.Name, &assignee.Email, &assignee.CreationTime)
+	if err != nil {
+		return Assignee{}, err
+	}
+	return assignee, nil
+}
+
+func (r AssigneeRepositoryImpl) SaveAssignee(ctx context.Context, assignee Assignee) (Assignee, error) {
+	query := "INSERT INTO assignees (public_id, tenant_id, name, email, creation_time) VALUES (?, ?, ?, ?, NOW())"
+	id, err := r.dialect.insertID(ctx, r.db, query, newULID(time.Now()), tenantFromContext(ctx), assignee.Name, assignee.Email)
+	if err != nil {
+		return Assignee{}, err
+	}
+	query = "SELECT " + assigneeColumns + " FROM assignees WHERE id = ?"
+	return scanAssignee(r.db.QueryRowContext(ctx, r.dialect.bind(query), id))
+}
+
+func (r AssigneeRepositoryImpl) FindAssigneeByPublicID(ctx context.Context, publicID string) (Assignee, error) {
+	query := "SELECT " + assigneeColumns + " FROM assignees WHERE public_id = ? AND tenant_id = ?"
+	return scanAssignee(r.db.QueryRowContext(ctx, r.dialect.bind(query), publicID, tenantFromContext(ctx)))
+}
+
+func (r AssigneeRepositoryImpl) FindAllAssignees(ctx context.Context) ([]Assignee, error) {
+	query := "SELECT " + assigneeColumns + " FROM assignees WHERE tenant_id = ? ORDER BY id"
+	rows, err := r.db.QueryContext(ctx, r.dialect.bind(query), tenantFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var assignees []Assignee
+	for rows.Next() {
+		assignee, err := scanAssignee(rows)
+		if err != nil {
+			return nil, err
+		}
+		assignees = append(assignees, assignee)
+	}
+	return assignees, rows.Err()
+}
+
+func (r AssigneeRepositoryImpl) DeleteAssignee(ctx context.Context, id int) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	tenant := tenantFromContext(ctx)
+	var found int
+	query := "SELECT id FROM assignees WHERE id = ? AND tenant_id = ? FOR UPDATE"
+	if err := tx.QueryRowContext(ctx, r.dialect.bind(query), id, tenant).Scan(&found); err != nil {
+		return err
+	}
+	var open int
+	query = "SELECT COUNT(*) FROM device_assignments WHERE assignee_id = ? AND checkin_time IS NULL"
+	if err := tx.QueryRowContext(ctx, r.dialect.bind(query), id).Scan(&open); err != nil {
+		return err
+	}
+	if open > 0 {
+		return ErrAssigneeHoldsDevices
+	}
+	query = "DELETE FROM assignees WHERE id = ? AND tenant_id = ?"
+	if _, err := tx.ExecContext(ctx, r.dialect.bind(query), id, tenant); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func CrudAssigneesHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		assignees, err := assigneeRepository.FindAllAssignees(r.Context())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error finding assignees", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(assignees)
+
+	case http.MethodPost:
+		var newAssignee Assignee
+		err := json.NewDecoder(r.Body).Decode(&newAssignee)
+		if err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if newAssignee.Name == "" {
+			http.Error(w, "Name is required", http.StatusBadRequest)
+			return
+		}
+		newAssignee, err = assigneeRepository.SaveAssignee(r.Context(), newAssignee)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error adding assignee", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Assignee added", "assignee", newAssignee.PublicID)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(newAssignee)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func CrudAssigneeHandler(w http.ResponseWriter, r *http.Request) {
+	assigneeID := strings.TrimPrefix(r.URL.Path, "/assignees/")
+	if !isULID(assigneeID) {
+		http.Error(w, "Invalid assignee ID", http.StatusBadRequest)
+		return
+	}
+	assignee, err := assigneeRepository.FindAssigneeByPublicID(r.Context(), assigneeID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, fmt.Sprintf("Assignee with id %v not found", assigneeID), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.ErrorContext(r.Context(), "Error finding assignee", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(assignee)
+
+	case http.MethodDelete:
+		err := assigneeRepository.DeleteAssignee(r.Context(), assignee.ID)
+		if errors.Is(err, ErrAssigneeHoldsDevices) {
+			writeProblem(w, http.StatusConflict, fmt.Sprintf("Assignee with id %v still holds devices", assigneeID))
+			return
+		}
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, fmt.Sprintf("Assignee with id %v not found", assigneeID), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error deleting assignee", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Assignee deleted", "assignee", assigneeID)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var (
+	// ErrDeviceCheckedOut is returned by CheckoutDevice and DeleteDevice when the device is on loan already
+	ErrDeviceCheckedOut = errors.New("device is checked out")
+	// ErrDeviceNotCheckedOut is returned by CheckinDevice when the device is not on loan
+	ErrDeviceNotCheckedOut = errors.New("device is not checked out")
+	ErrAssigneeNotFound    = errors.New("assignee not found")
+)
+
+// Holder is the assignee a device is checked out to and the terms of the loan
+type Holder struct {
+	AssigneeID   string    `json:"assignee_id"`
+	Name         string    `json:"name"`
+	CheckoutTime time.Time `json:"checkout_time"`
+	DueTime      time.Time `json:"due_time"`
+}
+
+// findHolders reads the open loans of the tenant by device, condition narrows them down
+func findHolders(ctx context.Context, q querier, condition string, args ...any) (map[int]*Holder, error) {
+	query := "SELECT a.device_id, s.public_id, s.name, a.checkout_time, a.due_time FROM device_assignments a " +
+		"JOIN assignees s ON s.id = a.assignee_id WHERE a.tenant_id = ? AND a.checkin_time IS NULL" + condition
+	rows, err := q.QueryContext(ctx, query, append([]any{tenantFromContext(ctx)}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holders := map[int]*Holder{}
+	for rows.Next() {
+		var deviceID int
+		var holder Holder
+		if err := rows.Scan(&deviceID, &holder.AssigneeID, &holder.Name, &holder.CheckoutTime, &holder.DueTime); err != nil {
+			return nil, err
+		}
+		holders[deviceID] = &holder
+	}
+	return holders, rows.Err()
+}
+
+// CheckoutDevice locks the device so concurrent checkouts queue up behind each other and see the loan of the
+// first one, the unique open_device_id turns away whatever slips through
+func (r RepositoryImpl) CheckoutDevice(ctx context.Context, id int, assigneeID int, due time.Time) (Device, error) {
+	tenant := tenantFromContext(ctx)
+	var device Device
+	err := r.inTx(ctx, func(tx querier) error {
+		current, err := findDeviceByID(ctx, tx, id, true)
+		if err != nil {
+			return err
+		}
+		if current.Holder != nil {
+			return ErrDeviceCheckedOut
+		}
+		var found int
+		query := "SELECT id FROM assignees WHERE id = ? AND tenant_id = ?"
+		err = tx.QueryRowContext(ctx, query, assigneeID, tenant).Scan(&found)
+		if err == sql.ErrNoRows {
+			return ErrAssigneeNotFound
+		}
+		if err != nil {
+			return err
+		}
+		query = "INSERT INTO device_assignments (tenant_id, device_id, assignee_id, open_device_id, checkout_time, due_time) VALUES (?, ?, ?, ?, ?, ?)"
+		_, err = tx.ExecContext(ctx, query, tenant, id, assigneeID, id, time.Now().UTC(), due.UTC())
+		if r.dialect.isUniqueViolation(err) {
+			return ErrDeviceCheckedOut
+		}
+		if err != nil {
+			return err
+		}
+		device, err = findDeviceByID(ctx, tx, id, false)
+		if err != nil {
+			return err
+		}
+		return insertOutboxEvent(ctx, tx, EventDeviceCheckedOut, device)
+	})
+	if err != nil {
+		return Device{}, err
+	}
+	slog.DebugContext(ctx, "Device checked out", "device_id", id, "assignee_id", assigneeID, "tenant", tenant)
+	return device, nil
+}
+
+func (r RepositoryImpl) CheckinDevice(ctx context.Context, id int) (Device, error) {
+	tenant := tenantFromContext(ctx)
+	var device Device
+	err := r.inTx(ctx, func(tx querier) error {
+		var err error
+		device, err = findDeviceByID(ctx, tx, id, true)
+		if err != nil {
+			return err
+		}
+		if device.Holder == nil {
+			return ErrDeviceNotCheckedOut
+		}
+		query := "UPDATE device_assignments SET checkin_time = ?, open_device_id = NULL WHERE open_device_id = ? AND tenant_id = ?"
+		_, err = tx.ExecContext(ctx, query, time.Now().UTC(), id, tenant)
+		if err != nil {
+			return err
+		}
+		device.Holder = nil
+		return insertOutboxEvent(ctx, tx, EventDeviceCheckedIn, device)
+	})
+	if err != nil {
+		return Device{}, err
+	}
+	slog.DebugContext(ctx, "Device checked in", "device_id", id, "tenant", tenant)
+	return device, nil
+}
+
+func (r RepositoryImpl) FindDevicesByAssignee(ctx context.Context, assigneeID int) ([]Device, error) {
+	query := "SELECT " + deviceColumns + " FROM devices WHERE tenant_id = ? AND id IN " +
+		"(SELECT device_id FROM device_assignments WHERE assignee_id = ? AND checkin_time IS NULL) ORDER BY id"
+	return r.queryDevices(ctx, query, tenantFromContext(ctx), assigneeID)
+}
+
+func (r RepositoryImpl) FindOverdueDevices(ctx context.Context, now time.Time) ([]Device, error) {
+	tenant := tenantFromContext(ctx)
+	query := "SELECT " + deviceColumns + " FROM devices WHERE tenant_id = ? AND id IN " +
+		"(SELECT device_id FROM device_assignments WHERE tenant_id = ? AND checkin_time IS NULL AND due_time < ?) ORDER BY id"
+	return r.queryDevices(ctx, query, tenant, tenant, now.UTC())
+}
+
+// checkoutRequest is the body of POST /device/{id}/checkout
+type checkoutRequest struct {
+	AssigneeID string    `json:"assignee_id"`
+	DueTime    time.Time `json:"due_time"`
+}
+
+// DeviceLoanHandler serves POST /device/{id}/checkout and POST /device/{id}/checkin
+func DeviceLoanHandler(w http.ResponseWriter, r *http.Request, deviceID string, action string) {
+	if action != "checkout" && action != "checkin" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	device, err := findDeviceByPathID(w, r, deviceID)
+	if err != nil {
+		return
+	}
+
+	if action == "checkin" {
+		device, err = repository.CheckinDevice(r.Context(), device.ID)
+	} else {
+		var request checkoutRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if request.AssigneeID == "" || request.DueTime.IsZero() {
+			http.Error(w, "assignee_id and due_time are required", http.StatusBadRequest)
+			return
+		}
+		if !request.DueTime.After(time.Now()) {
+			http.Error(w, "due_time must be in the future", http.StatusBadRequest)
+			return
+		}
+		assignee, findErr := assigneeRepository.FindAssigneeByPublicID(r.Context(), request.AssigneeID)
+		if errors.Is(findErr, sql.ErrNoRows) {
+			http.Error(w, fmt.Sprintf("Assignee with id %v not found", request.AssigneeID), http.StatusUnprocessableEntity)
+			return
+		}
+		if findErr != nil {
+			slog.ErrorContext(r.Context(), "Error finding assignee", "error", findErr)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		device, err = repository.CheckoutDevice(r.Context(), device.ID, assignee.ID, request.DueTime)
+	}
+	if err != nil {
+		switch {
+		case errors.Is(err, ErrForbidden):
+			writeProblem(w, http.StatusForbidden, fmt.Sprintf("Not allowed to %v device with id %v", action, deviceID))
+		case errors.Is(err, ErrDeviceCheckedOut):
+			writeProblem(w, http.StatusConflict, fmt.Sprintf("Device with id %v is checked out already", deviceID))
+		case errors.Is(err, ErrDeviceNotCheckedOut):
+			writeProblem(w, http.StatusConflict, fmt.Sprintf("Device with id %v is not checked out", deviceID))
+		case errors.Is(err, ErrAssigneeNotFound):
+			http.Error(w, "Assignee not found", http.StatusUnprocessableEntity)
+		case errors.Is(err, sql.ErrNoRows):
+			http.Error(w, fmt.Sprintf("Device with id %v not found", deviceID), http.StatusNotFound)
+		default:
+			slog.ErrorContext(r.Context(), "Error changing device loan", "action", action, "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		}
+		return
+	}
+	slog.InfoContext(r.Context(), "Device loan changed", "action", action, "device", device.PublicID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(device)
+}
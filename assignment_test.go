@@ -0,0 +1,375 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_DeviceLoans(t *testing.T) {
+	backends := map[string]func(t *testing.T) RepositoryImpl{
+		"sqlite": sqliteRepository,
+		"mysql": func(t *testing.T) RepositoryImpl {
+			return mysqlDatabase(t, mysqlServerDSN(t))
+		},
+	}
+	for name, newRepository := range backends {
+		t.Run(name, func(t *testing.T) {
+			testDeviceLoans(t, newRepository)
+		})
+	}
+}
+
+func testDeviceLoans(t *testing.T, newRepository func(t *testing.T) RepositoryImpl) {
+	ctx := withTenant(context.Background(), "loan-tenant")
+	otherTenant := withTenant(context.Background(), "loan-other-tenant")
+	due := time.Now().Add(24 * time.Hour).Truncate(time.Second)
+
+	// setup returns a repository with a device and an assignee of the tenant of ctx
+	setup := func(t *testing.T) (RepositoryImpl, AssigneeRepositoryImpl, Device, Assignee) {
+		r := newRepository(t)
+		assignees := AssigneeRepositoryImpl{db: r.db, dialect: r.dialect}
+		device, err := r.SaveDevice(ctx, Device{Name: "Loaner", Brand: "Loan Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assignee, err := assignees.SaveAssignee(ctx, Assignee{Name: "Ada", Email: "ada@example.com"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return r, assignees, device, assignee
+	}
+
+	t.Run("should embed the holder while a device is checked out", func(t *testing.T) {
+		r, _, device, assignee := setup(t)
+		checkedOut, err := r.CheckoutDevice(ctx, device.ID, assignee.ID, due)
+		if err != nil {
+			t.Fatal(err)
+		}
+		holder := checkedOut.Holder
+		if holder == nil || holder.AssigneeID != assignee.PublicID || holder.Name != "Ada" || !holder.DueTime.Equal(due) || holder.CheckoutTime.IsZero() {
+			t.Fatalf("expected the device to be held by %+v until %v, got %+v", assignee, due, holder)
+		}
+		found, err := r.FindDeviceByPublicID(ctx, device.PublicID)
+		if err != nil || found.Holder == nil || *found.Holder != *holder {
+			t.Errorf("expected the holder by public id, got %+v, %v", found.Holder, err)
+		}
+		devices, err := r.FindAllDevices(ctx)
+		if err != nil || len(devices) != 1 || devices[0].Holder == nil {
+			t.Errorf("expected the holder in lists, got %v, %v", devices, err)
+		}
+
+		checkedIn, err := r.CheckinDevice(ctx, device.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if checkedIn.Holder != nil {
+			t.Errorf("expected no holder after checkin, got %+v", checkedIn.Holder)
+		}
+		found, err = r.FindDeviceByID(ctx, device.ID)
+		if err != nil || found.Holder != nil {
+			t.Errorf("expected the device to be available, got %+v, %v", found.Holder, err)
+		}
+		if _, err := r.CheckinDevice(ctx, device.ID); !errors.Is(err, ErrDeviceNotCheckedOut) {
+			t.Errorf("expected ErrDeviceNotCheckedOut, got %v", err)
+		}
+		if _, err := r.CheckoutDevice(ctx, device.ID, assignee.ID, due); err != nil {
+			t.Errorf("expected the device to be checked out again, got %v", err)
+		}
+	})
+
+	t.Run("should not check out a device twice", func(t *testing.T) {
+		r, assignees, device, assignee := setup(t)
+		if _, err := r.CheckoutDevice(ctx, device.ID, assignee.ID, due); err != nil {
+			t.Fatal(err)
+		}
+		other, err := assignees.SaveAssignee(ctx, Assignee{Name: "Grace"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.CheckoutDevice(ctx, device.ID, other.ID, due); !errors.Is(err, ErrDeviceCheckedOut) {
+			t.Errorf("expected ErrDeviceCheckedOut, got %v", err)
+		}
+	})
+
+	t.Run("should check out a device once under concurrency", func(t *testing.T) {
+		r, assignees, device, _ := setup(t)
+		const borrowers = 8
+		var wg sync.WaitGroup
+		errs := make([]error, borrowers)
+		for i := 0; i < borrowers; i++ {
+			assignee, err := assignees.SaveAssignee(ctx, Assignee{Name: fmt.Sprintf("Borrower %d", i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, errs[i] = r.CheckoutDevice(ctx, device.ID, assignee.ID, due)
+			}()
+		}
+		wg.Wait()
+		succeeded := 0
+		for _, err := range errs {
+			switch {
+			case err == nil:
+				succeeded++
+			case !errors.Is(err, ErrDeviceCheckedOut):
+				t.Errorf("expected ErrDeviceCheckedOut, got %v", err)
+			}
+		}
+		if succeeded != 1 {
+			t.Errorf("expected 1 checkout to succeed, got %d", succeeded)
+		}
+	})
+
+	t.Run("should keep loans within the tenant", func(t *testing.T) {
+		r, assignees, device, assignee := setup(t)
+		if _, err := r.CheckoutDevice(otherTenant, device.ID, assignee.ID, due); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("expected the device of another tenant to be missing, got %v", err)
+		}
+		stranger, err := assignees.SaveAssignee(otherTenant, Assignee{Name: "Stranger"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.CheckoutDevice(ctx, device.ID, stranger.ID, due); !errors.Is(err, ErrAssigneeNotFound) {
+			t.Errorf("expected the assignee of another tenant to be missing, got %v", err)
+		}
+		if _, err := assignees.FindAssigneeByPublicID(ctx, stranger.PublicID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("expected the assignee of another tenant to be missing, got %v", err)
+		}
+	})
+
+	t.Run("should find devices by assignee and overdue ones", func(t *testing.T) {
+		r, assignees, first, assignee := setup(t)
+		second, err := r.SaveDevice(ctx, Device{Name: "Second Loaner", Brand: "Loan Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := assignees.SaveAssignee(ctx, Assignee{Name: "Grace"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.CheckoutDevice(ctx, first.ID, assignee.ID, due); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.CheckoutDevice(ctx, second.ID, other.ID, due.Add(24*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		held, err := r.FindDevicesByAssignee(ctx, assignee.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectDevices(t, "held by the assignee", held, first)
+
+		overdue, err := r.FindOverdueDevices(ctx, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectDevices(t, "overdue now", overdue)
+		overdue, err = r.FindOverdueDevices(ctx, due.Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectDevices(t, "overdue after the first due time", overdue, first)
+		if overdue[0].Holder == nil || overdue[0].Holder.AssigneeID != assignee.PublicID {
+			t.Errorf("expected the overdue device with its holder, got %+v", overdue[0].Holder)
+		}
+	})
+
+	t.Run("should list more devices than one batch of holders", func(t *testing.T) {
+		r, _, first, assignee := setup(t)
+		var last Device
+		for i := 0; i < holderBatchSize; i++ {
+			var err error
+			last, err = r.SaveDevice(ctx, Device{Name: fmt.Sprintf("Batch Loaner %d", i), Brand: "Loan Brand"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, device := range []Device{first, last} {
+			if _, err := r.CheckoutDevice(ctx, device.ID, assignee.ID, due); err != nil {
+				t.Fatal(err)
+			}
+		}
+		devices, err := r.FindAllDevices(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != holderBatchSize+1 {
+			t.Fatalf("expected %d devices, got %d", holderBatchSize+1, len(devices))
+		}
+		held := 0
+		for _, device := range devices {
+			if device.Holder == nil {
+				continue
+			}
+			held++
+			if device.ID != first.ID && device.ID != last.ID {
+				t.Errorf("expected only the checked out devices to have a holder, got %+v", device)
+			}
+		}
+		if held != 2 {
+			t.Errorf("expected the holders of both batches, got %d", held)
+		}
+	})
+
+	t.Run("should not delete assignees holding devices", func(t *testing.T) {
+		r, assignees, device, assignee := setup(t)
+		if _, err := r.CheckoutDevice(ctx, device.ID, assignee.ID, due); err != nil {
+			t.Fatal(err)
+		}
+		if err := assignees.DeleteAssignee(ctx, assignee.ID); !errors.Is(err, ErrAssigneeHoldsDevices) {
+			t.Errorf("expected ErrAssigneeHoldsDevices, got %v", err)
+		}
+		if _, err := r.CheckinDevice(ctx, device.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := assignees.DeleteAssignee(ctx, assignee.ID); err != nil {
+			t.Errorf("expected the assignee to be deleted once the device is back, got %v", err)
+		}
+	})
+
+	t.Run("should show loans made through the cache", func(t *testing.T) {
+		r, _, device, assignee := setup(t)
+		cache := NewCachedRepository(r, CacheConfig{Size: 100, TTL: time.Hour}, nil)
+		cache.FindDeviceByPublicID(ctx, device.PublicID)
+		if _, err := cache.CheckoutDevice(ctx, device.ID, assignee.ID, due); err != nil {
+			t.Fatal(err)
+		}
+		found, err := cache.FindDeviceByPublicID(ctx, device.PublicID)
+		if err != nil || found.Holder == nil {
+			t.Errorf("expected the cached device to show its holder, got %+v, %v", found.Holder, err)
+		}
+	})
+}
+
+// loanRequest sends a JSON request to handler
+func loanRequest(t *testing.T, handler http.HandlerFunc, method string, url string, body any) *httptest.ResponseRecorder {
+	t.Helper()
+	payload, err := json.Marshal(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+func Test_DeviceLoanHandler(t *testing.T) {
+	ctx := context.Background()
+	due := time.Now().Add(time.Hour).UTC()
+
+	device, err := repository.SaveDevice(ctx, Device{Name: uniqueDeviceName(), Brand: "Loan Brand"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := loanRequest(t, CrudAssigneesHandler, http.MethodPost, "/assignees", Assignee{Name: "Ada", Email: "ada@example.com"})
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status code %d, got %d: %v", http.StatusCreated, rr.Code, rr.Body)
+	}
+	var assignee Assignee
+	json.Unmarshal(rr.Body.Bytes(), &assignee)
+	checkoutURL := "/device/" + device.PublicID + "/checkout"
+	checkinURL := "/device/" + device.PublicID + "/checkin"
+
+	t.Run("should reject checkouts without a future due time or a known assignee", func(t *testing.T) {
+		rr := loanRequest(t, CrudDeviceHandler, http.MethodPost, checkoutURL, checkoutRequest{AssigneeID: assignee.PublicID, DueTime: time.Now().Add(-time.Hour)})
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d for a past due time, got %d", http.StatusBadRequest, rr.Code)
+		}
+		rr = loanRequest(t, CrudDeviceHandler, http.MethodPost, checkoutURL, checkoutRequest{AssigneeID: "01ARZ3NDEKTSV4RRFFQ69G5FAV", DueTime: due})
+		if rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected status code %d for an unknown assignee, got %d", http.StatusUnprocessableEntity, rr.Code)
+		}
+		rr = loanRequest(t, CrudDeviceHandler, http.MethodPost, "/device/"+device.PublicID+"/lend", nil)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d for an unknown action, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("should check a device out and in", func(t *testing.T) {
+		rr := loanRequest(t, CrudDeviceHandler, http.MethodPost, checkoutURL, checkoutRequest{AssigneeID: assignee.PublicID, DueTime: due})
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %v", http.StatusOK, rr.Code, rr.Body)
+		}
+		var checkedOut Device
+		json.Unmarshal(rr.Body.Bytes(), &checkedOut)
+		if checkedOut.Holder == nil || checkedOut.Holder.AssigneeID != assignee.PublicID {
+			t.Errorf("expected the device to be held by %v, got %+v", assignee.PublicID, checkedOut.Holder)
+		}
+		rr = loanRequest(t, CrudDeviceHandler, http.MethodDelete, "/device/"+device.PublicID, nil)
+		if rr.Code != http.StatusConflict {
+			t.Errorf("expected status code %d for deleting a device on loan, got %d", http.StatusConflict, rr.Code)
+		}
+		rr = loanRequest(t, CrudDeviceHandler, http.MethodPost, checkoutURL, checkoutRequest{AssigneeID: assignee.PublicID, DueTime: due})
+		if rr.Code != http.StatusConflict {
+			t.Errorf("expected status code %d for a second checkout, got %d", http.StatusConflict, rr.Code)
+		}
+
+		rr = loanRequest(t, CrudDevicesHandler, http.MethodGet, "/devices?assigned_to="+assignee.PublicID, nil)
+		var held []Device
+		json.Unmarshal(rr.Body.Bytes(), &held)
+		if rr.Code != http.StatusOK || len(held) != 1 || held[0].PublicID != device.PublicID {
+			t.Errorf("expected the device to be listed for its assignee, got %d %v", rr.Code, rr.Body)
+		}
+		rr = loanRequest(t, CrudDevicesHandler, http.MethodGet, "/devices?overdue=true", nil)
+		var overdue []Device
+		json.Unmarshal(rr.Body.Bytes(), &overdue)
+		for _, d := range overdue {
+			if d.PublicID == device.PublicID {
+				t.Errorf("expected the device not to be overdue before %v", due)
+			}
+		}
+
+		rr = loanRequest(t, CrudDeviceHandler, http.MethodPost, checkinURL, nil)
+		if rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %v", http.StatusOK, rr.Code, rr.Body)
+		}
+		var checkedIn Device
+		json.Unmarshal(rr.Body.Bytes(), &checkedIn)
+		if checkedIn.Holder != nil {
+			t.Errorf("expected no holder after checkin, got %+v", checkedIn.Holder)
+		}
+		rr = loanRequest(t, CrudDeviceHandler, http.MethodPost, checkinURL, nil)
+		if rr.Code != http.StatusConflict {
+			t.Errorf("expected status code %d for a second checkin, got %d", http.StatusConflict, rr.Code)
+		}
+	})
+
+	t.Run("should reject combined filters and unknown assignees", func(t *testing.T) {
+		rr := loanRequest(t, CrudDevicesHandler, http.MethodGet, "/devices?brand=Loan%20Brand&overdue=true", nil)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		rr = loanRequest(t, CrudDevicesHandler, http.MethodGet, "/devices?assigned_to=01ARZ3NDEKTSV4RRFFQ69G5FAV", nil)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("should need write access to the brand", func(t *testing.T) {
+		acme, err := repository.SaveDevice(ctx, Device{Name: uniqueDeviceName(), Brand: "Acme"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bob := Principal{Subject: "bob"}
+		rr := rbacRequest(t, bob, http.MethodPost, "/device/"+acme.PublicID+"/checkout",
+			checkoutRequest{AssigneeID: assignee.PublicID, DueTime: due}, CrudDeviceHandler)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d: %v", http.StatusForbidden, rr.Code, rr.Body)
+		}
+	})
+}
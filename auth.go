@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	ScopeDevicesRead   = "devices:read"
+	ScopeDevicesWrite  = "devices:write"
+	ScopeDevicesDelete = "devices:delete"
+	ScopeAdmin         = "admin"
+)
+
+var knownScopes = []string{ScopeDevicesRead, ScopeDevicesWrite, ScopeDevicesDelete, ScopeAdmin}
+
+var (
+	ErrNoCredentials      = errors.New("missing bearer token")
+	ErrInvalidCredentials = errors.New("invalid bearer token")
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Subject string
+	Tenant  string
+	Groups  []string
+	Scopes  []string
+}
+
+func (p Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+type Authenticator interface {
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+type principalKey struct{}
+
+func withPrincipal(ctx context.Context, p Principal) context.Context {
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+func principalFromContext(ctx context.Context) (Principal, bool) {
+	p, ok := ctx.Value(principalKey{}).(Principal)
+	return p, ok
+}
+
+// bearerToken extracts the token from an "Authorization: Bearer <token>" header
+func bearerToken(r *http.Request) (string, error) {
+	header := r.Header.Get("Authorization")
+	if header == "" {
+		return "", ErrNoCredentials
+	}
+	scheme, token, ok := strings.Cut(header, " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") || strings.TrimSpace(token) == "" {
+		return "", ErrInvalidCredentials
+	}
+	return strings.TrimSpace(token), nil
+}
+
+// deviceScope maps a device request to the scope it needs
+func deviceScope(r *http.Request) string {
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		return ScopeDevicesRead
+	case http.MethodDelete:
+		return ScopeDevicesDelete
+	default:
+		return ScopeDevicesWrite
+	}
+}
+
+func adminScope(r *http.Request) string {
+	return ScopeAdmin
+}
+
+// requireScope authenticates the request and checks the principal holds the scope returned by
+// scopeFor before calling next
+func requireScope(auth Authenticator, scopeFor func(r *http.Request) string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		principal, err := auth.Authenticate(r)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="device-store"`)
+			writeProblem(w, http.StatusUnauthorized, err.Error())
+			return
+		}
+		scope := scopeFor(r)
+		if !principal.HasScope(scope) {
+			writeProblem(w, http.StatusForbidden, "missing scope "+scope)
+			return
+		}
+		next(w, r.WithContext(withPrincipal(r.Context(), principal)))
+	}
+}
+
+// Problem is an RFC 7807 problem details body
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+func writeProblem(w http.ResponseWriter, status int, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(Problem{
+		Type:   "about:blank",
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+	})
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+const testAdminKey = "test-admin-key"
+
+func issueTestAPIKey(t *testing.T, scopes ...string) APIKey {
+	t.Helper()
+	keyStub, err := json.Marshal(APIKey{Name: "test key", Scopes: scopes})
+	if err != nil {
+		t.Fatal(err)
+	}
+	req, err := http.NewRequest("POST", "/admin/api-keys", bytes.NewReader(keyStub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Authorization", "Bearer "+testAdminKey)
+	rr := httptest.NewRecorder()
+	auth := APIKeyAuthenticator{repo: apiKeyRepository, adminKey: testAdminKey}
+	requireScope(auth, adminScope, CrudAPIKeysHandler).ServeHTTP(rr, req)
+	if rr.Code != http.StatusCreated {
+		t.Fatalf("expected status code %d, got %d: %v", http.StatusCreated, rr.Code, rr.Body.String())
+	}
+	var key APIKey
+	err = json.Unmarshal(rr.Body.Bytes(), &key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func authenticatedRequest(t *testing.T, method string, url string, token string) *httptest.ResponseRecorder {
+	t.Helper()
+	req, err := http.NewRequest(method, url, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rr := httptest.NewRecorder()
+	auth := APIKeyAuthenticator{repo: apiKeyRepository, adminKey: testAdminKey}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/device/", requireScope(auth, deviceScope, CrudDeviceHandler))
+	mux.HandleFunc("/devices", requireScope(auth, deviceScope, CrudDevicesHandler))
+	mux.HandleFunc("/admin/api-keys", requireScope(auth, adminScope, CrudAPIKeysHandler))
+	mux.HandleFunc("/admin/api-keys/", requireScope(auth, adminScope, CrudAPIKeyHandler))
+	mux.ServeHTTP(rr, req)
+	return rr
+}
+
+func Test_APIKeyAuthentication(t *testing.T) {
+	t.Run("should issue key and allow scoped requests", func(t *testing.T) {
+		key := issueTestAPIKey(t, ScopeDevicesRead)
+		if key.Key == "" || key.ID == 0 {
+			t.Fatalf("expected issued key with id, got %v", key)
+		}
+		rr := authenticatedRequest(t, "GET", "/devices", key.Key)
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+	})
+
+	t.Run("should return 401 for missing or unknown key", func(t *testing.T) {
+		for _, token := range []string{"", "ds_unknown", "not-a-key"} {
+			rr := authenticatedRequest(t, "GET", "/devices", token)
+			if rr.Code != http.StatusUnauthorized {
+				t.Errorf("expected status code %d for %q, got %d", http.StatusUnauthorized, token, rr.Code)
+			}
+			if rr.Header().Get("WWW-Authenticate") == "" {
+				t.Errorf("expected WWW-Authenticate header for %q", token)
+			}
+			if rr.Header().Get("Content-Type") != "application/problem+json" {
+				t.Errorf("expected problem response, got %v", rr.Header().Get("Content-Type"))
+			}
+		}
+	})
+
+	t.Run("should return 403 when the key lacks the scope", func(t *testing.T) {
+		device, err := repository.SaveDevice(context.Background(), Device{Name: "Auth Device", Brand: "Auth Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		key := issueTestAPIKey(t, ScopeDevicesRead, ScopeDevicesWrite)
+		rr := authenticatedRequest(t, "DELETE", "/device/"+device.PublicID, key.Key)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		var problem Problem
+		err = json.Unmarshal(rr.Body.Bytes(), &problem)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if problem.Status != http.StatusForbidden || problem.Detail != "missing scope "+ScopeDevicesDelete {
+			t.Errorf("expected forbidden problem for %v, got %v", ScopeDevicesDelete, problem)
+		}
+		_, err = repository.FindDeviceByID(context.Background(), device.ID)
+		if err != nil {
+			t.Errorf("expected device to still exist, got %v", err)
+		}
+
+		rr = authenticatedRequest(t, "GET", "/admin/api-keys", key.Key)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+	})
+
+	t.Run("should reject revoked keys", func(t *testing.T) {
+		key := issueTestAPIKey(t, ScopeDevicesRead)
+		rr := authenticatedRequest(t, "DELETE", "/admin/api-keys/"+strconv.Itoa(key.ID), testAdminKey)
+		if rr.Code != http.StatusNoContent {
+			t.Fatalf("expected status code %d, got %d", http.StatusNoContent, rr.Code)
+		}
+		rr = authenticatedRequest(t, "GET", "/devices", key.Key)
+		if rr.Code != http.StatusUnauthorized {
+			t.Errorf("expected status code %d, got %d", http.StatusUnauthorized, rr.Code)
+		}
+		rr = authenticatedRequest(t, "DELETE", "/admin/api-keys/100000", testAdminKey)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+
+	t.Run("should return 400 bad request for unknown scope", func(t *testing.T) {
+		keyStub, err := json.Marshal(APIKey{Name: "bad key", Scopes: []string{"devices:everything"}})
+		req, err := http.NewRequest("POST", "/admin/api-keys", bytes.NewReader(keyStub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(CrudAPIKeysHandler).ServeHTTP(rr, req)
+		if rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+	})
+	repository.DeleteAllDevices()
+}
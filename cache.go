@@ -0,0 +1,387 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	deviceCacheLookups = newCounterVec("device_cache_lookups_total",
+		"Device lookups by method and result: hit, negative_hit or miss.", "method", "result")
+	deviceCacheEvictions = newCounter("device_cache_evictions_total",
+		"Entries evicted from the device cache to make room for others.")
+	deviceCacheRemoteInvalidations = newCounter("device_cache_remote_invalidations_total",
+		"Device changes of other replicas received on the invalidation bus.")
+)
+
+// CacheConfig sizes the device cache, a Size of 0 disables it
+type CacheConfig struct {
+	Size int
+	// TTL bounds how long another replica's changes can go unnoticed
+	TTL time.Duration
+	// NegativeTTL is how long a device that was not found stays not found
+	NegativeTTL time.Duration
+}
+
+// deviceCacheConfig reads DEVICE_CACHE_SIZE, DEVICE_CACHE_TTL and DEVICE_CACHE_NEGATIVE_TTL. The cache is off unless
+// DEVICE_CACHE_SIZE is set, a deployment turning it on picks the invalidation its replicas need.
+func deviceCacheConfig() (CacheConfig, error) {
+	size, err := strconv.Atoi(getEnv("DEVICE_CACHE_SIZE", "0"))
+	if err != nil || size < 0 {
+		return CacheConfig{}, fmt.Errorf("invalid DEVICE_CACHE_SIZE %q", os.Getenv("DEVICE_CACHE_SIZE"))
+	}
+	ttl, err := time.ParseDuration(getEnv("DEVICE_CACHE_TTL", "30s"))
+	if err != nil || ttl <= 0 {
+		return CacheConfig{}, fmt.Errorf("invalid DEVICE_CACHE_TTL %q", os.Getenv("DEVICE_CACHE_TTL"))
+	}
+	negativeTTL, err := time.ParseDuration(getEnv("DEVICE_CACHE_NEGATIVE_TTL", "5s"))
+	if err != nil || negativeTTL < 0 {
+		return CacheConfig{}, fmt.Errorf("invalid DEVICE_CACHE_NEGATIVE_TTL %q", os.Getenv("DEVICE_CACHE_NEGATIVE_TTL"))
+	}
+	return CacheConfig{Size: size, TTL: ttl, NegativeTTL: negativeTTL}, nil
+}
+
+// cacheEntry is a device, or the absence of one when found is false, under one of its keys
+type cacheEntry struct {
+	key     string
+	tenant  string
+	device  Device
+	found   bool
+	expires time.Time
+}
+
+// flight is a load in progress that concurrent misses of the same key wait for
+type flight struct {
+	done   chan struct{}
+	device Device
+	err    error
+}
+
+// CachedRepository serves FindDeviceByID and FindDeviceByPublicID from an in-process LRU. Devices are cached
+// under both ids, not found results for NegativeTTL. Writes through the cache invalidate what they touch
+// and are announced on the bus, writes of other replicas show up when Listen hears of them or once the
+// entries expire. Misses are loaded from the primary, a lagging replica would keep a stale device around
+// for a whole TTL. Lists are not cached.
+type CachedRepository struct {
+	next   Repository
+	config CacheConfig
+	// bus tells the other replicas about changes made through this one, it may be nil
+	bus InvalidationBus
+	now func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	lru     *list.List
+	flights map[string]*flight
+	// generation changes on every invalidation so loads that raced with one are not stored
+	generation uint64
+}
+
+func NewCachedRepository(next Repository, config CacheConfig, bus InvalidationBus) *CachedRepository {
+	return &CachedRepository{
+		next:    next,
+		config:  config,
+		bus:     bus,
+		now:     time.Now,
+		entries: map[string]*list.Element{},
+		lru:     list.New(),
+		flights: map[string]*flight{},
+	}
+}
+
+func idKey(tenant string, id int) string {
+	return tenant + "\x00id\x00" + strconv.Itoa(id)
+}
+
+func publicIDKey(tenant string, publicID string) string {
+	return tenant + "\x00public_id\x00" + publicID
+}
+
+func (c *CachedRepository) FindDeviceByID(ctx context.Context, id int) (Device, error) {
+	return c.lookup(ctx, "FindDeviceByID", idKey(tenantFromContext(ctx), id), func() (Device, error) {
+		return c.next.FindDeviceByID(withPrimaryReads(ctx), id)
+	})
+}
+
+func (c *CachedRepository) FindDeviceByPublicID(ctx context.Context, publicID string) (Device, error) {
+	return c.lookup(ctx, "FindDeviceByPublicID", publicIDKey(tenantFromContext(ctx), publicID), func() (Device, error) {
+		return c.next.FindDeviceByPublicID(withPrimaryReads(ctx), publicID)
+	})
+}
+
+// lookup answers from the cache or loads the device once for all concurrent misses of key
+func (c *CachedRepository) lookup(ctx context.Context, method string, key string, load func() (Device, error)) (Device, error) {
+	if entry, ok := c.get(key); ok {
+		if !entry.found {
+			deviceCacheLookups.WithLabelValues(method, "negative_hit").Inc()
+			return Device{}, sql.ErrNoRows
+		}
+		deviceCacheLookups.WithLabelValues(method, "hit").Inc()
+		return entry.device, nil
+	}
+	deviceCacheLookups.WithLabelValues(method, "miss").Inc()
+
+	c.mu.Lock()
+	if f, ok := c.flights[key]; ok {
+		c.mu.Unlock()
+		select {
+		case <-f.done:
+			return f.device, f.err
+		case <-ctx.Done():
+			return Device{}, ctx.Err()
+		}
+	}
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	generation := c.generation
+	c.mu.Unlock()
+
+	f.device, f.err = load()
+
+	c.mu.Lock()
+	delete(c.flights, key)
+	if generation == c.generation {
+		tenant := tenantFromContext(ctx)
+		switch {
+		case f.err == nil:
+			c.putDevice(tenant, f.device)
+		case errors.Is(f.err, sql.ErrNoRows) && c.config.NegativeTTL > 0:
+			c.put(&cacheEntry{key: key, tenant: tenant, expires: c.now().Add(c.config.NegativeTTL)})
+		}
+	}
+	c.mu.Unlock()
+	close(f.done)
+	return f.device, f.err
+}
+
+func (c *CachedRepository) get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	element, ok := c.entries[key]
+	if !ok {
+		return cacheEntry{}, false
+	}
+	entry := element.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(key)
+		return cacheEntry{}, false
+	}
+	if entry.found {
+		// a device is used as a whole, whichever id it was looked up by
+		c.touch(idKey(entry.tenant, entry.device.ID))
+		c.touch(publicIDKey(entry.tenant, entry.device.PublicID))
+	} else {
+		c.lru.MoveToFront(element)
+	}
+	return *entry, true
+}
+
+func (c *CachedRepository) touch(key string) {
+	if element, ok := c.entries[key]; ok {
+		c.lru.MoveToFront(element)
+	}
+}
+
+// putDevice caches device under its id and public id, c.mu must be held
+func (c *CachedRepository) putDevice(tenant string, device Device) {
+	expires := c.now().Add(c.config.TTL)
+	c.put(&cacheEntry{key: idKey(tenant, device.ID), tenant: tenant, device: device, found: true, expires: expires})
+	if device.PublicID != "" {
+		c.put(&cacheEntry{key: publicIDKey(tenant, device.PublicID), tenant: tenant, device: device, found: true, expires: expires})
+	}
+}
+
+// put adds or replaces an entry and evicts the least recently used devices beyond Size, c.mu must be held
+func (c *CachedRepository) put(entry *cacheEntry) {
+	if element, ok := c.entries[entry.key]; ok {
+		element.Value = entry
+		c.lru.MoveToFront(element)
+	} else {
+		c.entries[entry.key] = c.lru.PushFront(entry)
+	}
+	for c.lru.Len() > c.config.Size {
+		c.remove(c.lru.Back().Value.(*cacheEntry).key)
+		deviceCacheEvictions.Inc()
+	}
+}
+
+// remove drops the entry under key, for a device the entry under its other id as well, c.mu must be held
+func (c *CachedRepository) remove(key string) {
+	element, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	entry := element.Value.(*cacheEntry)
+	c.lru.Remove(element)
+	delete(c.entries, key)
+	if entry.found {
+		c.remove(idKey(entry.tenant, entry.device.ID))
+		c.remove(publicIDKey(entry.tenant, entry.device.PublicID))
+	}
+}
+
+// invalidate drops what is cached about the device with id and publicID, either may be unknown
+func (c *CachedRepository) invalidate(tenant string, id int, publicID string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.remove(idKey(tenant, id))
+	if publicID != "" {
+		c.remove(publicIDKey(tenant, publicID))
+	}
+}
+
+// changed invalidates the device here and on the other replicas
+func (c *CachedRepository) changed(ctx context.Context, id int, publicID string) {
+	c.announce(ctx, Invalidation{Tenant: tenantFromContext(ctx), DeviceID: id, PublicID: publicID})
+}
+
+func (c *CachedRepository) announce(ctx context.Context, invalidation Invalidation) {
+	c.invalidate(invalidation.Tenant, invalidation.DeviceID, invalidation.PublicID)
+	if c.bus == nil {
+		return
+	}
+	if err := c.bus.Publish(ctx, invalidation); err != nil {
+		slog.WarnContext(ctx, "Error publishing cache invalidation", "device_id", invalidation.DeviceID, "error", err)
+	}
+}
+
+// Listen evicts the devices other replicas changed until ctx is cancelled
+func (c *CachedRepository) Listen(ctx context.Context) {
+	if c.bus == nil {
+		return
+	}
+	c.bus.Run(ctx, func(invalidation Invalidation) {
+		deviceCacheRemoteInvalidations.Inc()
+		c.invalidate(invalidation.Tenant, invalidation.DeviceID, invalidation.PublicID)
+	})
+}
+
+func (c *CachedRepository) SaveDevice(ctx context.Context, device Device) (Device, error) {
+	device, err := c.next.SaveDevice(ctx, device)
+	if err == nil {
+		// the new ids may have been looked up before they existed
+		c.changed(ctx, device.ID, device.PublicID)
+	}
+	return device, err
+}
+
+func (c *CachedRepository) FindDevicesByBrand(ctx context.Context, brand string) ([]Device, error) {
+	return c.next.FindDevicesByBrand(ctx, brand)
+}
+
+func (c *CachedRepository) FindAllDevices(ctx context.Context) ([]Device, error) {
+	return c.next.FindAllDevices(ctx)
+}
+
+// UpdateDevice and DeleteDevice invalidate even when they fail, a failed commit may still have been applied
+func (c *CachedRepository) UpdateDevice(ctx context.Context, device Device) (Device, error) {
+	updated, err := c.next.UpdateDevice(ctx, device)
+	c.changed(ctx, device.ID, device.PublicID)
+	return updated, err
+}
+
+func (c *CachedRepository) DeleteDevice(ctx context.Context, id int) error {
+	err := c.next.DeleteDevice(ctx, id)
+	c.changed(ctx, id, "")
+	return err
+}
+
+// CheckoutDevice and CheckinDevice change the holder of the cached device, they invalidate like UpdateDevice
+func (c *CachedRepository) CheckoutDevice(ctx context.Context, id int, assigneeID int, due time.Time) (Device, error) {
+	device, err := c.next.CheckoutDevice(ctx, id, assigneeID, due)
+	c.changed(ctx, id, device.PublicID)
+	return device, err
+}
+
+func (c *CachedRepository) CheckinDevice(ctx context.Context, id int) (Device, error) {
+	device, err := c.next.CheckinDevice(ctx, id)
+	c.changed(ctx, id, device.PublicID)
+	return device, err
+}
+
+func (c *CachedRepository) FindDevicesByAssignee(ctx context.Context, assigneeID int) ([]Device, error) {
+	return c.next.FindDevicesByAssignee(ctx, assigneeID)
+}
+
+func (c *CachedRepository) FindOverdueDevices(ctx context.Context, now time.Time) ([]Device, error) {
+	return c.next.FindOverdueDevices(ctx, now)
+}
+
+// WithTx bypasses the cache inside the unit of work, which has to see its own changes, and invalidates
+// the devices it changed once it is over
+func (c *CachedRepository) WithTx(ctx context.Context, opts TxOptions, fn func(tx Repository) error) error {
+	var changed []Invalidation
+	err := c.next.WithTx(ctx, opts, func(next Repository) error {
+		return fn(cachedTx{Repository: next, changed: &changed})
+	})
+	for _, invalidation := range changed {
+		c.announce(ctx, invalidation)
+	}
+	return err
+}
+
+// cachedTx records the devices a unit of work changes, including those of attempts that were rolled back
+type cachedTx struct {
+	Repository
+	changed *[]Invalidation
+}
+
+func (t cachedTx) record(ctx context.Context, id int, publicID string) {
+	*t.changed = append(*t.changed, Invalidation{Tenant: tenantFromContext(ctx), DeviceID: id, PublicID: publicID})
+}
+
+func (t cachedTx) SaveDevice(ctx context.Context, device Device) (Device, error) {
+	device, err := t.Repository.SaveDevice(ctx, device)
+	if err == nil {
+		t.record(ctx, device.ID, device.PublicID)
+	}
+	return device, err
+}
+
+func (t cachedTx) UpdateDevice(ctx context.Context, device Device) (Device, error) {
+	updated, err := t.Repository.UpdateDevice(ctx, device)
+	t.record(ctx, device.ID, device.PublicID)
+	return updated, err
+}
+
+func (t cachedTx) DeleteDevice(ctx context.Context, id int) error {
+	err := t.Repository.DeleteDevice(ctx, id)
+	t.record(ctx, id, "")
+	return err
+}
+
+func (t cachedTx) CheckoutDevice(ctx context.Context, id int, assigneeID int, due time.Time) (Device, error) {
+	device, err := t.Repository.CheckoutDevice(ctx, id, assigneeID, due)
+	t.record(ctx, id, device.PublicID)
+	return device, err
+}
+
+func (t cachedTx) CheckinDevice(ctx context.Context, id int) (Device, error) {
+	device, err := t.Repository.CheckinDevice(ctx, id)
+	t.record(ctx, id, device.PublicID)
+	return device, err
+}
+
+func (t cachedTx) WithTx(ctx context.Context, opts TxOptions, fn func(tx Repository) error) error {
+	return t.Repository.WithTx(ctx, opts, func(next Repository) error {
+		return fn(cachedTx{Repository: next, changed: t.changed})
+	})
+}
+
+func (c *CachedRepository) DeleteAllDevices() {
+	c.next.DeleteAllDevices()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generation++
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"time"
+)
+
+// Invalidation tells the caches of all replicas that a device changed, PublicID may be unknown
+type Invalidation struct {
+	Tenant   string `json:"tenant"`
+	DeviceID int    `json:"device_id"`
+	PublicID string `json:"public_id,omitempty"`
+}
+
+// InvalidationBus carries invalidations between the device caches of the replicas
+type InvalidationBus interface {
+	// Publish announces a committed change of a device
+	Publish(ctx context.Context, invalidation Invalidation) error
+	// Run hands the invalidations of every replica to handle until ctx is cancelled
+	Run(ctx context.Context, handle func(Invalidation))
+}
+
+// newInvalidationBus selects the bus with CACHE_INVALIDATION: outbox (the default), multicast or none
+func newInvalidationBus(db *sql.DB, dialect Dialect) (InvalidationBus, error) {
+	switch kind := getEnv("CACHE_INVALIDATION", "outbox"); kind {
+	case "outbox":
+		interval, err := time.ParseDuration(getEnv("CACHE_INVALIDATION_INTERVAL", "1s"))
+		if err != nil || interval <= 0 {
+			return nil, fmt.Errorf("invalid CACHE_INVALIDATION_INTERVAL %q", os.Getenv("CACHE_INVALIDATION_INTERVAL"))
+		}
+		return NewOutboxInvalidationBus(db, dialect, interval), nil
+	case "multicast":
+		return NewMulticastInvalidationBus(getEnv("CACHE_INVALIDATION_GROUP", "239.255.77.77:7946"))
+	case "none":
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("unknown CACHE_INVALIDATION %q, use outbox, multicast or none", kind)
+	}
+}
+
+// OutboxInvalidationBus follows device_outbox, which every replica writes in the transaction of a change,
+// so no change is missed and Publish has nothing to do. Changes are seen within interval of their commit.
+type OutboxInvalidationBus struct {
+	db       *sql.DB
+	dialect  Dialect
+	interval time.Duration
+	batch    int
+	// grace is how long an id missing below the ones seen is waited for, see outboxCursor
+	grace time.Duration
+}
+
+func NewOutboxInvalidationBus(db *sql.DB, dialect Dialect, interval time.Duration) *OutboxInvalidationBus {
+	return &OutboxInvalidationBus{db: db, dialect: dialect, interval: interval, batch: 500, grace: 30 * time.Second}
+}
+
+func (b *OutboxInvalidationBus) Publish(ctx context.Context, invalidation Invalidation) error {
+	return nil
+}
+
+func (b *OutboxInvalidationBus) Run(ctx context.Context, handle func(Invalidation)) {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+	var cursor *outboxCursor
+	for {
+		if cursor == nil {
+			// only changes made from now on can be stale in the caches, they start empty
+			var last int64
+			err := b.db.QueryRowContext(ctx, "SELECT COALESCE(MAX(id), 0) FROM device_outbox").Scan(&last)
+			if err != nil {
+				slog.ErrorContext(ctx, "Error reading outbox position", "error", err)
+			} else {
+				cursor = newOutboxCursor(last)
+			}
+		} else if err := b.poll(ctx, cursor, handle); err != nil {
+			slog.ErrorContext(ctx, "Error polling outbox for invalidations", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// poll hands every outbox event not handled yet to handle, batch by batch. The batches page by the last id
+// read rather than by the cursor, which stays put while it waits for a gap below rows already seen.
+func (b *OutboxInvalidationBus) poll(ctx context.Context, cursor *outboxCursor, handle func(Invalidation)) error {
+	after := cursor.low
+	for {
+		query := "SELECT id, tenant_id, device_id, payload FROM device_outbox WHERE id > ? ORDER BY id LIMIT ?"
+		rows, err := b.db.QueryContext(ctx, b.dialect.bind(query), after, b.batch)
+		if err != nil {
+			return err
+		}
+		n := 0
+		for rows.Next() {
+			n++
+			var id int64
+			var invalidation Invalidation
+			var payload string
+			if err := rows.Scan(&id, &invalidation.Tenant, &invalidation.DeviceID, &payload); err != nil {
+				rows.Close()
+				return err
+			}
+			after = id
+			if cursor.seen[id] {
+				continue
+			}
+			var event DeviceEvent
+			if json.Unmarshal([]byte(payload), &event) == nil {
+				invalidation.PublicID = event.Device.PublicID
+			}
+			handle(invalidation)
+			cursor.mark(id, time.Now())
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		cursor.advance(time.Now(), b.grace)
+		if n < b.batch {
+			return nil
+		}
+	}
+}
+
+// maxOutboxGap bounds the ids waited for when the sequence jumps
+const maxOutboxGap = 1000
+
+// outboxCursor is the position of a replica in device_outbox. Ids are taken on insert but show up on commit,
+// so an id missing below the highest one seen may belong to a transaction still running. It is waited for
+// up to a grace period before it is taken for a rolled back insert.
+type outboxCursor struct {
+	// low is the id up to which everything has been handled or given up on
+	low  int64
+	high int64
+	seen map[int64]bool
+	// gaps are the ids above low not seen yet, with the time they were first missed
+	gaps map[int64]time.Time
+}
+
+func newOutboxCursor(last int64) *outboxCursor {
+	return &outboxCursor{low: last, high: last, seen: map[int64]bool{}, gaps: map[int64]time.Time{}}
+}
+
+func (c *outboxCursor) mark(id int64, now time.Time) {
+	c.seen[id] = true
+	delete(c.gaps, id)
+	if id <= c.high {
+		return
+	}
+	for missing := max(c.high+1, id-maxOutboxGap); missing < id; missing++ {
+		c.gaps[missing] = now
+	}
+	c.high = id
+}
+
+// advance gives up on gaps older than grace and moves low past every id handled
+func (c *outboxCursor) advance(now time.Time, grace time.Duration) {
+	for id, since := range c.gaps {
+		if now.Sub(since) >= grace {
+			delete(c.gaps, id)
+		}
+	}
+	for c.low < c.high {
+		if _, waiting := c.gaps[c.low+1]; waiting {
+			return
+		}
+		c.low++
+		delete(c.seen, c.low)
+	}
+}
+
+// MulticastInvalidationBus sends invalidations as UDP datagrams to a multicast group the replicas join.
+// Datagrams can be lost, the cache TTL bounds how long a lost one leaves a device stale.
+type MulticastInvalidationBus struct {
+	group *net.UDPAddr
+	conn  *net.UDPConn
+	// sender tells the datagrams of this replica apart, it has invalidated its cache already
+	sender string
+}
+
+// multicastMessage is the datagram of an invalidation
+type multicastMessage struct {
+	Sender string `json:"sender"`
+	Invalidation
+}
+
+func NewMulticastInvalidationBus(group string) (*MulticastInvalidationBus, error) {
+	addr, err := net.ResolveUDPAddr("udp", group)
+	if err != nil {
+		return nil, err
+	}
+	if !addr.IP.IsMulticast() {
+		return nil, fmt.Errorf("%v is not a multicast address", group)
+	}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 8)
+	rand.Read(id)
+	return &MulticastInvalidationBus{group: addr, conn: conn, sender: hex.EncodeToString(id)}, nil
+}
+
+func (b *MulticastInvalidationBus) Publish(ctx context.Context, invalidation Invalidation) error {
+	message, err := json.Marshal(multicastMessage{Sender: b.sender, Invalidation: invalidation})
+	if err != nil {
+		return err
+	}
+	_, err = b.conn.Write(message)
+	return err
+}
+
+func (b *MulticastInvalidationBus) Run(ctx context.Context, handle func(Invalidation)) {
+	conn, err := net.ListenMulticastUDP("udp", nil, b.group)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error joining invalidation group", "group", b.group, "error", err)
+		return
+	}
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	buf := make([]byte, 2048)
+	for {
+		n, _, err := conn.ReadFromUDP(buf)
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			slog.ErrorContext(ctx, "Error receiving invalidation", "error", err)
+			continue
+		}
+		var message multicastMessage
+		if err := json.Unmarshal(buf[:n], &message); err != nil {
+			slog.WarnContext(ctx, "Ignoring malformed invalidation", "error", err)
+			continue
+		}
+		if message.Sender != b.sender {
+			handle(message.Invalidation)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+// waitFor polls condition until it holds or timeout passes
+func waitFor(timeout time.Duration, condition func() bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		if condition() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return condition()
+}
+
+func Test_OutboxInvalidationBus(t *testing.T) {
+	ctx := context.Background()
+	config := CacheConfig{Size: 100, TTL: time.Hour, NegativeTTL: time.Hour}
+
+	t.Run("should evict devices changed through another replica", func(t *testing.T) {
+		db := sqliteRepository(t)
+		replicas := make([]*CachedRepository, 2)
+		for i := range replicas {
+			bus := NewOutboxInvalidationBus(db.db, db.dialect, 10*time.Millisecond)
+			replicas[i] = NewCachedRepository(db, config, bus)
+			listening, stop := context.WithCancel(ctx)
+			done := make(chan struct{})
+			go func() {
+				replicas[i].Listen(listening)
+				close(done)
+			}()
+			t.Cleanup(func() {
+				stop()
+				<-done
+			})
+		}
+		// let the replicas take their outbox position
+		time.Sleep(50 * time.Millisecond)
+
+		device, err := replicas[0].SaveDevice(ctx, Device{Name: "Shared", Brand: "Bus Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		replicas[1].FindDeviceByPublicID(ctx, device.PublicID)
+		device.Name = "Renamed Elsewhere"
+		if _, err := replicas[0].UpdateDevice(ctx, device); err != nil {
+			t.Fatal(err)
+		}
+		if !waitFor(2*time.Second, func() bool {
+			found, err := replicas[1].FindDeviceByPublicID(ctx, device.PublicID)
+			return err == nil && found.Name == "Renamed Elsewhere"
+		}) {
+			t.Fatal("expected the other replica to see the update")
+		}
+		if err := replicas[0].DeleteDevice(ctx, device.ID); err != nil {
+			t.Fatal(err)
+		}
+		if !waitFor(2*time.Second, func() bool {
+			_, err := replicas[1].FindDeviceByID(ctx, device.ID)
+			return err != nil
+		}) {
+			t.Fatal("expected the other replica to see the delete")
+		}
+	})
+
+	t.Run("should wait for ids committed out of order", func(t *testing.T) {
+		start := time.Now()
+		cursor := newOutboxCursor(10)
+		cursor.mark(11, start)
+		cursor.mark(13, start)
+		cursor.advance(start, time.Minute)
+		if cursor.low != 11 {
+			t.Errorf("expected to wait for 12 at 11, got %d", cursor.low)
+		}
+		cursor.mark(12, start)
+		cursor.advance(start, time.Minute)
+		if cursor.low != 13 || len(cursor.seen) != 0 {
+			t.Errorf("expected to move on to 13 once 12 showed up, got %d with %v seen", cursor.low, cursor.seen)
+		}
+
+		cursor.mark(15, start)
+		cursor.advance(start.Add(time.Minute), time.Minute)
+		if cursor.low != 15 || len(cursor.gaps) != 0 {
+			t.Errorf("expected to give up on 14 after the grace period, got %d waiting for %v", cursor.low, cursor.gaps)
+		}
+	})
+
+	t.Run("should read past a full batch of seen rows while waiting for a gap", func(t *testing.T) {
+		db := sqliteRepository(t)
+		var devices []Device
+		for _, name := range []string{"First", "Second", "Third"} {
+			device, err := db.SaveDevice(ctx, Device{Name: name, Brand: "Gap Brand"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			devices = append(devices, device)
+		}
+		var first int64
+		if err := db.db.QueryRow("SELECT MIN(id) FROM device_outbox").Scan(&first); err != nil {
+			t.Fatal(err)
+		}
+		// the id below the first row is still pending, the two rows above it are handled already
+		cursor := newOutboxCursor(first - 2)
+		cursor.mark(first, time.Now())
+		cursor.mark(first+1, time.Now())
+		bus := NewOutboxInvalidationBus(db.db, db.dialect, time.Second)
+		bus.batch = 2
+
+		polling, cancel := context.WithTimeout(ctx, 2*time.Second)
+		defer cancel()
+		var handled []Invalidation
+		err := bus.poll(polling, cursor, func(invalidation Invalidation) {
+			handled = append(handled, invalidation)
+		})
+		if err != nil {
+			t.Fatalf("expected the poll to finish, got %v", err)
+		}
+		if len(handled) != 1 || handled[0].DeviceID != devices[2].ID {
+			t.Errorf("expected only the third device to be invalidated, got %v", handled)
+		}
+		if cursor.low != first-2 {
+			t.Errorf("expected the cursor to keep waiting for %d, got %d", first-1, cursor.low)
+		}
+	})
+}
+
+func Test_MulticastInvalidationBus(t *testing.T) {
+	const group = "239.255.77.77:17946"
+
+	t.Run("should deliver invalidations to the other replicas only", func(t *testing.T) {
+		sender, err := NewMulticastInvalidationBus(group)
+		if err != nil {
+			t.Skipf("multicast is not available: %v", err)
+		}
+		receiver, err := NewMulticastInvalidationBus(group)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		received, echoed := make(chan Invalidation, 100), make(chan Invalidation, 100)
+		go receiver.Run(ctx, func(invalidation Invalidation) { received <- invalidation })
+		go sender.Run(ctx, func(invalidation Invalidation) { echoed <- invalidation })
+		expected := Invalidation{Tenant: "acme", DeviceID: 7, PublicID: "01ARZ3NDEKTSV4RRFFQ69G5FAV"}
+		// datagrams sent before the receiver joined are lost, so keep sending until one arrives
+		ticker := time.NewTicker(20 * time.Millisecond)
+		defer ticker.Stop()
+		timeout := time.After(2 * time.Second)
+		for {
+			select {
+			case got := <-received:
+				if got != expected {
+					t.Fatalf("expected %+v, got %+v", expected, got)
+				}
+				// the sender is in the group as well, its own datagrams would have reached it by now
+				time.Sleep(50 * time.Millisecond)
+				if len(echoed) != 0 {
+					t.Errorf("expected the sender to ignore its own invalidations, got %+v", <-echoed)
+				}
+				return
+			case <-ticker.C:
+				if err := sender.Publish(ctx, expected); err != nil {
+					t.Skipf("multicast is not available: %v", err)
+				}
+			case <-timeout:
+				t.Skip("no multicast route, the datagrams did not arrive")
+			}
+		}
+	})
+}
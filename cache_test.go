@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// countingRepository counts the lookups that reach the database, release blocks them while set
+type countingRepository struct {
+	Repository
+	lookups atomic.Int64
+	release chan struct{}
+	err     error
+}
+
+func (r *countingRepository) FindDeviceByID(ctx context.Context, id int) (Device, error) {
+	r.lookups.Add(1)
+	if r.release != nil {
+		<-r.release
+	}
+	if r.err != nil {
+		return Device{}, r.err
+	}
+	return r.Repository.FindDeviceByID(ctx, id)
+}
+
+func (r *countingRepository) FindDeviceByPublicID(ctx context.Context, publicID string) (Device, error) {
+	r.lookups.Add(1)
+	return r.Repository.FindDeviceByPublicID(ctx, publicID)
+}
+
+func newTestCache(t *testing.T, config CacheConfig) (*CachedRepository, *countingRepository, *time.Time) {
+	next := &countingRepository{Repository: sqliteRepository(t)}
+	cache := NewCachedRepository(next, config, nil)
+	now := time.Now()
+	cache.now = func() time.Time { return now }
+	return cache, next, &now
+}
+
+func Test_CachedRepository(t *testing.T) {
+	ctx := context.Background()
+	config := CacheConfig{Size: 100, TTL: time.Minute, NegativeTTL: time.Second}
+
+	t.Run("should serve repeated lookups by either id from the cache", func(t *testing.T) {
+		cache, next, _ := newTestCache(t, config)
+		device, err := cache.SaveDevice(ctx, Device{Name: "Cached", Brand: "Cache Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		hits := testutil.ToFloat64(deviceCacheLookups.WithLabelValues("FindDeviceByPublicID", "hit"))
+		for i := 0; i < 3; i++ {
+			if _, err := cache.FindDeviceByID(ctx, device.ID); err != nil {
+				t.Fatal(err)
+			}
+			found, err := cache.FindDeviceByPublicID(ctx, device.PublicID)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !sameDevice(found, device) {
+				t.Errorf("expected %+v, got %+v", device, found)
+			}
+		}
+		if n := next.lookups.Load(); n != 1 {
+			t.Errorf("expected 1 lookup to reach the database, got %d", n)
+		}
+		if got := testutil.ToFloat64(deviceCacheLookups.WithLabelValues("FindDeviceByPublicID", "hit")) - hits; got != 3 {
+			t.Errorf("expected 3 hits by public id, got %v", got)
+		}
+	})
+
+	t.Run("should remember missing devices for the negative ttl", func(t *testing.T) {
+		cache, next, now := newTestCache(t, config)
+		for i := 0; i < 2; i++ {
+			if _, err := cache.FindDeviceByPublicID(ctx, "01ARZ3NDEKTSV4RRFFQ69G5FAV"); !errors.Is(err, sql.ErrNoRows) {
+				t.Fatalf("expected sql.ErrNoRows, got %v", err)
+			}
+		}
+		if n := next.lookups.Load(); n != 1 {
+			t.Errorf("expected the missing device to be looked up once, got %d", n)
+		}
+		*now = now.Add(config.NegativeTTL)
+		cache.FindDeviceByPublicID(ctx, "01ARZ3NDEKTSV4RRFFQ69G5FAV")
+		if n := next.lookups.Load(); n != 2 {
+			t.Errorf("expected the missing device to be looked up again after the negative ttl, got %d", n)
+		}
+	})
+
+	t.Run("should find devices saved after they were looked up", func(t *testing.T) {
+		cache, _, _ := newTestCache(t, config)
+		if _, err := cache.FindDeviceByID(ctx, 1); !errors.Is(err, sql.ErrNoRows) {
+			t.Fatalf("expected sql.ErrNoRows, got %v", err)
+		}
+		device, err := cache.SaveDevice(ctx, Device{Name: "Late", Brand: "Cache Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cache.FindDeviceByID(ctx, device.ID); err != nil {
+			t.Errorf("expected the saved device to be found, got %v", err)
+		}
+	})
+
+	t.Run("should expire devices after the ttl", func(t *testing.T) {
+		cache, next, now := newTestCache(t, config)
+		device, err := cache.SaveDevice(ctx, Device{Name: "Expiring", Brand: "Cache Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.FindDeviceByID(ctx, device.ID)
+		*now = now.Add(config.TTL)
+		cache.FindDeviceByPublicID(ctx, device.PublicID)
+		if n := next.lookups.Load(); n != 2 {
+			t.Errorf("expected the device to be loaded again after the ttl, got %d lookups", n)
+		}
+	})
+
+	t.Run("should invalidate on update and delete", func(t *testing.T) {
+		cache, _, _ := newTestCache(t, config)
+		device, err := cache.SaveDevice(ctx, Device{Name: "Changing", Brand: "Cache Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		cache.FindDeviceByPublicID(ctx, device.PublicID)
+		device.Name = "Changed"
+		if _, err := cache.UpdateDevice(ctx, device); err != nil {
+			t.Fatal(err)
+		}
+		found, err := cache.FindDeviceByPublicID(ctx, device.PublicID)
+		if err != nil || found.Name != "Changed" {
+			t.Errorf("expected the updated device, got %+v, %v", found, err)
+		}
+		if err := cache.DeleteDevice(ctx, device.ID); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cache.FindDeviceByPublicID(ctx, device.PublicID); !errors.Is(err, sql.ErrNoRows) {
+			t.Errorf("expected the deleted device to be gone, got %v", err)
+		}
+	})
+
+	t.Run("should evict the least recently used devices", func(t *testing.T) {
+		// every device takes an entry per id
+		cache, next, _ := newTestCache(t, CacheConfig{Size: 4, TTL: time.Minute})
+		var devices []Device
+		for _, name := range []string{"First", "Second", "Third"} {
+			device, err := cache.SaveDevice(ctx, Device{Name: name, Brand: "Cache Brand"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			devices = append(devices, device)
+		}
+		cache.FindDeviceByID(ctx, devices[0].ID)
+		cache.FindDeviceByID(ctx, devices[1].ID)
+		cache.FindDeviceByID(ctx, devices[0].ID)
+		cache.FindDeviceByID(ctx, devices[2].ID)
+		next.lookups.Store(0)
+		cache.FindDeviceByPublicID(ctx, devices[0].PublicID)
+		cache.FindDeviceByPublicID(ctx, devices[2].PublicID)
+		if n := next.lookups.Load(); n != 0 {
+			t.Errorf("expected recently used devices to stay cached, got %d lookups", n)
+		}
+		cache.FindDeviceByPublicID(ctx, devices[1].PublicID)
+		if n := next.lookups.Load(); n != 1 {
+			t.Errorf("expected the least recently used device to be evicted, got %d lookups", n)
+		}
+	})
+
+	t.Run("should load concurrent misses once", func(t *testing.T) {
+		cache, next, _ := newTestCache(t, config)
+		device, err := cache.SaveDevice(ctx, Device{Name: "Contended", Brand: "Cache Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		next.release = make(chan struct{})
+		const readers = 10
+		var wg sync.WaitGroup
+		errs := make([]error, readers)
+		for i := 0; i < readers; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				_, errs[i] = cache.FindDeviceByID(ctx, device.ID)
+			}()
+		}
+		// let the readers pile up behind the first lookup
+		time.Sleep(50 * time.Millisecond)
+		close(next.release)
+		wg.Wait()
+		for _, err := range errs {
+			if err != nil {
+				t.Errorf("expected every reader to get the device, got %v", err)
+			}
+		}
+		if n := next.lookups.Load(); n != 1 {
+			t.Errorf("expected 1 lookup for %d concurrent readers, got %d", readers, n)
+		}
+	})
+
+	t.Run("should not cache failures", func(t *testing.T) {
+		cache, next, _ := newTestCache(t, config)
+		next.err = errors.New("connection refused")
+		for i := 0; i < 2; i++ {
+			if _, err := cache.FindDeviceByID(ctx, 1); !errors.Is(err, next.err) {
+				t.Fatalf("expected %v, got %v", next.err, err)
+			}
+		}
+		if n := next.lookups.Load(); n != 2 {
+			t.Errorf("expected failures to be retried, got %d lookups", n)
+		}
+	})
+}
+
+func Test_DeviceCacheConfig(t *testing.T) {
+	t.Run("should leave the cache off unless a size is set", func(t *testing.T) {
+		t.Setenv("DEVICE_CACHE_SIZE", "")
+		config, err := deviceCacheConfig()
+		if err != nil || config.Size != 0 {
+			t.Errorf("expected the cache to be off, got %+v, %v", config, err)
+		}
+		t.Setenv("DEVICE_CACHE_SIZE", "10000")
+		config, err = deviceCacheConfig()
+		if err != nil || config.Size != 10000 {
+			t.Errorf("expected a cache of 10000 devices, got %+v, %v", config, err)
+		}
+	})
+}
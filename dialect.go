@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// Dialect is the SQL flavour of the database behind a pool, the zero value is MySQL. Queries are written
+// with ? placeholders and MySQL compatible SQL, bind adapts them.
+type Dialect string
+
+const (
+	MySQL    Dialect = "mysql"
+	Postgres Dialect = "postgres"
+	SQLite   Dialect = "sqlite"
+)
+
+// openDB opens a pool for dsn. A postgres:// or postgresql:// URL selects PostgreSQL, sqlite://<path>
+// a SQLite file, anything else is taken as a MySQL DSN.
+func openDB(dsn string) (*sql.DB, Dialect, error) {
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		db, err := sql.Open("postgres", dsn)
+		return db, Postgres, err
+	}
+	if path, ok := strings.CutPrefix(dsn, "sqlite://"); ok {
+		db, err := sql.Open("sqlite", sqliteDSN(path))
+		return db, SQLite, err
+	}
+	db, err := sql.Open("mysql", strings.TrimPrefix(dsn, "mysql://"))
+	return db, MySQL, err
+}
+
+// sqliteDSN enables WAL so readers do not block the writer, waits up to 5s for the write lock instead of
+// failing with SQLITE_BUSY and begins transactions IMMEDIATE so writers are serialized when they start,
+// not when they first write. Options given in path are kept.
+func sqliteDSN(path string) string {
+	options := "_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_txlock=immediate&_time_format=sqlite"
+	if strings.Contains(path, "?") {
+		return "file:" + path + "&" + options
+	}
+	return "file:" + path + "?" + options
+}
+
+// name is the db.system of traces and the driver name
+func (d Dialect) name() string {
+	if d == "" {
+		return string(MySQL)
+	}
+	return string(d)
+}
+
+// bind adapts a query to the dialect: ? placeholders become $1, $2, ... for PostgreSQL, SQLite has no NOW()
+// and no row locks, a transaction already holds the database lock. The queries of this package never
+// contain ? inside literals, so no parsing is needed.
+func (d Dialect) bind(query string) string {
+	if d == SQLite {
+		query = strings.ReplaceAll(query, "NOW()", "CURRENT_TIMESTAMP")
+		return strings.TrimSuffix(query, " FOR UPDATE")
+	}
+	if d != Postgres || !strings.Contains(query, "?") {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// isUniqueViolation reports whether err is a duplicate key error, MySQL error 1062, SQLSTATE 23505 or
+// a SQLite unique constraint
+func (d Dialect) isUniqueViolation(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1062
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+	}
+	var stateErr interface{ SQLState() string }
+	return errors.As(err, &stateErr) && stateErr.SQLState() == "23505"
+}
+
+// isRetryable reports whether err aborted a transaction that may succeed when run again: a MySQL deadlock
+// (1213) or lock wait timeout (1205), SQLSTATE 40001 or 40P01, or a busy SQLite database
+func (d Dialect) isRetryable(err error) bool {
+	var mysqlErr *mysql.MySQLError
+	if errors.As(err, &mysqlErr) {
+		return mysqlErr.Number == 1213 || mysqlErr.Number == 1205
+	}
+	var sqliteErr *sqlite.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code()&0xff == sqlite3.SQLITE_BUSY
+	}
+	var stateErr interface{ SQLState() string }
+	return errors.As(err, &stateErr) && (stateErr.SQLState() == "40001" || stateErr.SQLState() == "40P01")
+}
+
+// transactionalDDL reports whether schema changes can be rolled back, MySQL commits every DDL statement implicitly
+func (d Dialect) transactionalDDL() bool {
+	return d == Postgres || d == SQLite
+}
+
+// insertID binds and runs an INSERT and returns the generated id. PostgreSQL drivers do not implement
+// LastInsertId, so the id is read with RETURNING instead.
+func (d Dialect) insertID(ctx context.Context, q querier, query string, args ...any) (int64, error) {
+	if d == Postgres {
+		var id int64
+		err := q.QueryRowContext(ctx, d.bind(query+" RETURNING id"), args...).Scan(&id)
+		return id, err
+	}
+	result, err := q.ExecContext(ctx, d.bind(query), args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.LastInsertId()
+}
+
+// sqliteLocks stand in for named locks, a SQLite file is served by a single process
+var sqliteLocks sync.Map
+
+// tryLock takes the session level lock name on conn without waiting, release it with unlock on the same conn
+func (d Dialect) tryLock(ctx context.Context, conn *sql.Conn, name string) (bool, error) {
+	if d == SQLite {
+		lock, _ := sqliteLocks.LoadOrStore(name, &sync.Mutex{})
+		return lock.(*sync.Mutex).TryLock(), nil
+	}
+	if d == Postgres {
+		var acquired bool
+		err := conn.QueryRowContext(ctx, "SELECT pg_try_advisory_lock(hashtext($1))", name).Scan(&acquired)
+		return acquired, err
+	}
+	var acquired sql.NullInt64
+	err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 0)", name).Scan(&acquired)
+	return acquired.Int64 == 1, err
+}
+
+// tryNamedLock takes the lock name without waiting and holds on to its connection until unlock is called,
+// named locks belong to a session
+func tryNamedLock(ctx context.Context, db *sql.DB, dialect Dialect, name string) (unlock func(), ok bool, err error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, false, err
+	}
+	acquired, err := dialect.tryLock(ctx, conn, name)
+	if err != nil || !acquired {
+		conn.Close()
+		return nil, false, err
+	}
+	unlock = func() {
+		dialect.unlock(conn, name)
+		conn.Close()
+	}
+	return unlock, true, nil
+}
+
+func (d Dialect) unlock(conn *sql.Conn, name string) {
+	if d == SQLite {
+		if lock, ok := sqliteLocks.Load(name); ok {
+			lock.(*sync.Mutex).Unlock()
+		}
+		return
+	}
+	if d == Postgres {
+		conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock(hashtext($1))", name)
+		return
+	}
+	conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", name)
+}
+
+// boundQuerier binds the placeholders of every statement for its dialect
+type boundQuerier struct {
+	q       querier
+	dialect Dialect
+}
+
+func (bq boundQuerier) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	return bq.q.ExecContext(ctx, bq.dialect.bind(query), args...)
+}
+
+func (bq boundQuerier) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	return bq.q.QueryContext(ctx, bq.dialect.bind(query), args...)
+}
+
+func (bq boundQuerier) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	return bq.q.QueryRowContext(ctx, bq.dialect.bind(query), args...)
+}
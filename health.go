@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// connectDB pings db until it answers, backing off from 500ms up to 30s between attempts
+func connectDB(ctx context.Context, db *sql.DB) error {
+	backoff := 500 * time.Millisecond
+	for {
+		pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+		err := db.PingContext(pingCtx)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		slog.WarnContext(ctx, "Failed to connect to database", "retry_in", backoff, "error", err)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
+
+// HealthCheck is a named dependency check, Check returns nil when the dependency is usable
+type HealthCheck struct {
+	Name  string
+	Check func(ctx context.Context) error
+}
+
+// databaseCheck pings the database
+func databaseCheck(db *sql.DB) HealthCheck {
+	return HealthCheck{Name: "database", Check: db.PingContext}
+}
+
+type CheckResult struct {
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+type HealthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+// Readiness reports whether the service can take traffic: every check passes and it is not draining
+type Readiness struct {
+	checks   []HealthCheck
+	timeout  time.Duration
+	draining atomic.Bool
+}
+
+func NewReadiness(checks ...HealthCheck) *Readiness {
+	return &Readiness{checks: checks, timeout: 2 * time.Second}
+}
+
+// Drain reports not ready from now on so load balancers stop routing new requests here
+func (rd *Readiness) Drain() {
+	rd.draining.Store(true)
+}
+
+// Check runs every check and returns the report and whether the service is ready
+func (rd *Readiness) Check(ctx context.Context) (HealthReport, bool) {
+	ctx, cancel := context.WithTimeout(ctx, rd.timeout)
+	defer cancel()
+	report := HealthReport{Status: "ready", Checks: map[string]CheckResult{}}
+	ready := true
+	for _, c := range rd.checks {
+		if err := c.Check(ctx); err != nil {
+			report.Checks[c.Name] = CheckResult{Status: "failing", Error: err.Error()}
+			ready = false
+			continue
+		}
+		report.Checks[c.Name] = CheckResult{Status: "ok"}
+	}
+	if rd.draining.Load() {
+		report.Checks["draining"] = CheckResult{Status: "failing", Error: "server is shutting down"}
+		ready = false
+	} else {
+		report.Checks["draining"] = CheckResult{Status: "ok"}
+	}
+	if !ready {
+		report.Status = "not ready"
+	}
+	return report, ready
+}
+
+// ReadyzHandler answers 200 when ready and 503 otherwise, with the result of every check
+func (rd *Readiness) ReadyzHandler(w http.ResponseWriter, r *http.Request) {
+	report, ready := rd.Check(r.Context())
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ready {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(report)
+}
+
+// HealthzHandler answers 200 as long as the process can serve HTTP, it checks no dependencies
+func HealthzHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	json.NewEncoder(w).Encode(HealthReport{Status: "ok"})
+}
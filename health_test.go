@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func readyz(t *testing.T, readiness *Readiness) (int, HealthReport) {
+	t.Helper()
+	rr := httptest.NewRecorder()
+	readiness.ReadyzHandler(rr, httptest.NewRequest("GET", "/readyz", nil))
+	var report HealthReport
+	if err := json.NewDecoder(rr.Body).Decode(&report); err != nil {
+		t.Fatal(err)
+	}
+	return rr.Code, report
+}
+
+func Test_Readiness(t *testing.T) {
+	db, dialect := repository.(RepositoryImpl).db, repository.(RepositoryImpl).dialect
+
+	t.Run("should be ready when the database is reachable and migrated", func(t *testing.T) {
+		code, report := readyz(t, NewReadiness(databaseCheck(db), migrationCheck(NewMigrator(db, dialect, embeddedMigrations(dialect)))))
+		if code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d: %v", http.StatusOK, code, report)
+		}
+		for _, name := range []string{"database", "migrations", "draining"} {
+			if report.Checks[name].Status != "ok" {
+				t.Errorf("expected check %v to be ok, got %v", name, report.Checks[name])
+			}
+		}
+	})
+
+	t.Run("should report failing checks", func(t *testing.T) {
+		failing := HealthCheck{Name: "broken", Check: func(ctx context.Context) error { return errors.New("boom") }}
+		code, report := readyz(t, NewReadiness(databaseCheck(db), failing))
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("expected status code %d, got %d", http.StatusServiceUnavailable, code)
+		}
+		if report.Status != "not ready" || report.Checks["broken"].Error != "boom" {
+			t.Errorf("expected broken check in report, got %v", report)
+		}
+		if report.Checks["database"].Status != "ok" {
+			t.Errorf("expected database check to be ok, got %v", report.Checks["database"])
+		}
+	})
+
+	t.Run("should not be ready while draining", func(t *testing.T) {
+		readiness := NewReadiness(databaseCheck(db))
+		readiness.Drain()
+		code, report := readyz(t, readiness)
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("expected status code %d, got %d", http.StatusServiceUnavailable, code)
+		}
+		if report.Checks["draining"].Status != "failing" {
+			t.Errorf("expected draining check to fail, got %v", report.Checks["draining"])
+		}
+	})
+
+	t.Run("should not be ready without a database", func(t *testing.T) {
+		unreachable, err := sql.Open("mysql", "user:password@tcp(127.0.0.1:1)/device_store")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer unreachable.Close()
+		code, report := readyz(t, NewReadiness(databaseCheck(unreachable), migrationCheck(NewMigrator(unreachable, MySQL, embeddedMigrations(MySQL)))))
+		if code != http.StatusServiceUnavailable {
+			t.Errorf("expected status code %d, got %d", http.StatusServiceUnavailable, code)
+		}
+		if report.Checks["database"].Status != "failing" {
+			t.Errorf("expected database check to fail, got %v", report.Checks["database"])
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		if err := connectDB(ctx, unreachable); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected connectDB to retry until the deadline, got %v", err)
+		}
+	})
+}
+
+func Test_Healthz(t *testing.T) {
+	rr := httptest.NewRecorder()
+	HealthzHandler(rr, httptest.NewRequest("GET", "/healthz", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+}
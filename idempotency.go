@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+var idempotencyRequests = newCounterVec("idempotency_requests_total",
+	"Requests carrying an Idempotency-Key by outcome: new, replayed, mismatched or in_progress.", "result")
+
+// IdempotentResponse is the stored response to the first request with a key, StatusCode is 0 while it runs.
+// Keys are scoped to the tenant and the subject of the principal that sent them.
+type IdempotentResponse struct {
+	Tenant       string
+	Subject      string
+	Key          string
+	Fingerprint  string
+	StatusCode   int
+	ContentType  string
+	Body         []byte
+	CreationTime time.Time
+	ExpiresTime  time.Time
+}
+
+type IdempotencyRepository interface {
+	// Claim stores response as running, or returns the response stored for its key with claimed false.
+	// Expired responses and running ones created before stale are replaced.
+	Claim(ctx context.Context, response IdempotentResponse, stale time.Time) (stored IdempotentResponse, claimed bool, err error)
+	// Complete stores the response of a claimed key
+	Complete(ctx context.Context, response IdempotentResponse) error
+	// Release drops a claimed key so the request can be tried again
+	Release(ctx context.Context, response IdempotentResponse) error
+	DeleteExpired(ctx context.Context, now time.Time) (int64, error)
+}
+
+type IdempotencyRepositoryImpl struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+var idempotencyRepository IdempotencyRepository
+
+func (r IdempotencyRepositoryImpl) Claim(ctx context.Context, response IdempotentResponse, stale time.Time) (IdempotentResponse, bool, error) {
+	// the stored response can expire between the insert and the select, then the claim is tried again
+	for attempt := 0; attempt < 3; attempt++ {
+		query := "DELETE FROM idempotency_keys WHERE tenant_id = ? AND subject = ? AND idempotency_key = ? AND (expires_time <= ? OR (status_code IS NULL AND creation_time <= ?))"
+		_, err := r.db.ExecContext(ctx, r.dialect.bind(query), response.Tenant, response.Subject, response.Key,
+			response.CreationTime.UTC(), stale.UTC())
+		if err != nil {
+			return IdempotentResponse{}, false, err
+		}
+		query = "INSERT INTO idempotency_keys (tenant_id, subject, idempotency_key, fingerprint, creation_time, expires_time) VALUES (?, ?, ?, ?, ?, ?)"
+		_, err = r.db.ExecContext(ctx, r.dialect.bind(query), response.Tenant, response.Subject, response.Key, response.Fingerprint,
+			response.CreationTime.UTC(), response.ExpiresTime.UTC())
+		if err == nil {
+			return response, true, nil
+		}
+		if !r.dialect.isUniqueViolation(err) {
+			return IdempotentResponse{}, false, err
+		}
+		stored, err := r.find(ctx, response.Tenant, response.Subject, response.Key)
+		if err != sql.ErrNoRows {
+			return stored, false, err
+		}
+	}
+	return IdempotentResponse{}, false, fmt.Errorf("claiming idempotency key %v: stored response keeps changing", response.Key)
+}
+
+func (r IdempotencyRepositoryImpl) find(ctx context.Context, tenant string, subject string, key string) (IdempotentResponse, error) {
+	response := IdempotentResponse{Tenant: tenant, Subject: subject, Key: key}
+	var statusCode sql.NullInt64
+	var body sql.NullString
+	query := "SELECT fingerprint, status_code, content_type, body, creation_time, expires_time FROM idempotency_keys WHERE tenant_id = ? AND subject = ? AND idempotency_key = ?"
+	err := r.db.QueryRowContext(ctx, r.dialect.bind(query), tenant, subject, key).Scan(&response.Fingerprint, &statusCode,
+		&response.ContentType, &body, &response.CreationTime, &response.ExpiresTime)
+	if err != nil {
+		return IdempotentResponse{}, err
+	}
+	response.StatusCode = int(statusCode.Int64)
+	response.Body = []byte(body.String)
+	return response, nil
+}
+
+func (r IdempotencyRepositoryImpl) Complete(ctx context.Context, response IdempotentResponse) error {
+	query := "UPDATE idempotency_keys SET status_code = ?, content_type = ?, body = ? WHERE tenant_id = ? AND subject = ? AND idempotency_key = ? AND status_code IS NULL"
+	_, err := r.db.ExecContext(ctx, r.dialect.bind(query), response.StatusCode, response.ContentType, string(response.Body),
+		response.Tenant, response.Subject, response.Key)
+	return err
+}
+
+func (r IdempotencyRepositoryImpl) Release(ctx context.Context, response IdempotentResponse) error {
+	query := "DELETE FROM idempotency_keys WHERE tenant_id = ? AND subject = ? AND idempotency_key = ? AND status_code IS NULL"
+	_, err := r.db.ExecContext(ctx, r.dialect.bind(query), response.Tenant, response.Subject, response.Key)
+	return err
+}
+
+func (r IdempotencyRepositoryImpl) DeleteExpired(ctx context.Context, now time.Time) (int64, error) {
+	query := "DELETE FROM idempotency_keys WHERE expires_time <= ?"
+	result, err := r.db.ExecContext(ctx, r.dialect.bind(query), now.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// idempotencyLockTimeout is how long a request may run before a retry with its key takes over, it outlasts
+// the write timeout of the server
+const idempotencyLockTimeout = time.Minute
+
+// maxIdempotencyKeyLength is the length of the idempotency_key column
+const maxIdempotencyKeyLength = 255
+
+// maxIdempotentBodyBytes bounds the request bodies read and the responses kept for a key, device requests and
+// responses are a few hundred bytes
+const maxIdempotentBodyBytes = 1 << 20
+
+// captureRecorder passes a response through and keeps a copy of it, up to maxIdempotentBodyBytes
+type captureRecorder struct {
+	http.ResponseWriter
+	status      int
+	contentType string
+	body        bytes.Buffer
+	// truncated is set when the response did not fit, it is not kept then
+	truncated bool
+}
+
+func (cr *captureRecorder) WriteHeader(status int) {
+	if cr.status == 0 {
+		cr.status = status
+		cr.contentType = cr.Header().Get("Content-Type")
+	}
+	cr.ResponseWriter.WriteHeader(status)
+}
+
+func (cr *captureRecorder) Write(b []byte) (int, error) {
+	if cr.status == 0 {
+		cr.WriteHeader(http.StatusOK)
+	}
+	if !cr.truncated && cr.body.Len()+len(b) <= maxIdempotentBodyBytes {
+		cr.body.Write(b)
+	} else {
+		cr.truncated = true
+		cr.body.Reset()
+	}
+	return cr.ResponseWriter.Write(b)
+}
+
+// idempotencyFingerprint identifies a request by method, path and body
+func idempotencyFingerprint(r *http.Request, body []byte) string {
+	hash := sha256.New()
+	fmt.Fprintf(hash, "%v %v\n", r.Method, r.URL.Path)
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func validIdempotencyKey(key string) bool {
+	if len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// idempotent makes POSTs with an Idempotency-Key safe to retry, device creation as well as checkouts and checkins.
+// The first response for a key of the tenant and principal is stored for ttl and replayed with Idempotent-Replayed:
+// true to every retry, a different request with the same key, another path included, is answered 422 and a retry
+// while the first request still runs 409. Server errors are not stored, the request can be retried with the same key.
+// Request bodies over maxIdempotentBodyBytes are answered 413, responses over it are not stored either.
+func idempotent(store IdempotencyRepository, ttl time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		if r.Method != http.MethodPost || key == "" {
+			next(w, r)
+			return
+		}
+		if !validIdempotencyKey(key) {
+			http.Error(w, fmt.Sprintf("Idempotency-Key must be up to %d printable characters", maxIdempotencyKeyLength), http.StatusBadRequest)
+			return
+		}
+		body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBodyBytes))
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, fmt.Sprintf("Request body must be at most %d bytes", tooLarge.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		if err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		r.Body = io.NopCloser(bytes.NewReader(body))
+
+		// a key is only replayed to the principal that sent it, another caller of the tenant cannot read its response
+		principal, _ := principalFromContext(r.Context())
+		now := time.Now()
+		claim := IdempotentResponse{
+			Tenant:       tenantFromContext(r.Context()),
+			Subject:      principal.Subject,
+			Key:          key,
+			Fingerprint:  idempotencyFingerprint(r, body),
+			CreationTime: now,
+			ExpiresTime:  now.Add(ttl),
+		}
+		stored, claimed, err := store.Claim(r.Context(), claim, now.Add(-idempotencyLockTimeout))
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error claiming idempotency key", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		switch {
+		case claimed:
+		case stored.Fingerprint != claim.Fingerprint:
+			idempotencyRequests.WithLabelValues("mismatched").Inc()
+			http.Error(w, fmt.Sprintf("Idempotency-Key %v was used for a different request", key), http.StatusUnprocessableEntity)
+			return
+		case stored.StatusCode == 0:
+			idempotencyRequests.WithLabelValues("in_progress").Inc()
+			http.Error(w, fmt.Sprintf("A request with Idempotency-Key %v is in progress", key), http.StatusConflict)
+			return
+		default:
+			idempotencyRequests.WithLabelValues("replayed").Inc()
+			if stored.ContentType != "" {
+				w.Header().Set("Content-Type", stored.ContentType)
+			}
+			w.Header().Set("Idempotent-Replayed", "true")
+			w.WriteHeader(stored.StatusCode)
+			w.Write(stored.Body)
+			return
+		}
+
+		idempotencyRequests.WithLabelValues("new").Inc()
+		rec := &captureRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		// the response is out, storing it must not depend on the client waiting for it
+		ctx := context.WithoutCancel(r.Context())
+		switch {
+		case rec.status >= http.StatusInternalServerError:
+			err = store.Release(ctx, claim)
+		case rec.truncated:
+			slog.WarnContext(r.Context(), "Not storing idempotent response, it is too large", "status", rec.status)
+			err = store.Release(ctx, claim)
+		default:
+			claim.StatusCode, claim.ContentType, claim.Body = rec.status, rec.contentType, rec.body.Bytes()
+			err = store.Complete(ctx, claim)
+		}
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error storing idempotent response", "error", err)
+		}
+	}
+}
+
+// expireIdempotencyKeys deletes the expired responses every interval until ctx is cancelled
+func expireIdempotencyKeys(store IdempotencyRepository, interval time.Duration) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			deleted, err := store.DeleteExpired(ctx, time.Now())
+			if err != nil {
+				slog.ErrorContext(ctx, "Error deleting expired idempotency keys", "error", err)
+			} else if deleted > 0 {
+				slog.DebugContext(ctx, "Deleted expired idempotency keys", "keys", deleted)
+			}
+		}
+	}
+}
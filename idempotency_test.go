@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func postWithKey(handler http.HandlerFunc, ctx context.Context, key string, body string) *httptest.ResponseRecorder {
+	return postPathWithKey(handler, ctx, "/device/", key, body)
+}
+
+func postPathWithKey(handler http.HandlerFunc, ctx context.Context, path string, key string, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body)).WithContext(ctx)
+	req.Header.Set("Idempotency-Key", key)
+	rr := httptest.NewRecorder()
+	handler(rr, req)
+	return rr
+}
+
+// uniqueIdempotencyKey returns a key no other request of the test run has
+func uniqueIdempotencyKey() string {
+	return strings.ReplaceAll(uniqueDeviceName(), " ", "-")
+}
+
+func Test_Idempotency(t *testing.T) {
+	ctx := context.Background()
+	handler := idempotent(idempotencyRepository, time.Hour, CrudDeviceHandler)
+
+	t.Run("should replay the response to the first request", func(t *testing.T) {
+		key := uniqueIdempotencyKey()
+		body := fmt.Sprintf(`{"name": %q, "brand": "Idempotent Brand"}`, uniqueDeviceName())
+		first := postWithKey(handler, ctx, key, body)
+		if first.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d: %v", http.StatusCreated, first.Code, first.Body)
+		}
+		replay := postWithKey(handler, ctx, key, body)
+		if replay.Code != first.Code || replay.Body.String() != first.Body.String() {
+			t.Errorf("expected %d %v, got %d %v", first.Code, first.Body, replay.Code, replay.Body)
+		}
+		if replay.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("expected the replay to be marked, got headers %v", replay.Header())
+		}
+		for _, rr := range []*httptest.ResponseRecorder{first, replay} {
+			if contentType := rr.Header().Get("Content-Type"); contentType != "application/json" {
+				t.Errorf("expected Content-Type application/json, got %q", contentType)
+			}
+		}
+		var device Device
+		json.Unmarshal(first.Body.Bytes(), &device)
+		if _, err := repository.FindDeviceByPublicID(ctx, device.PublicID); err != nil {
+			t.Errorf("expected the device of the first request, got %v", err)
+		}
+	})
+
+	t.Run("should reject the key for a different request", func(t *testing.T) {
+		key := uniqueIdempotencyKey()
+		first := postWithKey(handler, ctx, key, fmt.Sprintf(`{"name": %q, "brand": "Idempotent Brand"}`, uniqueDeviceName()))
+		if first.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, first.Code)
+		}
+		other := postWithKey(handler, ctx, key, fmt.Sprintf(`{"name": %q, "brand": "Idempotent Brand"}`, uniqueDeviceName()))
+		if other.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected status code %d, got %d", http.StatusUnprocessableEntity, other.Code)
+		}
+	})
+
+	t.Run("should keep the keys of tenants apart", func(t *testing.T) {
+		key := uniqueIdempotencyKey()
+		body := fmt.Sprintf(`{"name": %q, "brand": "Idempotent Brand"}`, uniqueDeviceName())
+		first := postWithKey(handler, withTenant(ctx, "idempotency-a"), key, body)
+		second := postWithKey(handler, withTenant(ctx, "idempotency-b"), key, body)
+		if first.Code != http.StatusCreated || second.Code != http.StatusCreated {
+			t.Errorf("expected both tenants to create their device, got %d and %d", first.Code, second.Code)
+		}
+		if second.Header().Get("Idempotent-Replayed") != "" {
+			t.Error("expected no replay for another tenant")
+		}
+	})
+
+	t.Run("should keep the keys of principals of a tenant apart", func(t *testing.T) {
+		key := uniqueIdempotencyKey()
+		body := fmt.Sprintf(`{"name": %q, "brand": "Idempotent Brand"}`, uniqueDeviceName())
+		alice := withPrincipal(ctx, Principal{Subject: "api-key:1"})
+		first := postWithKey(handler, alice, key, body)
+		if first.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d: %v", http.StatusCreated, first.Code, first.Body)
+		}
+		other := postWithKey(handler, withPrincipal(ctx, Principal{Subject: "api-key:2"}), key, body)
+		if other.Header().Get("Idempotent-Replayed") != "" || other.Body.String() == first.Body.String() {
+			t.Errorf("expected the response of another principal not to be replayed, got %d %v", other.Code, other.Body)
+		}
+		if replay := postWithKey(handler, alice, key, body); replay.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("expected the principal to get its response replayed, got %d %v", replay.Code, replay.Body)
+		}
+	})
+
+	t.Run("should answer retries while the first request runs with a conflict", func(t *testing.T) {
+		started, release := make(chan struct{}), make(chan struct{})
+		blocking := idempotent(idempotencyRepository, time.Hour, func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			<-release
+			w.WriteHeader(http.StatusCreated)
+		})
+		key := uniqueIdempotencyKey()
+		done := make(chan *httptest.ResponseRecorder)
+		go func() { done <- postWithKey(blocking, ctx, key, "{}") }()
+		<-started
+		retry := postWithKey(blocking, ctx, key, "{}")
+		close(release)
+		if retry.Code != http.StatusConflict {
+			t.Errorf("expected status code %d, got %d", http.StatusConflict, retry.Code)
+		}
+		if first := <-done; first.Code != http.StatusCreated {
+			t.Errorf("expected status code %d, got %d", http.StatusCreated, first.Code)
+		}
+	})
+
+	t.Run("should run the request again after a server error", func(t *testing.T) {
+		calls := 0
+		failing := idempotent(idempotencyRepository, time.Hour, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			if calls == 1 {
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusCreated)
+		})
+		key := uniqueIdempotencyKey()
+		postWithKey(failing, ctx, key, "{}")
+		if rr := postWithKey(failing, ctx, key, "{}"); rr.Code != http.StatusCreated || calls != 2 {
+			t.Errorf("expected the retry to run, got %d after %d calls", rr.Code, calls)
+		}
+	})
+
+	t.Run("should replay checkouts and checkins", func(t *testing.T) {
+		device, err := repository.SaveDevice(ctx, Device{Name: uniqueDeviceName(), Brand: "Idempotent Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assignee, err := assigneeRepository.SaveAssignee(ctx, Assignee{Name: "Idempotent Borrower"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkout := fmt.Sprintf(`{"assignee_id": %q, "due_time": %q}`, assignee.PublicID, time.Now().Add(time.Hour).UTC().Format(time.RFC3339))
+		checkoutURL, checkinURL := "/device/"+device.PublicID+"/checkout", "/device/"+device.PublicID+"/checkin"
+
+		key := uniqueIdempotencyKey()
+		first := postPathWithKey(handler, ctx, checkoutURL, key, checkout)
+		if first.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %v", http.StatusOK, first.Code, first.Body)
+		}
+		replay := postPathWithKey(handler, ctx, checkoutURL, key, checkout)
+		if replay.Code != http.StatusOK || replay.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("expected the retried checkout to be replayed instead of answering 409, got %d %v", replay.Code, replay.Body)
+		}
+		if rr := postPathWithKey(handler, ctx, checkinURL, key, ""); rr.Code != http.StatusUnprocessableEntity {
+			t.Errorf("expected status code %d for the checkout key on a checkin, got %d", http.StatusUnprocessableEntity, rr.Code)
+		}
+
+		key = uniqueIdempotencyKey()
+		if rr := postPathWithKey(handler, ctx, checkinURL, key, ""); rr.Code != http.StatusOK {
+			t.Fatalf("expected status code %d, got %d: %v", http.StatusOK, rr.Code, rr.Body)
+		}
+		if rr := postPathWithKey(handler, ctx, checkinURL, key, ""); rr.Code != http.StatusOK || rr.Header().Get("Idempotent-Replayed") != "true" {
+			t.Errorf("expected the retried checkin to be replayed, got %d %v", rr.Code, rr.Body)
+		}
+	})
+
+	t.Run("should reject invalid keys", func(t *testing.T) {
+		for _, key := range []string{"with space", strings.Repeat("k", maxIdempotencyKeyLength+1)} {
+			if rr := postWithKey(handler, ctx, key, "{}"); rr.Code != http.StatusBadRequest {
+				t.Errorf("expected status code %d for %q, got %d", http.StatusBadRequest, key, rr.Code)
+			}
+		}
+	})
+
+	t.Run("should refuse bodies over the limit and not store large responses", func(t *testing.T) {
+		calls := 0
+		large := idempotent(idempotencyRepository, time.Hour, func(w http.ResponseWriter, r *http.Request) {
+			calls++
+			w.WriteHeader(http.StatusCreated)
+			w.Write([]byte(strings.Repeat("x", maxIdempotentBodyBytes+1)))
+		})
+		rr := postWithKey(large, ctx, uniqueIdempotencyKey(), strings.Repeat("x", maxIdempotentBodyBytes+1))
+		if rr.Code != http.StatusRequestEntityTooLarge || calls != 0 {
+			t.Errorf("expected status code %d without calling the handler, got %d after %d calls", http.StatusRequestEntityTooLarge, rr.Code, calls)
+		}
+		key := uniqueIdempotencyKey()
+		first := postWithKey(large, ctx, key, "{}")
+		if first.Code != http.StatusCreated || first.Body.Len() != maxIdempotentBodyBytes+1 {
+			t.Errorf("expected the whole response to be passed through, got %d with %d bytes", first.Code, first.Body.Len())
+		}
+		if retry := postWithKey(large, ctx, key, "{}"); retry.Header().Get("Idempotent-Replayed") != "" || calls != 2 {
+			t.Errorf("expected the retry to run again, got %d calls", calls)
+		}
+	})
+
+	t.Run("should forget expired keys", func(t *testing.T) {
+		now := time.Now()
+		claim := IdempotentResponse{Tenant: DefaultTenant, Key: uniqueIdempotencyKey(), Fingerprint: strings.Repeat("a", 64),
+			CreationTime: now.Add(-2 * time.Hour), ExpiresTime: now.Add(-time.Hour)}
+		if _, claimed, err := idempotencyRepository.Claim(ctx, claim, now.Add(-idempotencyLockTimeout)); err != nil || !claimed {
+			t.Fatalf("expected the key to be claimed, got %v, %v", claimed, err)
+		}
+		claim.StatusCode = http.StatusCreated
+		if err := idempotencyRepository.Complete(ctx, claim); err != nil {
+			t.Fatal(err)
+		}
+		claim.Fingerprint = strings.Repeat("b", 64)
+		claim.CreationTime, claim.ExpiresTime = now, now.Add(time.Hour)
+		if _, claimed, err := idempotencyRepository.Claim(ctx, claim, now.Add(-idempotencyLockTimeout)); err != nil || !claimed {
+			t.Errorf("expected the expired key to be claimed again, got %v, %v", claimed, err)
+		}
+		if _, err := idempotencyRepository.DeleteExpired(ctx, now.Add(2*time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if _, claimed, _ := idempotencyRepository.Claim(ctx, claim, now.Add(-idempotencyLockTimeout)); !claimed {
+			t.Error("expected the key to be deleted once expired")
+		}
+	})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var (
+	httpRequests = newCounterVec("http_requests_total",
+		"HTTP requests by route, method and status.", "route", "method", "status")
+	httpRequestDuration = newHistogramVec("http_request_duration_seconds",
+		"HTTP request latency by route, method and status.", "route", "method", "status")
+	repositoryCallDuration = newHistogramVec("repository_call_duration_seconds",
+		"Repository call latency by method.", "method")
+	repositoryErrors = newCounterVec("repository_errors_total",
+		"Failed repository calls by method, not found is not counted as a failure.", "method")
+	transactionRetries = newCounter("repository_transaction_retries_total",
+		"Transactions run again after a deadlock or serialization failure.")
+)
+
+// statusRecorder remembers the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+	}
+	sr.ResponseWriter.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.status == 0 {
+		sr.status = http.StatusOK
+	}
+	return sr.ResponseWriter.Write(b)
+}
+
+// instrument counts and times requests to route, the registered pattern rather than the path keeps
+// the number of series bounded
+func instrument(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		status := strconv.Itoa(rec.status)
+		httpRequests.WithLabelValues(route, r.Method, status).Inc()
+		httpRequestDuration.WithLabelValues(route, r.Method, status).Observe(time.Since(start).Seconds())
+	}
+}
+
+// InstrumentedRepository records latency and failures of every call to next
+type InstrumentedRepository struct {
+	next Repository
+}
+
+func NewInstrumentedRepository(next Repository) InstrumentedRepository {
+	return InstrumentedRepository{next: next}
+}
+
+func observeCall(method string, start time.Time, err error) {
+	repositoryCallDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		repositoryErrors.WithLabelValues(method).Inc()
+	}
+}
+
+func (r InstrumentedRepository) SaveDevice(ctx context.Context, device Device) (Device, error) {
+	start := time.Now()
+	device, err := r.next.SaveDevice(ctx, device)
+	observeCall("SaveDevice", start, err)
+	return device, err
+}
+
+func (r InstrumentedRepository) FindDeviceByID(ctx context.Context, id int) (Device, error) {
+	start := time.Now()
+	device, err := r.next.FindDeviceByID(ctx, id)
+	observeCall("FindDeviceByID", start, err)
+	return device, err
+}
+
+func (r InstrumentedRepository) FindDeviceByPublicID(ctx context.Context, publicID string) (Device, error) {
+	start := time.Now()
+	device, err := r.next.FindDeviceByPublicID(ctx, publicID)
+	observeCall("FindDeviceByPublicID", start, err)
+	return device, err
+}
+
+func (r InstrumentedRepository) FindDevicesByBrand(ctx context.Context, brand string) ([]Device, error) {
+	start := time.Now()
+	devices, err := r.next.FindDevicesByBrand(ctx, brand)
+	observeCall("FindDevicesByBrand", start, err)
+	return devices, err
+}
+
+func (r InstrumentedRepository) FindAllDevices(ctx context.Context) ([]Device, error) {
+	start := time.Now()
+	devices, err := r.next.FindAllDevices(ctx)
+	observeCall("FindAllDevices", start, err)
+	return devices, err
+}
+
+func (r InstrumentedRepository) UpdateDevice(ctx context.Context, device Device) (Device, error) {
+	start := time.Now()
+	device, err := r.next.UpdateDevice(ctx, device)
+	observeCall("UpdateDevice", start, err)
+	return device, err
+}
+
+func (r InstrumentedRepository) DeleteDevice(ctx context.Context, id int) error {
+	start := time.Now()
+	err := r.next.DeleteDevice(ctx, id)
+	observeCall("DeleteDevice", start, err)
+	return err
+}
+
+func (r InstrumentedRepository) CheckoutDevice(ctx context.Context, id int, assigneeID int, due time.Time) (Device, error) {
+	start := time.Now()
+	device, err := r.next.CheckoutDevice(ctx, id, assigneeID, due)
+	observeCall("CheckoutDevice", start, err)
+	return device, err
+}
+
+func (r InstrumentedRepository) CheckinDevice(ctx context.Context, id int) (Device, error) {
+	start := time.Now()
+	device, err := r.next.CheckinDevice(ctx, id)
+	observeCall("CheckinDevice", start, err)
+	return device, err
+}
+
+func (r InstrumentedRepository) FindDevicesByAssignee(ctx context.Context, assigneeID int) ([]Device, error) {
+	start := time.Now()
+	devices, err := r.next.FindDevicesByAssignee(ctx, assigneeID)
+	observeCall("FindDevicesByAssignee", start, err)
+	return devices, err
+}
+
+func (r InstrumentedRepository) FindOverdueDevices(ctx context.Context, now time.Time) ([]Device, error) {
+	start := time.Now()
+	devices, err := r.next.FindOverdueDevices(ctx, now)
+	observeCall("FindOverdueDevices", start, err)
+	return devices, err
+}
+
+func (r InstrumentedRepository) WithTx(ctx context.Context, opts TxOptions, fn func(tx Repository) error) error {
+	start := time.Now()
+	err := r.next.WithTx(ctx, opts, func(tx Repository) error {
+		return fn(NewInstrumentedRepository(tx))
+	})
+	observeCall("WithTx", start, err)
+	return err
+}
+
+func (r InstrumentedRepository) DeleteAllDevices() {
+	r.next.DeleteAllDevices()
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrTokenExpired   = errors.New("token expired")
+	ErrUnknownKey     = errors.New("unknown signing key")
+	ErrBadSignature   = errors.New("invalid token signature")
+	ErrUnsupportedAlg = errors.New("unsupported token algorithm")
+)
+
+// JWK is a single key of a JSON Web Key Set, only the RSA and EC fields are used
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg,omitempty"`
+	Use string `json:"use,omitempty"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+func (k JWK) PublicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		key := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("point is not on curve")
+		}
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+	}
+}
+
+// JWKSource loads a key set from a file or URL and caches it. An unknown kid triggers a reload,
+// rate limited by minRefresh, so rotated keys are picked up without a restart. Reloads run without
+// holding the cache lock and concurrent callers share one, a slow source only delays the callers
+// waiting for a key it does not have yet.
+type JWKSource struct {
+	location   string
+	ttl        time.Duration
+	minRefresh time.Duration
+	client     *http.Client
+
+	mu        sync.Mutex
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	reload    *jwksReload
+}
+
+// jwksReload is a running reload, done is closed once err is set
+type jwksReload struct {
+	done chan struct{}
+	err  error
+}
+
+func NewJWKSource(location string) *JWKSource {
+	return &JWKSource{
+		location:   location,
+		ttl:        time.Hour,
+		minRefresh: 30 * time.Second,
+		client:     &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+func (s *JWKSource) Key(kid string) (crypto.PublicKey, error) {
+	s.mu.Lock()
+	key, ok := s.keys[kid]
+	stale := time.Since(s.fetchedAt) > s.ttl
+	if ok {
+		if stale {
+			// keep serving the cached key, it is replaced once the reload succeeds
+			s.startReload()
+		}
+		s.mu.Unlock()
+		return key, nil
+	}
+	if s.keys != nil && !stale && time.Since(s.fetchedAt) <= s.minRefresh {
+		s.mu.Unlock()
+		return nil, ErrUnknownKey
+	}
+	reload := s.startReload()
+	s.mu.Unlock()
+
+	<-reload.done
+	if reload.err != nil {
+		return nil, reload.err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, ok = s.keys[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// startReload loads the key set in the background unless a reload is running already, s.mu must be held
+func (s *JWKSource) startReload() *jwksReload {
+	if s.reload != nil {
+		return s.reload
+	}
+	reload := &jwksReload{done: make(chan struct{})}
+	s.reload = reload
+	go func() {
+		keys, err := s.load()
+		s.mu.Lock()
+		if err == nil {
+			s.keys = keys
+			s.fetchedAt = time.Now()
+		}
+		s.reload = nil
+		s.mu.Unlock()
+		reload.err = err
+		close(reload.done)
+	}()
+	return reload
+}
+
+func (s *JWKSource) load() (map[string]crypto.PublicKey, error) {
+	body, err := s.read()
+	if err != nil {
+		return nil, err
+	}
+	var set JWKS
+	if err := json.Unmarshal(body, &set); err != nil {
+		return nil, err
+	}
+	keys := map[string]crypto.PublicKey{}
+	for _, jwk := range set.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := jwk.PublicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (s *JWKSource) read() ([]byte, error) {
+	if !strings.HasPrefix(s.location, "http://") && !strings.HasPrefix(s.location, "https://") {
+		return os.ReadFile(s.location)
+	}
+	resp, err := s.client.Get(s.location)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching jwks: status %d", resp.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// audience accepts both the string and array forms of the aud claim
+type audience []string
+
+func (a *audience) UnmarshalJSON(b []byte) error {
+	var single string
+	if err := json.Unmarshal(b, &single); err == nil {
+		*a = audience{single}
+		return nil
+	}
+	var many []string
+	if err := json.Unmarshal(b, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+type jwtClaims struct {
+	Issuer    string   `json:"iss"`
+	Subject   string   `json:"sub"`
+	Audience  audience `json:"aud"`
+	ExpiresAt int64    `json:"exp"`
+	NotBefore int64    `json:"nbf"`
+}
+
+// JWTAuthenticator verifies RS256 and ES256 bearer tokens issued by issuer for audience and grants the
+// scopes mapped to the roles found in rolesClaim. Groups found in groupsClaim are kept on the principal for RBAC bindings
+// and tenantClaim binds the principal to a tenant.
+type JWTAuthenticator struct {
+	jwks        *JWKSource
+	issuer      string
+	audience    string
+	rolesClaim  string
+	groupsClaim string
+	tenantClaim string
+	roleScopes  map[string][]string
+	leeway      time.Duration
+	now         func() time.Time
+}
+
+func NewJWTAuthenticator(jwks *JWKSource, issuer string, audience string, rolesClaim string, roleScopes map[string][]string) JWTAuthenticator {
+	if rolesClaim == "" {
+		rolesClaim = "roles"
+	}
+	return JWTAuthenticator{
+		jwks:        jwks,
+		issuer:      issuer,
+		audience:    audience,
+		rolesClaim:  rolesClaim,
+		groupsClaim: "groups",
+		tenantClaim: "tenant",
+		roleScopes:  roleScopes,
+		leeway:      30 * time.Second,
+		now:         time.Now,
+	}
+}
+
+func (a JWTAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	token, err := bearerToken(r)
+	if err != nil {
+		return Principal{}, err
+	}
+	claims, raw, err := a.verify(token)
+	if err != nil {
+		return Principal{}, err
+	}
+	principal := Principal{Subject: claims.Subject, Groups: rolesFromClaim(raw[a.groupsClaim])}
+	if tenant, ok := raw[a.tenantClaim]; ok {
+		if err := json.Unmarshal(tenant, &principal.Tenant); err != nil || !tenantIDPattern.MatchString(principal.Tenant) {
+			return Principal{}, ErrInvalidCredentials
+		}
+	}
+	seen := map[string]bool{}
+	for _, role := range rolesFromClaim(raw[a.rolesClaim]) {
+		for _, scope := range a.roleScopes[role] {
+			if !seen[scope] {
+				seen[scope] = true
+				principal.Scopes = append(principal.Scopes, scope)
+			}
+		}
+	}
+	return principal, nil
+}
+
+func (a JWTAuthenticator) verify(token string) (jwtClaims, map[string]json.RawMessage, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtClaims{}, nil, ErrInvalidCredentials
+	}
+	var header jwtHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return jwtClaims{}, nil, ErrInvalidCredentials
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtClaims{}, nil, ErrInvalidCredentials
+	}
+	if header.Alg != "RS256" && header.Alg != "ES256" {
+		return jwtClaims{}, nil, ErrUnsupportedAlg
+	}
+	key, err := a.jwks.Key(header.Kid)
+	if err != nil {
+		return jwtClaims{}, nil, err
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !verifySignature(header.Alg, key, digest[:], signature) {
+		return jwtClaims{}, nil, ErrBadSignature
+	}
+
+	var claims jwtClaims
+	var raw map[string]json.RawMessage
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return jwtClaims{}, nil, ErrInvalidCredentials
+	}
+	if err := decodeSegment(parts[1], &raw); err != nil {
+		return jwtClaims{}, nil, ErrInvalidCredentials
+	}
+	if err := a.validateClaims(claims); err != nil {
+		return jwtClaims{}, nil, err
+	}
+	return claims, raw, nil
+}
+
+func (a JWTAuthenticator) validateClaims(claims jwtClaims) error {
+	now := a.now()
+	if claims.ExpiresAt == 0 || now.After(time.Unix(claims.ExpiresAt, 0).Add(a.leeway)) {
+		return ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(a.leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return errors.New("token not yet valid")
+	}
+	// an authenticator without issuer or audience accepts no token at all
+	if a.issuer == "" || claims.Issuer != a.issuer {
+		return errors.New("unexpected token issuer")
+	}
+	for _, aud := range claims.Audience {
+		if a.audience != "" && aud == a.audience {
+			return nil
+		}
+	}
+	return errors.New("unexpected token audience")
+}
+
+// verifySignature checks the signature and that the key type matches alg, so an RSA key can
+// never be used to accept an ES256 token or the other way round
+func verifySignature(alg string, key crypto.PublicKey, digest []byte, signature []byte) bool {
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		return ok && rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest, signature) == nil
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok || ecKey.Curve != elliptic.P256() || len(signature) != 64 {
+			return false
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		return ecdsa.Verify(ecKey, digest, r, s)
+	}
+	return false
+}
+
+func decodeSegment(segment string, v any) error {
+	b, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(b, v)
+}
+
+// rolesFromClaim accepts a roles or groups claim as a JSON array or a space separated string
+func rolesFromClaim(raw json.RawMessage) []string {
+	if raw == nil {
+		return nil
+	}
+	var roles []string
+	if err := json.Unmarshal(raw, &roles); err == nil {
+		return roles
+	}
+	var single string
+	if err := json.Unmarshal(raw, &single); err == nil {
+		return strings.Fields(single)
+	}
+	return nil
+}
+
+// parseRoleScopes reads a mapping such as "viewer=devices:read;editor=devices:read,devices:write"
+func parseRoleScopes(s string) (map[string][]string, error) {
+	roleScopes := map[string][]string{}
+	for _, entry := range strings.Split(s, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		role, scopes, ok := strings.Cut(entry, "=")
+		if !ok || role == "" {
+			return nil, fmt.Errorf("invalid role mapping %q", entry)
+		}
+		roleScopes[role] = strings.Split(scopes, ",")
+		if err := validateScopes(roleScopes[role]); err != nil {
+			return nil, err
+		}
+	}
+	return roleScopes, nil
+}
+
+// ChainAuthenticator tries each authenticator in turn and returns the first success
+type ChainAuthenticator []Authenticator
+
+func (c ChainAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	err := ErrNoCredentials
+	for _, a := range c {
+		var principal Principal
+		principal, err = a.Authenticate(r)
+		if err == nil {
+			return principal, nil
+		}
+		if errors.Is(err, ErrNoCredentials) {
+			return Principal{}, err
+		}
+	}
+	return Principal{}, err
+}
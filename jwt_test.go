@@ -0,0 +1,297 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func rsaJWK(kid string, key *rsa.PrivateKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Kid: kid,
+		N:   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+	}
+}
+
+func ecJWK(kid string, key *ecdsa.PrivateKey) JWK {
+	return JWK{
+		Kty: "EC",
+		Kid: kid,
+		Crv: "P-256",
+		X:   base64.RawURLEncoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+		Y:   base64.RawURLEncoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+	}
+}
+
+func writeJWKS(t *testing.T, path string, keys ...JWK) {
+	t.Helper()
+	b, err := json.Marshal(JWKS{Keys: keys})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(path, b, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func signTestJWT(t *testing.T, alg string, kid string, key crypto.Signer, claims map[string]any) string {
+	t.Helper()
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signingInput))
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+	case *ecdsa.PrivateKey:
+		var r, s *big.Int
+		r, s, err = ecdsa.Sign(rand.Reader, k, digest[:])
+		if err == nil {
+			signature = append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+		}
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func validClaims(roles ...string) map[string]any {
+	return map[string]any{
+		"iss":   "https://sso.example.com",
+		"sub":   "alice",
+		"aud":   []string{"device-store"},
+		"exp":   time.Now().Add(time.Hour).Unix(),
+		"roles": roles,
+	}
+}
+
+func bearerRequest(token string) *http.Request {
+	req := httptest.NewRequest("GET", "/devices", nil)
+	req.Header.Set("Authorization", "Bearer "+token)
+	return req
+}
+
+func Test_JWTAuthenticator(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwksPath := filepath.Join(t.TempDir(), "jwks.json")
+	writeJWKS(t, jwksPath, rsaJWK("rsa-1", rsaKey), ecJWK("ec-1", ecKey))
+	roleScopes, err := parseRoleScopes("viewer=devices:read;editor=devices:read,devices:write")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth := NewJWTAuthenticator(NewJWKSource(jwksPath), "https://sso.example.com", "device-store", "roles", roleScopes)
+
+	t.Run("should accept RS256 and ES256 tokens and map roles to scopes", func(t *testing.T) {
+		for _, token := range []string{
+			signTestJWT(t, "RS256", "rsa-1", rsaKey, validClaims("editor")),
+			signTestJWT(t, "ES256", "ec-1", ecKey, validClaims("editor")),
+		} {
+			principal, err := auth.Authenticate(bearerRequest(token))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if principal.Subject != "alice" {
+				t.Errorf("expected subject alice, got %v", principal.Subject)
+			}
+			if !principal.HasScope(ScopeDevicesRead) || !principal.HasScope(ScopeDevicesWrite) || principal.HasScope(ScopeDevicesDelete) {
+				t.Errorf("expected read and write scopes, got %v", principal.Scopes)
+			}
+		}
+	})
+
+	t.Run("should reject invalid tokens", func(t *testing.T) {
+		otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expired := validClaims("viewer")
+		expired["exp"] = time.Now().Add(-time.Hour).Unix()
+		wrongAudience := validClaims("viewer")
+		wrongAudience["aud"] = "someone-else"
+		wrongIssuer := validClaims("viewer")
+		wrongIssuer["iss"] = "https://evil.example.com"
+		noExpiry := validClaims("viewer")
+		delete(noExpiry, "exp")
+		header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none","kid":"rsa-1"}`))
+		payload, _ := json.Marshal(validClaims("viewer"))
+
+		for name, token := range map[string]string{
+			"expired":        signTestJWT(t, "RS256", "rsa-1", rsaKey, expired),
+			"wrong audience": signTestJWT(t, "RS256", "rsa-1", rsaKey, wrongAudience),
+			"wrong issuer":   signTestJWT(t, "RS256", "rsa-1", rsaKey, wrongIssuer),
+			"no expiry":      signTestJWT(t, "RS256", "rsa-1", rsaKey, noExpiry),
+			"wrong key":      signTestJWT(t, "RS256", "rsa-1", otherKey, validClaims("viewer")),
+			"key type":       signTestJWT(t, "ES256", "rsa-1", ecKey, validClaims("viewer")),
+			"unknown kid":    signTestJWT(t, "RS256", "rsa-9", rsaKey, validClaims("viewer")),
+			"alg none":       header + "." + base64.RawURLEncoding.EncodeToString(payload) + ".",
+			"malformed":      "not.a.jwt",
+		} {
+			_, err := auth.Authenticate(bearerRequest(token))
+			if err == nil {
+				t.Errorf("expected %v token to be rejected", name)
+			}
+		}
+	})
+
+	t.Run("should pick up rotated keys", func(t *testing.T) {
+		rotatedKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := filepath.Join(t.TempDir(), "jwks.json")
+		writeJWKS(t, path, rsaJWK("rsa-1", rsaKey))
+		source := NewJWKSource(path)
+		source.minRefresh = 0
+		rotating := NewJWTAuthenticator(source, "https://sso.example.com", "device-store", "roles", roleScopes)
+		_, err = rotating.Authenticate(bearerRequest(signTestJWT(t, "RS256", "rsa-1", rsaKey, validClaims("viewer"))))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		writeJWKS(t, path, ecJWK("ec-2", rotatedKey))
+		_, err = rotating.Authenticate(bearerRequest(signTestJWT(t, "ES256", "ec-2", rotatedKey, validClaims("viewer"))))
+		if err != nil {
+			t.Errorf("expected rotated key to be accepted, got %v", err)
+		}
+		_, err = rotating.Authenticate(bearerRequest(signTestJWT(t, "RS256", "rsa-1", rsaKey, validClaims("viewer"))))
+		if !errors.Is(err, ErrUnknownKey) {
+			t.Errorf("expected retired key to be rejected, got %v", err)
+		}
+	})
+
+	t.Run("should cache keys fetched from a url", func(t *testing.T) {
+		var fetches atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fetches.Add(1)
+			json.NewEncoder(w).Encode(JWKS{Keys: []JWK{rsaJWK("rsa-1", rsaKey)}})
+		}))
+		defer server.Close()
+		remote := NewJWTAuthenticator(NewJWKSource(server.URL), "https://sso.example.com", "device-store", "roles", roleScopes)
+		for i := 0; i < 3; i++ {
+			_, err := remote.Authenticate(bearerRequest(signTestJWT(t, "RS256", "rsa-1", rsaKey, validClaims("viewer"))))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		_, err := remote.Authenticate(bearerRequest(signTestJWT(t, "RS256", "rsa-9", rsaKey, validClaims("viewer"))))
+		if err == nil {
+			t.Error("expected unknown kid to be rejected")
+		}
+		if fetches.Load() != 1 {
+			t.Errorf("expected 1 jwks fetch, got %d", fetches.Load())
+		}
+	})
+
+	t.Run("should serve cached keys while the key set reloads", func(t *testing.T) {
+		var fetches atomic.Int32
+		reloading, release := make(chan struct{}), make(chan struct{})
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if fetches.Add(1) == 2 {
+				close(reloading)
+				<-release
+			}
+			json.NewEncoder(w).Encode(JWKS{Keys: []JWK{rsaJWK("rsa-1", rsaKey)}})
+		}))
+		defer server.Close()
+		defer close(release)
+		source := NewJWKSource(server.URL)
+		slow := NewJWTAuthenticator(source, "https://sso.example.com", "device-store", "roles", roleScopes)
+		token := signTestJWT(t, "RS256", "rsa-1", rsaKey, validClaims("viewer"))
+		if _, err := slow.Authenticate(bearerRequest(token)); err != nil {
+			t.Fatal(err)
+		}
+
+		source.ttl = 0
+		authenticated := make(chan error)
+		go func() {
+			for i := 0; i < 3; i++ {
+				if _, err := slow.Authenticate(bearerRequest(token)); err != nil {
+					authenticated <- err
+					return
+				}
+				if i == 0 {
+					<-reloading
+				}
+			}
+			authenticated <- nil
+		}()
+		select {
+		case err := <-authenticated:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("expected the cached key to be served while the key set reloads")
+		}
+		if fetches.Load() != 2 {
+			t.Errorf("expected callers to share one reload, got %d fetches", fetches.Load())
+		}
+	})
+
+	t.Run("should accept no token without issuer and audience", func(t *testing.T) {
+		for _, unchecked := range []JWTAuthenticator{
+			NewJWTAuthenticator(NewJWKSource(jwksPath), "", "device-store", "roles", roleScopes),
+			NewJWTAuthenticator(NewJWKSource(jwksPath), "https://sso.example.com", "", "roles", roleScopes),
+		} {
+			if _, err := unchecked.Authenticate(bearerRequest(signTestJWT(t, "RS256", "rsa-1", rsaKey, validClaims("viewer")))); err == nil {
+				t.Errorf("expected token to be rejected by %+v", unchecked)
+			}
+		}
+	})
+
+	t.Run("should gate device methods by role", func(t *testing.T) {
+		handler := requireScope(auth, deviceScope, CrudDevicesHandler)
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, bearerRequest(signTestJWT(t, "RS256", "rsa-1", rsaKey, validClaims("viewer"))))
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+
+		req := httptest.NewRequest("DELETE", "/device/1", nil)
+		req.Header.Set("Authorization", "Bearer "+signTestJWT(t, "RS256", "rsa-1", rsaKey, validClaims("editor")))
+		rr = httptest.NewRecorder()
+		requireScope(auth, deviceScope, CrudDeviceHandler).ServeHTTP(rr, req)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+
+		chain := ChainAuthenticator{APIKeyAuthenticator{repo: apiKeyRepository}, auth}
+		rr = httptest.NewRecorder()
+		requireScope(chain, deviceScope, CrudDevicesHandler).ServeHTTP(rr, bearerRequest(signTestJWT(t, "ES256", "ec-1", ecKey, validClaims("viewer"))))
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d through chain, got %d", http.StatusOK, rr.Code)
+		}
+	})
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// captureLogs makes the default logger write JSON at debug level to a buffer while fn runs
+func captureLogs(t *testing.T, fn func()) []map[string]any {
+	t.Helper()
+	var buf bytes.Buffer
+	logger, err := newLogger(&buf, "json", "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	previous := slog.Default()
+	slog.SetDefault(logger)
+	defer slog.SetDefault(previous)
+
+	fn()
+	var lines []map[string]any
+	dec := json.NewDecoder(&buf)
+	for dec.More() {
+		var line map[string]any
+		if err := dec.Decode(&line); err != nil {
+			t.Fatal(err)
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func Test_RequestID(t *testing.T) {
+	var seen string
+	handler := requestID(func(w http.ResponseWriter, r *http.Request) {
+		seen = requestIDFromContext(r.Context())
+	})
+
+	t.Run("should honor and echo the caller's request id", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/devices", nil)
+		req.Header.Set("X-Request-ID", "abc-123")
+		rr := httptest.NewRecorder()
+		handler(rr, req)
+		if seen != "abc-123" || rr.Header().Get("X-Request-ID") != "abc-123" {
+			t.Errorf("expected request id abc-123, got %v and header %v", seen, rr.Header().Get("X-Request-ID"))
+		}
+	})
+
+	t.Run("should generate a request id when missing or invalid", func(t *testing.T) {
+		for _, header := range []string{"", "has spaces\nand newlines"} {
+			req := httptest.NewRequest("GET", "/devices", nil)
+			req.Header.Set("X-Request-ID", header)
+			rr := httptest.NewRecorder()
+			handler(rr, req)
+			if len(seen) != 32 || rr.Header().Get("X-Request-ID") != seen {
+				t.Errorf("expected generated request id for %q, got %v", header, seen)
+			}
+		}
+	})
+}
+
+func Test_StructuredLogging(t *testing.T) {
+	t.Run("should attach the request id to handler, repository and access logs", func(t *testing.T) {
+		lines := captureLogs(t, func() {
+			body, _ := json.Marshal(Device{Name: "Logged Device", Brand: "Logged Brand"})
+			req := httptest.NewRequest("POST", "/device/", bytes.NewReader(body))
+			req.Header.Set("X-Request-ID", "req-42")
+			requestID(accessLog("/device/", CrudDeviceHandler))(httptest.NewRecorder(), req)
+		})
+		defer repository.DeleteAllDevices()
+
+		messages := map[string]map[string]any{}
+		for _, line := range lines {
+			if line["request_id"] != "req-42" {
+				t.Errorf("expected request id on every line, got %v", line)
+			}
+			messages[line["msg"].(string)] = line
+		}
+		for _, msg := range []string{"Device saved", "Device added", "request"} {
+			if _, ok := messages[msg]; !ok {
+				t.Errorf("expected %q to be logged, got %v", msg, lines)
+			}
+		}
+		access := messages["request"]
+		if access["status"] != float64(http.StatusCreated) || access["route"] != "/device/" || access["latency"] == nil {
+			t.Errorf("expected access log with status, route and latency, got %v", access)
+		}
+	})
+
+	t.Run("should reject unknown formats and levels", func(t *testing.T) {
+		if _, err := newLogger(&bytes.Buffer{}, "xml", "info"); err == nil {
+			t.Error("expected unknown format to fail")
+		}
+		if _, err := newLogger(&bytes.Buffer{}, "text", "loud"); err == nil {
+			t.Error("expected unknown level to fail")
+		}
+	})
+}
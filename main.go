@@ -1,57 +1,419 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
 )
 
+// Device is addressed by its opaque PublicID in the API, ID is internal and used for joins
 type Device struct {
-	ID           int       `json:"id"`
+	ID           int       `json:"-"`
+	PublicID     string    `json:"id"`
 	Name         string    `json:"name"`
 	Brand        string    `json:"brand"`
 	CreationTime time.Time `json:"creation_time"`
+	// Holder is who the device is checked out to, nil while it is available
+	Holder *Holder `json:"holder,omitempty"`
 }
 
 var repository Repository
 
-func initDB() {
-	dsn := "user:password@tcp(localhost:3306)/device_store?parseTime=true"
-	db, err := sql.Open("mysql", dsn)
+// legacyDeviceIDs makes /device/{id} accept the former integer ids as well, set with LEGACY_DEVICE_IDS while clients move over
+var legacyDeviceIDs = false
+
+// readReplicas are the replicas of DATABASE_REPLICA_URLS, nil without them
+var readReplicas *ReplicaSet
+
+func configurePool(db *sql.DB) {
+	db.SetConnMaxLifetime(time.Minute * 3)
+	db.SetMaxOpenConns(10)
+	db.SetMaxIdleConns(10)
+}
+
+// initDB opens the pool for DATABASE_URL and sets up the repositories, connecting is left to connectDB.
+// A postgres:// URL selects PostgreSQL, otherwise it is a MySQL DSN.
+func initDB() (*sql.DB, Dialect) {
+	dsn := getEnv("DATABASE_URL", "user:password@tcp(localhost:3306)/device_store?parseTime=true")
+	db, dialect, err := openDB(dsn)
 
 	if err != nil {
-		log.Fatalf("Failed to open database: %v", err)
+		fatal("Failed to open database", "error", err)
 	}
+	configurePool(db)
+	readReplicas, err = openReplicas(dialect)
+	if err != nil {
+		fatal("Failed to open replicas", "error", err)
+	}
+	repository = RepositoryImpl{
+		db:       db,
+		dialect:  dialect,
+		replicas: readReplicas,
+	}
+	webhookRepository = WebhookRepositoryImpl{
+		db:      db,
+		dialect: dialect,
+	}
+	outboxRepository = OutboxRepositoryImpl{
+		db:      db,
+		dialect: dialect,
+	}
+	apiKeyRepository = APIKeyRepositoryImpl{
+		db:      db,
+		dialect: dialect,
+	}
+	tenantQuotaRepository = TenantQuotaRepositoryImpl{
+		db:      db,
+		dialect: dialect,
+	}
+	assigneeRepository = AssigneeRepositoryImpl{
+		db:      db,
+		dialect: dialect,
+	}
+	idempotencyRepository = IdempotencyRepositoryImpl{
+		db:      db,
+		dialect: dialect,
+	}
+	return db, dialect
+}
 
-	err = db.Ping()
+// newPublisher builds the outbox publisher: webhooks always, plus a JSON lines file when OUTBOX_FILE is set
+func newPublisher() MultiPublisher {
+	publishers := MultiPublisher{WebhookPublisher{repo: webhookRepository}}
+	if path := os.Getenv("OUTBOX_FILE"); path != "" {
+		filePublisher, err := NewFilePublisher(path)
+		if err != nil {
+			fatal("Failed to open outbox file", "error", err)
+		}
+		publishers = append(publishers, filePublisher)
+	}
+	return publishers
+}
+
+// newAuthenticator accepts API keys and, when JWT_JWKS is set to a JWKS file or URL, SSO issued JWTs
+func newAuthenticator() Authenticator {
+	apiKeys := APIKeyAuthenticator{repo: apiKeyRepository, adminKey: os.Getenv("ADMIN_API_KEY")}
+	jwksLocation := os.Getenv("JWT_JWKS")
+	if jwksLocation == "" {
+		return apiKeys
+	}
+	// without them any token signed by a key of the set would be accepted
+	if os.Getenv("JWT_ISSUER") == "" || os.Getenv("JWT_AUDIENCE") == "" {
+		fatal("JWT_ISSUER and JWT_AUDIENCE are required with JWT_JWKS")
+	}
+	roleScopes, err := parseRoleScopes(os.Getenv("JWT_ROLE_SCOPES"))
 	if err != nil {
-		log.Fatalf("Failed to connect to database: %v", err)
+		fatal("Invalid JWT_ROLE_SCOPES", "error", err)
+	}
+	jwt := NewJWTAuthenticator(NewJWKSource(jwksLocation), os.Getenv("JWT_ISSUER"), os.Getenv("JWT_AUDIENCE"),
+		os.Getenv("JWT_ROLES_CLAIM"), roleScopes)
+	if groupsClaim := os.Getenv("JWT_GROUPS_CLAIM"); groupsClaim != "" {
+		jwt.groupsClaim = groupsClaim
 	}
+	if tenantClaim := os.Getenv("JWT_TENANT_CLAIM"); tenantClaim != "" {
+		jwt.tenantClaim = tenantClaim
+	}
+	return ChainAuthenticator{apiKeys, jwt}
+}
 
-	db.SetConnMaxLifetime(time.Minute * 3)
-	db.SetMaxOpenConns(10)
-	db.SetMaxIdleConns(10)
-	repository = RepositoryImpl{
-		db: db,
+// newTracerProvider exports spans over OTLP/HTTP to the collector at OTEL_EXPORTER_OTLP_ENDPOINT, the exporter
+// reads the other OTEL_EXPORTER_OTLP_* variables too, or as JSON lines to the TRACES_FILE. Without either
+// nothing is sampled.
+func newTracerProvider() *sdktrace.TracerProvider {
+	serviceName := resource.NewSchemaless(attribute.String("service.name", getEnv("OTEL_SERVICE_NAME", "device-store")))
+	res, err := resource.Merge(resource.Default(), serviceName)
+	if err != nil {
+		fatal("Failed to describe the traced service", "error", err)
 	}
+	if os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT") != "" {
+		exporter, err := otlptracehttp.New(context.Background())
+		if err != nil {
+			fatal("Failed to create OTLP exporter", "error", err)
+		}
+		return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	}
+	if path := os.Getenv("TRACES_FILE"); path != "" {
+		out := os.Stdout
+		if path != "-" {
+			if out, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644); err != nil {
+				fatal("Failed to open traces file", "error", err)
+			}
+		}
+		exporter, err := stdouttrace.New(stdouttrace.WithWriter(out))
+		if err != nil {
+			fatal("Failed to create traces file exporter", "error", err)
+		}
+		return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	}
+	return sdktrace.NewTracerProvider(sdktrace.WithSampler(sdktrace.NeverSample()), sdktrace.WithResource(res))
+}
+
+// migrateCommand runs `device-store migrate ...` and returns the exit code
+func migrateCommand(db *sql.DB, dialect Dialect, args []string) int {
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer cancel()
+	if err := connectDB(ctx, db); err != nil {
+		slog.Error("Failed to connect to database", "error", err)
+		return 1
+	}
+	err := runMigrateCommand(ctx, NewMigrator(db, dialect, embeddedMigrations(dialect)), args, os.Stdout)
+	if errors.Is(err, errUsage) {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+	if err != nil {
+		slog.Error("Migration failed", "error", err)
+		return 1
+	}
+	if args[0] == "up" {
+		if err := backfillPublicIDs(ctx, db, dialect); err != nil {
+			slog.Error("Backfilling public ids failed", "error", err)
+			return 1
+		}
+	}
+	return 0
+}
+
+// backfillPublicIDs assigns public ids to devices stored before they existed
+func backfillPublicIDs(ctx context.Context, db *sql.DB, dialect Dialect) error {
+	updated, err := RepositoryImpl{db: db, dialect: dialect}.BackfillPublicIDs(ctx)
+	if updated > 0 {
+		slog.InfoContext(ctx, "Backfilled device public ids", "devices", updated)
+	}
+	return err
+}
+
+// handle registers handler for pattern with request IDs, tracing, access logs and metrics
+func handle(pattern string, handler http.HandlerFunc) {
+	http.HandleFunc(pattern, requestID(traced(pattern, accessLog(pattern, instrument(pattern, handler)))))
+}
+
+func getEnv(key string, fallback string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return fallback
+}
+
+// routeLimits returns the budgets of a route, overridable with RATE_LIMIT_<ROUTE>_READ and RATE_LIMIT_<ROUTE>_WRITE
+func routeLimits(route string, read string, write string) RouteLimits {
+	readLimit, err := ParseLimit(getEnv("RATE_LIMIT_"+route+"_READ", read))
+	if err != nil {
+		fatal("Invalid rate limit", "route", route, "error", err)
+	}
+	writeLimit, err := ParseLimit(getEnv("RATE_LIMIT_"+route+"_WRITE", write))
+	if err != nil {
+		fatal("Invalid rate limit", "route", route, "error", err)
+	}
+	return RouteLimits{Read: readLimit, Write: writeLimit}
 }
 
 func main() {
-	initDB()
-	http.HandleFunc("/device/", CrudDeviceHandler)
-	http.HandleFunc("/devices", CrudDevicesHandler)
-	log.Println("starting server on :8080")
-	log.Fatal(http.ListenAndServe(":8080", nil))
+	logger, err := newLogger(os.Stderr, getEnv("LOG_FORMAT", "text"), getEnv("LOG_LEVEL", "info"))
+	if err != nil {
+		fatal("Invalid logging configuration", "error", err)
+	}
+	slog.SetDefault(logger)
+	db, dialect := initDB()
+	legacyDeviceIDs = getEnv("LEGACY_DEVICE_IDS", "false") == "true"
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		os.Exit(migrateCommand(db, dialect, os.Args[2:]))
+	}
+	cacheConfig, err := deviceCacheConfig()
+	if err != nil {
+		fatal("Invalid device cache configuration", "error", err)
+	}
+	var cache *CachedRepository
+	if cacheConfig.Size > 0 {
+		bus, err := newInvalidationBus(db, dialect)
+		if err != nil {
+			fatal("Invalid cache invalidation configuration", "error", err)
+		}
+		cache = NewCachedRepository(repository, cacheConfig, bus)
+		repository = cache
+	}
+	if policyPath := os.Getenv("RBAC_POLICY"); policyPath != "" {
+		policy, err := LoadPolicy(policyPath)
+		if err != nil {
+			fatal("Failed to load RBAC policy", "error", err)
+		}
+		repository = NewAuthorizedRepository(repository, policy)
+	}
+	repository = NewTracedRepository(NewInstrumentedRepository(repository))
+	tracerProvider := newTracerProvider()
+	tracer = tracerProvider.Tracer(instrumentationName)
+	auth := newAuthenticator()
+	deviceLimits := routeLimits("DEVICE", "600/1m", "120/1m")
+	devicesLimits := routeLimits("DEVICES", "120/1m", "120/1m")
+	adminLimits := routeLimits("ADMIN", "60/1m", "30/1m")
+	assigneeLimits := routeLimits("ASSIGNEES", "120/1m", "60/1m")
+	readYourWritesWindow, err := readYourWritesConfig()
+	if err != nil {
+		fatal("Invalid read your writes configuration", "error", err)
+	}
+	idempotencyKeyTTL, err := time.ParseDuration(getEnv("IDEMPOTENCY_KEY_TTL", "24h"))
+	if err != nil || idempotencyKeyTTL <= 0 {
+		fatal("Invalid IDEMPOTENCY_KEY_TTL", "value", os.Getenv("IDEMPOTENCY_KEY_TTL"))
+	}
+	handle("/device/", requireScope(auth, deviceScope, rateLimit(deviceLimits, requireTenant(readYourWrites(readYourWritesWindow,
+		idempotent(idempotencyRepository, idempotencyKeyTTL, CrudDeviceHandler))))))
+	handle("/devices", requireScope(auth, deviceScope, rateLimit(devicesLimits, requireTenant(readYourWrites(readYourWritesWindow, CrudDevicesHandler)))))
+	handle("/assignees", requireScope(auth, deviceScope, rateLimit(assigneeLimits, requireTenant(CrudAssigneesHandler))))
+	handle("/assignees/", requireScope(auth, deviceScope, rateLimit(assigneeLimits, requireTenant(CrudAssigneeHandler))))
+	handle("/webhooks", requireScope(auth, adminScope, rateLimit(adminLimits, requireTenant(CrudWebhooksHandler))))
+	handle("/webhooks/", requireScope(auth, adminScope, rateLimit(adminLimits, requireTenant(CrudWebhookHandler))))
+	handle("/admin/api-keys", requireScope(auth, adminScope, rateLimit(adminLimits, CrudAPIKeysHandler)))
+	handle("/admin/api-keys/", requireScope(auth, adminScope, rateLimit(adminLimits, CrudAPIKeyHandler)))
+	handle("/admin/tenants/", requireScope(auth, adminScope, rateLimit(adminLimits, CrudTenantQuotaHandler)))
+	clientIPLimit, err := ParseLimit(getEnv("RATE_LIMIT_CLIENT_IP", "1200/1m"))
+	if err != nil {
+		fatal("Invalid RATE_LIMIT_CLIENT_IP", "error", err)
+	}
+	maxInFlight, err := strconv.Atoi(getEnv("MAX_IN_FLIGHT", "64"))
+	if err != nil || maxInFlight <= 0 {
+		fatal("Invalid MAX_IN_FLIGHT", "value", os.Getenv("MAX_IN_FLIGHT"))
+	}
+	drainDelay, err := time.ParseDuration(getEnv("DRAIN_DELAY", "5s"))
+	if err != nil {
+		fatal("Invalid DRAIN_DELAY", "error", err)
+	}
+	drainTimeout, err := time.ParseDuration(getEnv("SHUTDOWN_TIMEOUT", "25s"))
+	if err != nil {
+		fatal("Invalid SHUTDOWN_TIMEOUT", "error", err)
+	}
+
+	signalled, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+	migrator := NewMigrator(db, dialect, embeddedMigrations(dialect))
+	migrateOnStart := getEnv("MIGRATE_ON_START", "true") == "true"
+	// workers start once the database answers and the schema is current
+	connected := make(chan struct{})
+	go func() {
+		if connectDB(signalled, db) != nil {
+			return
+		}
+		slog.Info("Connected to database")
+		if migrateOnStart {
+			if _, err := migrator.Up(signalled, false, io.Discard); err != nil {
+				slog.Error("Error applying migrations", "error", err)
+				return
+			}
+			if err := backfillPublicIDs(signalled, db, dialect); err != nil {
+				slog.Error("Error backfilling public ids", "error", err)
+				return
+			}
+		}
+		close(connected)
+	}()
+
+	publisher := newPublisher()
+	relay := NewOutboxRelay(outboxRepository, publisher)
+	workers := NewWorkers()
+	workers.Go(after(connected, relay.Run))
+	workers.Go(after(connected, NewWebhookWorker(webhookRepository).Run))
+	workers.Go(after(connected, expireIdempotencyKeys(idempotencyRepository, time.Hour)))
+	workers.Go(after(connected, pruneOutbox(outboxRepository, 10*time.Minute, outboxRetention)))
+	if cache != nil {
+		workers.Go(after(connected, cache.Listen))
+	}
+	if readReplicas != nil {
+		workers.Go(readReplicas.Run)
+	}
+
+	readiness := NewReadiness(databaseCheck(db), migrationCheck(migrator))
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", HealthzHandler)
+	mux.HandleFunc("/readyz", readiness.ReadyzHandler)
+	mux.Handle("/", limitInFlight(maxInFlight, limitClientIPs(clientIPLimit, http.DefaultServeMux)))
+
+	// report not ready for DRAIN_DELAY before shutting down so probes take the instance out of rotation
+	ctx, shutdown := context.WithCancel(context.Background())
+	go func() {
+		<-signalled.Done()
+		readiness.Drain()
+		slog.Info("Draining", "shutdown_in", drainDelay)
+		time.Sleep(drainDelay)
+		shutdown()
+	}()
+
+	// the metrics carry tenant ids, they get a listener of their own that is not exposed with the API
+	metricsMux := http.NewServeMux()
+	metricsMux.Handle("/metrics", metricsHandler(newMetricsRegistry(db)))
+	metricsServer := newServer(getEnv("METRICS_ADDR", ":9090"), metricsMux)
+	metricsLn, err := net.Listen("tcp", metricsServer.Addr)
+	if err != nil {
+		fatal("Failed to listen", "addr", metricsServer.Addr, "error", err)
+	}
+	metricsDone := make(chan struct{})
+	go func() {
+		defer close(metricsDone)
+		if err := serve(ctx, metricsServer, metricsLn, drainTimeout); err != nil {
+			slog.Error("Error shutting down metrics server", "error", err)
+		}
+	}()
+
+	server := newServer(":8080", mux)
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		fatal("Failed to listen", "addr", server.Addr, "error", err)
+	}
+	slog.Info("Starting server", "addr", server.Addr, "metrics_addr", metricsServer.Addr)
+	if err := serve(ctx, server, ln, drainTimeout); err != nil {
+		slog.Error("Error shutting down server", "error", err)
+	}
+	<-metricsDone
+
+	workers.Stop()
+	// hand over the events written by the drained requests before closing the pool
+	flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	relay.RelayPending(flushCtx)
+	cancel()
+	if err := publisher.Close(); err != nil {
+		slog.Error("Error closing publishers", "error", err)
+	}
+	traceCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if err := tracerProvider.Shutdown(traceCtx); err != nil {
+		slog.Error("Error exporting remaining spans", "error", err)
+	}
+	cancel()
+	if readReplicas != nil {
+		if err := readReplicas.Close(); err != nil {
+			slog.Error("Error closing replicas", "error", err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		slog.Error("Error closing database", "error", err)
+	}
+	slog.Info("Server stopped")
 }
 
 func CrudDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	if path, ok := strings.CutPrefix(r.URL.Path, "/device/"); ok {
+		if deviceID, action, ok := strings.Cut(path, "/"); ok {
+			DeviceLoanHandler(w, r, deviceID, action)
+			return
+		}
+	}
 	switch r.Method {
 	case http.MethodGet:
 		device, err := GetDeviceById(w, r)
@@ -73,19 +435,27 @@ func CrudDeviceHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		newDevice, err = repository.SaveDevice(newDevice)
+		newDevice, err = repository.SaveDevice(r.Context(), newDevice)
 		if err != nil {
-			if strings.Contains(err.Error(), "Error 1062 (23000): Duplicate entry") {
+			if errors.Is(err, ErrForbidden) {
+				writeProblem(w, http.StatusForbidden, fmt.Sprintf("Not allowed to add devices of brand %v", newDevice.Brand))
+				return
+			}
+			if errors.Is(err, ErrQuotaExceeded) {
+				writeProblem(w, http.StatusForbidden, fmt.Sprintf("Device quota of tenant %v reached", tenantFromContext(r.Context())))
+				return
+			}
+			if errors.Is(err, ErrDeviceExists) {
 				http.Error(w, fmt.Sprintf("Device %v already exists", newDevice), http.StatusUnprocessableEntity)
 				return
 			}
-			log.Printf("Error adding device: %v", err)
+			slog.ErrorContext(r.Context(), "Error adding device", "error", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
-		log.Printf("Device added: %v", newDevice)
-		w.WriteHeader(http.StatusCreated)
+		slog.InfoContext(r.Context(), "Device added", "device", newDevice)
 		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
 		json.NewEncoder(w).Encode(newDevice)
 
 	case http.MethodPut:
@@ -108,9 +478,18 @@ func CrudDeviceHandler(w http.ResponseWriter, r *http.Request) {
 		deviceFromDB.Name = deviceDTO.Name
 		deviceFromDB.Brand = deviceDTO.Brand
 
-		_, err = repository.UpdateDevice(deviceFromDB)
+		_, err = repository.UpdateDevice(r.Context(), deviceFromDB)
 		if err != nil {
-			log.Printf("Error updating device: %v", err)
+			if errors.Is(err, ErrForbidden) {
+				writeProblem(w, http.StatusForbidden, fmt.Sprintf("Not allowed to update device with id %v", deviceFromDB.PublicID))
+				return
+			}
+			var conflict *DeviceConflictError
+			if errors.As(err, &conflict) {
+				writeConflict(w, conflict.PublicID, fmt.Sprintf("Device with name %v and brand %v already exists", deviceFromDB.Name, deviceFromDB.Brand))
+				return
+			}
+			slog.ErrorContext(r.Context(), "Error updating device", "error", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
@@ -118,20 +497,26 @@ func CrudDeviceHandler(w http.ResponseWriter, r *http.Request) {
 		json.NewEncoder(w).Encode(deviceFromDB)
 
 	case http.MethodDelete:
-		path := strings.TrimPrefix(r.URL.Path, "/device/")
-		deviceID, err := strconv.Atoi(path)
+		device, err := GetDeviceById(w, r)
 		if err != nil {
-			http.Error(w, "Invalid device ID", http.StatusBadRequest)
 			return
 		}
 
-		err = repository.DeleteDevice(deviceID)
+		err = repository.DeleteDevice(r.Context(), device.ID)
 		if err != nil {
+			if errors.Is(err, ErrForbidden) {
+				writeProblem(w, http.StatusForbidden, fmt.Sprintf("Not allowed to delete device with id %v", device.PublicID))
+				return
+			}
+			if errors.Is(err, ErrDeviceCheckedOut) {
+				writeProblem(w, http.StatusConflict, fmt.Sprintf("Device with id %v is checked out, check it in first", device.PublicID))
+				return
+			}
 			if strings.Contains(err.Error(), "no rows in result set") {
-				http.Error(w, fmt.Sprintf("Device with id %v not found", deviceID), http.StatusNotFound)
+				http.Error(w, fmt.Sprintf("Device with id %v not found", device.PublicID), http.StatusNotFound)
 				return
 			}
-			log.Printf("Error deleting device: %v", err)
+			slog.ErrorContext(r.Context(), "Error deleting device", "error", err)
 			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 			return
 		}
@@ -141,38 +526,87 @@ func CrudDeviceHandler(w http.ResponseWriter, r *http.Request) {
 
 func CrudDevicesHandler(w http.ResponseWriter, r *http.Request) {
 	brand := r.URL.Query().Get("brand")
+	assignedTo := r.URL.Query().Get("assigned_to")
+	overdue := r.URL.Query().Get("overdue") == "true"
+	filters := 0
+	for _, set := range []bool{brand != "", assignedTo != "", overdue} {
+		if set {
+			filters++
+		}
+	}
+	if filters > 1 {
+		http.Error(w, "Only one of brand, assigned_to and overdue can be given", http.StatusBadRequest)
+		return
+	}
 	var devices []Device
 	var err error
 
-	if brand == "" {
-		devices, err = repository.FindAllDevices()
-	} else {
-		devices, err = repository.FindDevicesByBrand(brand)
+	switch {
+	case brand != "":
+		devices, err = repository.FindDevicesByBrand(r.Context(), brand)
+	case assignedTo != "":
+		var assignee Assignee
+		assignee, err = assigneeRepository.FindAssigneeByPublicID(r.Context(), assignedTo)
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, fmt.Sprintf("Assignee with id %v not found", assignedTo), http.StatusNotFound)
+			return
+		}
+		if err == nil {
+			devices, err = repository.FindDevicesByAssignee(r.Context(), assignee.ID)
+		}
+	case overdue:
+		devices, err = repository.FindOverdueDevices(r.Context(), time.Now())
+	default:
+		devices, err = repository.FindAllDevices(r.Context())
 	}
 
 	if err != nil {
-		log.Printf("Error finding devices: %v", err)
+		slog.ErrorContext(r.Context(), "Error finding devices", "error", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return
 	}
 	w.Header().Set("Content-Type", "application/json")
+	_, span := tracer.Start(r.Context(), "encode devices", trace.WithAttributes(attribute.Int("devices.count", len(devices))))
 	json.NewEncoder(w).Encode(devices)
+	span.End()
+}
+
+// writeConflict answers 409 naming the device that is in the way
+func writeConflict(w http.ResponseWriter, conflictingID string, detail string) {
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(http.StatusConflict)
+	json.NewEncoder(w).Encode(struct {
+		Problem
+		ConflictingID string `json:"conflicting_id"`
+	}{
+		Problem:       Problem{Type: "about:blank", Title: http.StatusText(http.StatusConflict), Status: http.StatusConflict, Detail: detail},
+		ConflictingID: conflictingID,
+	})
 }
 
+// GetDeviceById loads the device named by the path, a ULID or, with legacyDeviceIDs, an integer id
 func GetDeviceById(w http.ResponseWriter, r *http.Request) (Device, error) {
-	path := strings.TrimPrefix(r.URL.Path, "/device/")
-	deviceID, err := strconv.Atoi(path)
-	if err != nil {
+	return findDeviceByPathID(w, r, strings.TrimPrefix(r.URL.Path, "/device/"))
+}
+
+// findDeviceByPathID loads the device named by deviceID, answering the request when it cannot
+func findDeviceByPathID(w http.ResponseWriter, r *http.Request, deviceID string) (Device, error) {
+	var device Device
+	var err error
+	if isULID(deviceID) {
+		device, err = repository.FindDeviceByPublicID(r.Context(), deviceID)
+	} else if id, atoiErr := strconv.Atoi(deviceID); atoiErr == nil && legacyDeviceIDs {
+		device, err = repository.FindDeviceByID(r.Context(), id)
+	} else {
 		http.Error(w, "Invalid device ID", http.StatusBadRequest)
-		return Device{}, err
+		return Device{}, errors.New("invalid device id")
 	}
-	device, err := repository.FindDeviceByID(deviceID)
 	if err != nil {
 		if strings.Contains(err.Error(), "no rows in result set") {
 			http.Error(w, fmt.Sprintf("Device with id %v not found", deviceID), http.StatusNotFound)
 			return Device{}, err
 		}
-		log.Printf("Error finding device: %v", err)
+		slog.ErrorContext(r.Context(), "Error finding device", "error", err)
 		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
 		return Device{}, err
 	}
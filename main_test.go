@@ -2,28 +2,98 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
-	"math/rand"
+	"io"
+	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func TestMain(m *testing.M) {
-	initDB()
+	os.Exit(runTests(m))
+}
+
+// runTests runs the suite against DATABASE_URL. Without it the suite gets its own database: a temporary
+// SQLite file, or with TEST_DATABASE=mysqld or TEST_DATABASE=postgres a database on a server started for the run.
+func runTests(m *testing.M) int {
+	dir, err := os.MkdirTemp("", "device-store-test")
+	if err != nil {
+		log.Fatalf("Failed to create temporary directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	if os.Getenv("DATABASE_URL") == "" {
+		switch backend := getEnv("TEST_DATABASE", "sqlite"); backend {
+		case "sqlite":
+			os.Setenv("DATABASE_URL", "sqlite://"+filepath.Join(dir, "device_store.db"))
+		case "mysqld":
+			testMySQL, err = startMySQL(dir)
+			if err != nil {
+				log.Printf("Failed to start mysqld: %v", err)
+				return 1
+			}
+			defer testMySQL.Stop()
+			dsn, drop, err := createDatabase(testMySQL.dsn)
+			if err != nil {
+				log.Printf("Failed to create test database: %v", err)
+				return 1
+			}
+			defer drop()
+			os.Setenv("DATABASE_URL", dsn)
+		case "postgres":
+			testPostgres, err = startPostgres(dir)
+			if err != nil {
+				log.Printf("Failed to start postgres: %v", err)
+				return 1
+			}
+			defer testPostgres.Stop()
+			dsn, drop, err := createPostgresDatabase(testPostgres.dsn)
+			if err != nil {
+				log.Printf("Failed to create test database: %v", err)
+				return 1
+			}
+			defer drop()
+			os.Setenv("DATABASE_URL", dsn)
+		default:
+			log.Printf("Unknown TEST_DATABASE %q, use sqlite, mysqld or postgres", backend)
+			return 1
+		}
+	}
+	db, dialect := initDB()
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := connectDB(ctx, db); err != nil {
+		log.Printf("Failed to connect to database: %v", err)
+		return 1
+	}
+	if _, err := NewMigrator(db, dialect, embeddedMigrations(dialect)).Up(ctx, false, io.Discard); err != nil {
+		log.Printf("Failed to migrate database: %v", err)
+		return 1
+	}
 
 	defer repository.DeleteAllDevices()
-	code := m.Run()
-	os.Exit(code)
+	return m.Run()
+}
+
+var deviceNames atomic.Int64
+
+// uniqueDeviceName returns a name no other device of the test run has
+func uniqueDeviceName() string {
+	return fmt.Sprintf("TEST DEVICE %d", deviceNames.Add(1))
 }
 
 func Test_AddDeviceHandler(t *testing.T) {
 	t.Run("should add device", func(t *testing.T) {
-		deviceName := strconv.Itoa(rand.Intn(100)) + "TEST DEVICE"
+		deviceName := uniqueDeviceName()
 		var device Device = Device{
 			Name:  deviceName,
 			Brand: "Test Brand",
@@ -54,8 +124,8 @@ func Test_AddDeviceHandler(t *testing.T) {
 		if deviceResponse.Brand != device.Brand {
 			t.Errorf("expected brand %v, got %v", device.Brand, deviceResponse.Brand)
 		}
-		if deviceResponse.ID == 0 {
-			t.Errorf("expected id to be non zero, got %v", deviceResponse.ID)
+		if deviceResponse.PublicID == "" {
+			t.Errorf("expected id to be non zero, got %v", deviceResponse.PublicID)
 		}
 		if deviceResponse.CreationTime.IsZero() {
 			t.Errorf("expected creation time to be non zero, got %v", deviceResponse.CreationTime)
@@ -63,12 +133,12 @@ func Test_AddDeviceHandler(t *testing.T) {
 	})
 
 	t.Run("should return 422 with message device already exists", func(t *testing.T) {
-		deviceName := strconv.Itoa(rand.Intn(100000)) + "TEST DEVICE"
+		deviceName := uniqueDeviceName()
 		var device Device = Device{
 			Name:  deviceName,
 			Brand: "Test Brand",
 		}
-		device, err := repository.SaveDevice(device)
+		device, err := repository.SaveDevice(context.Background(), device)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -114,17 +184,17 @@ func Test_AddDeviceHandler(t *testing.T) {
 
 func Test_GetDeviceHandler(t *testing.T) {
 	t.Run("should return device", func(t *testing.T) {
-		deviceName := strconv.Itoa(rand.Intn(100000)) + "TEST DEVICE"
+		deviceName := uniqueDeviceName()
 		var device Device = Device{
 			Name:  deviceName,
 			Brand: "Test Brand",
 		}
-		device, err := repository.SaveDevice(device)
+		device, err := repository.SaveDevice(context.Background(), device)
 		if err != nil {
 			t.Fatal(err)
 		}
 
-		req, err := http.NewRequest("GET", "/device/"+strconv.Itoa(device.ID), nil)
+		req, err := http.NewRequest("GET", "/device/"+device.PublicID, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -145,15 +215,15 @@ func Test_GetDeviceHandler(t *testing.T) {
 		if deviceResponse.Brand != device.Brand {
 			t.Errorf("expected brand %v, got %v", device.Brand, deviceResponse.Brand)
 		}
-		if deviceResponse.ID != device.ID {
-			t.Errorf("expected id %v, got %v", device.ID, deviceResponse.ID)
+		if deviceResponse.PublicID != device.PublicID {
+			t.Errorf("expected id %v, got %v", device.PublicID, deviceResponse.PublicID)
 		}
 		if deviceResponse.CreationTime.IsZero() {
 			t.Errorf("expected creation time to be non zero, got %v", deviceResponse.CreationTime)
 		}
 	})
 	t.Run("should return 404 not found", func(t *testing.T) {
-		req, err := http.NewRequest("GET", "/device/100000", nil)
+		req, err := http.NewRequest("GET", "/device/01ARZ3NDEKTSV4RRFFQ69G5FAV", nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -163,8 +233,8 @@ func Test_GetDeviceHandler(t *testing.T) {
 		if rr.Code != http.StatusNotFound {
 			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
 		}
-		if !strings.Contains(rr.Body.String(), "Device with id 100000 not found") {
-			t.Errorf("expected message %v, got %v", "Device with id 100000 not found", rr.Body.String())
+		if !strings.Contains(rr.Body.String(), "Device with id 01ARZ3NDEKTSV4RRFFQ69G5FAV not found") {
+			t.Errorf("expected message %v, got %v", "Device with id 01ARZ3NDEKTSV4RRFFQ69G5FAV not found", rr.Body.String())
 		}
 	})
 	t.Run("should return 400 bad request", func(t *testing.T) {
@@ -191,6 +261,40 @@ func Test_GetDeviceHandler(t *testing.T) {
 			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
 		}
 	})
+	t.Run("should accept integer ids only in legacy mode", func(t *testing.T) {
+		device, err := repository.SaveDevice(context.Background(), Device{Name: "Legacy Device", Brand: "Test Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		get := func() *httptest.ResponseRecorder {
+			rr := httptest.NewRecorder()
+			CrudDeviceHandler(rr, httptest.NewRequest("GET", "/device/"+strconv.Itoa(device.ID), nil))
+			return rr
+		}
+		if rr := get(); rr.Code != http.StatusBadRequest {
+			t.Errorf("expected status code %d, got %d", http.StatusBadRequest, rr.Code)
+		}
+		legacyDeviceIDs = true
+		defer func() { legacyDeviceIDs = false }()
+		rr := get()
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		var deviceResponse Device
+		if err := json.Unmarshal(rr.Body.Bytes(), &deviceResponse); err != nil {
+			t.Fatal(err)
+		}
+		if deviceResponse.PublicID != device.PublicID {
+			t.Errorf("expected public id %v, got %v", device.PublicID, deviceResponse.PublicID)
+		}
+		var fields map[string]any
+		if err := json.Unmarshal(rr.Body.Bytes(), &fields); err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := fields["id"].(string); !ok || len(fields) != 4 {
+			t.Errorf("expected only the public id to be exposed, got %v", fields)
+		}
+	})
 	repository.DeleteAllDevices()
 }
 
@@ -198,12 +302,12 @@ func Test_ListDevicesHandler(t *testing.T) {
 	repository.DeleteAllDevices()
 	t.Run("should return list of devices", func(t *testing.T) {
 		for i := 0; i < 10; i++ {
-			deviceName := strconv.Itoa(rand.Intn(100000)) + "TEST DEVICE"
+			deviceName := uniqueDeviceName()
 			var device Device = Device{
 				Name:  deviceName,
 				Brand: "Test Brand",
 			}
-			device, err := repository.SaveDevice(device)
+			device, err := repository.SaveDevice(context.Background(), device)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -253,19 +357,19 @@ func Test_ListDevicesHandler(t *testing.T) {
 
 func Test_UpdateDevice(t *testing.T) {
 	t.Run("should update device", func(t *testing.T) {
-		deviceName := strconv.Itoa(rand.Intn(100000)) + "TEST DEVICE"
+		deviceName := uniqueDeviceName()
 		var device Device = Device{
 			Name:  deviceName,
 			Brand: "Test Brand",
 		}
-		device, err := repository.SaveDevice(device)
+		device, err := repository.SaveDevice(context.Background(), device)
 		if err != nil {
 			t.Fatal(err)
 		}
 		device.Name = "Updated Name"
 		device.Brand = "Updated Brand"
 		deviceStub, err := json.Marshal(device)
-		req, err := http.NewRequest("PUT", "/device/"+strconv.Itoa(device.ID), bytes.NewReader(deviceStub))
+		req, err := http.NewRequest("PUT", "/device/"+device.PublicID, bytes.NewReader(deviceStub))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -288,8 +392,8 @@ func Test_UpdateDevice(t *testing.T) {
 		if deviceResponse.Brand != device.Brand {
 			t.Errorf("expected brand %v, got %v", device.Brand, deviceResponse.Brand)
 		}
-		if deviceResponse.ID != device.ID {
-			t.Errorf("expected id %v, got %v", device.ID, deviceResponse.ID)
+		if deviceResponse.PublicID != device.PublicID {
+			t.Errorf("expected id %v, got %v", device.PublicID, deviceResponse.PublicID)
 		}
 		if deviceResponse.CreationTime.IsZero() {
 			t.Errorf("expected creation time to be non zero, got %v", deviceResponse.CreationTime)
@@ -297,7 +401,7 @@ func Test_UpdateDevice(t *testing.T) {
 	})
 
 	t.Run("should return 404 not found", func(t *testing.T) {
-		req, err := http.NewRequest("PUT", "/device/100000", nil)
+		req, err := http.NewRequest("PUT", "/device/01ARZ3NDEKTSV4RRFFQ69G5FAV", nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -314,14 +418,14 @@ func Test_UpdateDevice(t *testing.T) {
 			Name:  "Test Device",
 			Brand: "Test Brand",
 		}
-		device, err := repository.SaveDevice(device)
+		device, err := repository.SaveDevice(context.Background(), device)
 		if err != nil {
 			t.Fatal(err)
 		}
 		device.Name = ""
 		device.Brand = ""
 		deviceStub, err := json.Marshal(device)
-		req, err := http.NewRequest("PUT", "/device/"+strconv.Itoa(device.ID), bytes.NewReader(deviceStub))
+		req, err := http.NewRequest("PUT", "/device/"+device.PublicID, bytes.NewReader(deviceStub))
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -335,21 +439,61 @@ func Test_UpdateDevice(t *testing.T) {
 			t.Errorf("expected message %v, got %v", "Name and brand are required", rr.Body.String())
 		}
 	})
+
+	t.Run("should return 409 conflict with the conflicting device id", func(t *testing.T) {
+		existing, err := repository.SaveDevice(context.Background(), Device{Name: "Taken Name", Brand: "Taken Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		device, err := repository.SaveDevice(context.Background(), Device{Name: "Other Name", Brand: "Other Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		device.Name = existing.Name
+		device.Brand = existing.Brand
+		deviceStub, err := json.Marshal(device)
+		req, err := http.NewRequest("PUT", "/device/"+device.PublicID, bytes.NewReader(deviceStub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(CrudDeviceHandler)
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusConflict {
+			t.Errorf("expected status code %d, got %d: %v", http.StatusConflict, rr.Code, rr.Body.String())
+		}
+		var problem struct {
+			ConflictingID string `json:"conflicting_id"`
+		}
+		if err := json.Unmarshal(rr.Body.Bytes(), &problem); err != nil {
+			t.Fatal(err)
+		}
+		if problem.ConflictingID != existing.PublicID {
+			t.Errorf("expected conflicting id %v, got %v", existing.PublicID, problem.ConflictingID)
+		}
+		unchanged, err := repository.FindDeviceByID(context.Background(), device.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if unchanged.Name != "Other Name" {
+			t.Errorf("expected device to keep its name, got %v", unchanged.Name)
+		}
+	})
 	repository.DeleteAllDevices()
 }
 
 func Test_DeleteDevice(t *testing.T) {
 	t.Run("should delete device", func(t *testing.T) {
-		deviceName := strconv.Itoa(rand.Intn(100000)) + "TEST DEVICE"
+		deviceName := uniqueDeviceName()
 		var device Device = Device{
 			Name:  deviceName,
 			Brand: "Test Brand",
 		}
-		device, err := repository.SaveDevice(device)
+		device, err := repository.SaveDevice(context.Background(), device)
 		if err != nil {
 			t.Fatal(err)
 		}
-		req, err := http.NewRequest("DELETE", "/device/"+strconv.Itoa(device.ID), nil)
+		req, err := http.NewRequest("DELETE", "/device/"+device.PublicID, nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -359,14 +503,14 @@ func Test_DeleteDevice(t *testing.T) {
 		if rr.Code != http.StatusNoContent {
 			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
 		}
-		_, err = repository.FindDeviceByID(device.ID)
+		_, err = repository.FindDeviceByID(context.Background(), device.ID)
 		if err == nil || !strings.Contains(err.Error(), "no rows in result set") {
 			t.Errorf("expected device to be deleted, got %v", err)
 		}
 	})
 
 	t.Run("should return 404 not found", func(t *testing.T) {
-		req, err := http.NewRequest("DELETE", "/device/1111111", nil)
+		req, err := http.NewRequest("DELETE", "/device/01ARZ3NDEKTSV4RRFFQ69G5FAV", nil)
 		if err != nil {
 			t.Fatal(err)
 		}
@@ -384,10 +528,10 @@ func Test_SearchDeviceHandler(t *testing.T) {
 	t.Run("should search device", func(t *testing.T) {
 		for i := 0; i < 10; i++ {
 			var device Device = Device{
-				Name:  strconv.Itoa(rand.Intn(100000)) + "TEST DEVICE",
+				Name:  uniqueDeviceName(),
 				Brand: "Test Brand",
 			}
-			device, err := repository.SaveDevice(device)
+			device, err := repository.SaveDevice(context.Background(), device)
 			if err != nil {
 				t.Fatal(err)
 			}
@@ -432,3 +576,30 @@ func Test_SearchDeviceHandler(t *testing.T) {
 	})
 	repository.DeleteAllDevices()
 }
+
+func Test_BackfillPublicIDs(t *testing.T) {
+	t.Run("should give devices without a public id one", func(t *testing.T) {
+		impl := repository.(RepositoryImpl)
+		result, err := impl.db.Exec("INSERT INTO devices (tenant_id, name, brand, creation_time) VALUES (?, ?, ?, CURRENT_TIMESTAMP)",
+			DefaultTenant, "Old Device", "Old Brand")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer repository.DeleteAllDevices()
+		id, _ := result.LastInsertId()
+		updated, err := impl.BackfillPublicIDs(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if updated != 1 {
+			t.Errorf("expected 1 device to be backfilled, got %v", updated)
+		}
+		device, err := repository.FindDeviceByID(context.Background(), int(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !isULID(device.PublicID) {
+			t.Errorf("expected a ulid, got %q", device.PublicID)
+		}
+	})
+}
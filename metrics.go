@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func newCounterVec(name string, help string, labels ...string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, labels)
+}
+
+func newCounter(name string, help string) prometheus.Counter {
+	return prometheus.NewCounter(prometheus.CounterOpts{Name: name, Help: help})
+}
+
+// newHistogramVec times in seconds with the default Prometheus buckets
+func newHistogramVec(name string, help string, labels ...string) *prometheus.HistogramVec {
+	return prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: name, Help: help, Buckets: prometheus.DefBuckets}, labels)
+}
+
+// dbStatsCollectors expose the sql.DBStats of the pool
+func dbStatsCollectors(db *sql.DB) []prometheus.Collector {
+	gauge := func(name string, help string, value func(s sql.DBStats) float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{Name: name, Help: help}, func() float64 { return value(db.Stats()) })
+	}
+	counter := func(name string, help string, value func(s sql.DBStats) float64) prometheus.Collector {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{Name: name, Help: help}, func() float64 { return value(db.Stats()) })
+	}
+	return []prometheus.Collector{
+		gauge("db_max_open_connections", "Maximum number of open connections to the database.",
+			func(s sql.DBStats) float64 { return float64(s.MaxOpenConnections) }),
+		gauge("db_open_connections", "Established connections, in use and idle.",
+			func(s sql.DBStats) float64 { return float64(s.OpenConnections) }),
+		gauge("db_in_use_connections", "Connections currently in use.",
+			func(s sql.DBStats) float64 { return float64(s.InUse) }),
+		gauge("db_idle_connections", "Idle connections.",
+			func(s sql.DBStats) float64 { return float64(s.Idle) }),
+		counter("db_wait_count_total", "Connections waited for because the pool was exhausted.",
+			func(s sql.DBStats) float64 { return float64(s.WaitCount) }),
+		counter("db_wait_duration_seconds_total", "Time spent waiting for a connection.",
+			func(s sql.DBStats) float64 { return s.WaitDuration.Seconds() }),
+		counter("db_max_idle_closed_total", "Connections closed due to SetMaxIdleConns.",
+			func(s sql.DBStats) float64 { return float64(s.MaxIdleClosed) }),
+		counter("db_max_idle_time_closed_total", "Connections closed due to SetConnMaxIdleTime.",
+			func(s sql.DBStats) float64 { return float64(s.MaxIdleTimeClosed) }),
+		counter("db_max_lifetime_closed_total", "Connections closed due to SetConnMaxLifetime.",
+			func(s sql.DBStats) float64 { return float64(s.MaxLifetimeClosed) }),
+	}
+}
+
+// deviceCountCollector counts stored devices per tenant and brand on every scrape
+type deviceCountCollector struct {
+	repo RepositoryImpl
+	desc *prometheus.Desc
+}
+
+func newDeviceCountCollector(repo RepositoryImpl) deviceCountCollector {
+	return deviceCountCollector{
+		repo: repo,
+		desc: prometheus.NewDesc("devices", "Stored devices by tenant and brand.", []string{"tenant", "brand"}, nil),
+	}
+}
+
+func (c deviceCountCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c deviceCountCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	counts, err := c.repo.CountDevicesByBrand(ctx)
+	if err != nil {
+		// the other families are still served, see promhttp.ContinueOnError
+		ch <- prometheus.NewInvalidMetric(c.desc, err)
+		return
+	}
+	for _, count := range counts {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(count.Count), count.Tenant, count.Brand)
+	}
+}
+
+// newMetricsRegistry registers the HTTP, repository, cache, pool and device metrics and those of the Go runtime
+func newMetricsRegistry(db *sql.DB) *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		httpRequests,
+		httpRequestDuration,
+		repositoryCallDuration,
+		repositoryErrors,
+		transactionRetries,
+		deviceCacheLookups,
+		deviceCacheEvictions,
+		deviceCacheRemoteInvalidations,
+		repositoryReads,
+		replicaFailovers,
+		idempotencyRequests,
+		newDeviceCountCollector(RepositoryImpl{db: db}),
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	registry.MustRegister(dbStatsCollectors(db)...)
+	return registry
+}
+
+// metricsHandler serves registry for scraping. The metrics carry tenant ids, so it is served on a listener of
+// its own, METRICS_ADDR, that is not exposed with the API.
+func metricsHandler(registry *prometheus.Registry) http.Handler {
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{
+		ErrorLog:      slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+		ErrorHandling: promhttp.ContinueOnError,
+	})
+}
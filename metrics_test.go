@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func Test_MetricsHandler(t *testing.T) {
+	t.Run("should serve the registry in the text format", func(t *testing.T) {
+		counter := newCounterVec("test_total", "Test counter.", "route", "status")
+		counter.WithLabelValues("/a", `say "hi"`).Add(2)
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(counter)
+
+		rr := httptest.NewRecorder()
+		metricsHandler(registry).ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+		if !strings.Contains(rr.Body.String(), `test_total{route="/a",status="say \"hi\""} 2`) {
+			t.Errorf("expected the counter, got\n%v", rr.Body.String())
+		}
+		if !strings.HasPrefix(rr.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+			t.Errorf("expected text exposition content type, got %v", rr.Header().Get("Content-Type"))
+		}
+	})
+}
+
+func Test_Instrumentation(t *testing.T) {
+	t.Run("should count requests by route, method and status", func(t *testing.T) {
+		handler := instrument("/test/", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "Not Found", http.StatusNotFound)
+		})
+		before := testutil.ToFloat64(httpRequests.WithLabelValues("/test/", "GET", "404"))
+		handler(httptest.NewRecorder(), httptest.NewRequest("GET", "/test/1", nil))
+		if got := testutil.ToFloat64(httpRequests.WithLabelValues("/test/", "GET", "404")); got != before+1 {
+			t.Errorf("expected %v requests, got %v", before+1, got)
+		}
+	})
+
+	t.Run("should count repository failures but not missing devices", func(t *testing.T) {
+		instrumented := NewInstrumentedRepository(repository)
+		ctx := context.Background()
+		before := testutil.ToFloat64(repositoryErrors.WithLabelValues("FindDeviceByID"))
+		_, err := instrumented.FindDeviceByID(ctx, -1)
+		if err == nil {
+			t.Fatal("expected device not to be found")
+		}
+		if got := testutil.ToFloat64(repositoryErrors.WithLabelValues("FindDeviceByID")); got != before {
+			t.Errorf("expected not found not to count as error, got %v", got)
+		}
+		before = testutil.ToFloat64(repositoryErrors.WithLabelValues("FindAllDevices"))
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err = instrumented.FindAllDevices(cancelled)
+		if err == nil {
+			t.Fatal("expected cancelled call to fail")
+		}
+		if got := testutil.ToFloat64(repositoryErrors.WithLabelValues("FindAllDevices")); got != before+1 {
+			t.Errorf("expected %v errors, got %v", before+1, got)
+		}
+	})
+
+	t.Run("should expose pool stats and device counts", func(t *testing.T) {
+		_, err := repository.SaveDevice(context.Background(), Device{Name: "Metrics Device", Brand: "Metrics Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer repository.DeleteAllDevices()
+
+		rr := httptest.NewRecorder()
+		metricsHandler(newMetricsRegistry(repository.(RepositoryImpl).db)).ServeHTTP(rr, httptest.NewRequest("GET", "/metrics", nil))
+		for _, line := range []string{
+			`devices{brand="Metrics Brand",tenant="default"} 1`,
+			"# TYPE db_open_connections gauge",
+			"db_max_open_connections 10",
+			"# TYPE db_wait_count_total counter",
+			"# TYPE http_request_duration_seconds histogram",
+		} {
+			if !strings.Contains(rr.Body.String(), line) {
+				t.Errorf("expected metrics to contain %q, got\n%v", line, rr.Body.String())
+			}
+		}
+	})
+}
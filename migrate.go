@@ -0,0 +1,424 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql migrations/postgres/*.sql migrations/sqlite/*.sql
+var migrationFiles embed.FS
+
+// Migration is a pair of up and down scripts, versions are applied in ascending order
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+var migrationFilePattern = regexp.MustCompile(`^(\d+)_(\w+)\.(up|down)\.sql$`)
+
+// loadMigrations reads NNNN_name.up.sql and NNNN_name.down.sql files from dir of fsys
+func loadMigrations(fsys fs.FS, dir string) ([]Migration, error) {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return nil, err
+	}
+	byVersion := map[int]*Migration{}
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		match := migrationFilePattern.FindStringSubmatch(entry.Name())
+		if match == nil {
+			return nil, fmt.Errorf("unexpected migration file %v, expected <version>_<name>.<up|down>.sql", entry.Name())
+		}
+		version, _ := strconv.Atoi(match[1])
+		content, err := fs.ReadFile(fsys, path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: match[2]}
+			byVersion[version] = m
+		}
+		if m.Name != match[2] {
+			return nil, fmt.Errorf("migration %v has two names, %v and %v", version, m.Name, match[2])
+		}
+		if match[3] == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
+		}
+	}
+	migrations := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if strings.TrimSpace(m.Up) == "" {
+			return nil, fmt.Errorf("migration %v_%v has no up script", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations, nil
+}
+
+// splitStatements splits a script on semicolons outside of quotes and comments
+func splitStatements(script string) []string {
+	var statements []string
+	var current strings.Builder
+	var quote rune
+	flush := func() {
+		if s := strings.TrimSpace(current.String()); s != "" {
+			statements = append(statements, s)
+		}
+		current.Reset()
+	}
+	runes := []rune(script)
+	for i := 0; i < len(runes); i++ {
+		c := runes[i]
+		switch {
+		case quote != 0:
+			current.WriteRune(c)
+			if c == '\\' && i+1 < len(runes) {
+				i++
+				current.WriteRune(runes[i])
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+			current.WriteRune(c)
+		case c == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			for i < len(runes) && runes[i] != '\n' {
+				i++
+			}
+			current.WriteRune('\n')
+		case c == ';':
+			flush()
+		default:
+			current.WriteRune(c)
+		}
+	}
+	flush()
+	return statements
+}
+
+// MigrationStatus is a known migration and whether it has been applied
+type MigrationStatus struct {
+	Migration
+	AppliedTime *time.Time
+}
+
+// Migrator applies migrations and records them in a table. A named lock makes sure only one replica migrates,
+// the others wait for it and then find nothing left to do.
+type Migrator struct {
+	db          *sql.DB
+	dialect     Dialect
+	migrations  []Migration
+	table       string
+	lockName    string
+	lockTimeout time.Duration
+}
+
+func NewMigrator(db *sql.DB, dialect Dialect, migrations []Migration) *Migrator {
+	return &Migrator{
+		db:          db,
+		dialect:     dialect,
+		migrations:  migrations,
+		table:       "schema_migrations",
+		lockName:    "device_store_migrations",
+		lockTimeout: 5 * time.Minute,
+	}
+}
+
+// embeddedMigrations returns the migrations built into the binary for dialect, PostgreSQL and SQLite
+// have their own sets in migrations/postgres and migrations/sqlite
+func embeddedMigrations(dialect Dialect) []Migration {
+	dir := "migrations"
+	if dialect == Postgres || dialect == SQLite {
+		dir = "migrations/" + string(dialect)
+	}
+	migrations, err := loadMigrations(migrationFiles, dir)
+	if err != nil {
+		// the files are embedded at build time, this is a programming error
+		panic(err)
+	}
+	return migrations
+}
+
+func (m *Migrator) ensureTable(ctx context.Context, q querier) error {
+	_, err := q.ExecContext(ctx, "CREATE TABLE IF NOT EXISTS "+m.table+` (
+		version BIGINT NOT NULL PRIMARY KEY,
+		name VARCHAR(255) NOT NULL,
+		applied_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+	)`)
+	return err
+}
+
+func (m *Migrator) applied(ctx context.Context, q querier) (map[int]time.Time, error) {
+	rows, err := q.QueryContext(ctx, "SELECT version, applied_time FROM "+m.table)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedTime time.Time
+		if err := rows.Scan(&version, &appliedTime); err != nil {
+			return nil, err
+		}
+		applied[version] = appliedTime
+	}
+	return applied, rows.Err()
+}
+
+// Status lists every known migration with the time it was applied, if it was. It fails when the
+// migrations table does not exist yet, it is only created when migrating.
+func (m *Migrator) Status(ctx context.Context) ([]MigrationStatus, error) {
+	applied, err := m.applied(ctx, m.db)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(m.migrations))
+	for _, migration := range m.migrations {
+		status := MigrationStatus{Migration: migration}
+		if t, ok := applied[migration.Version]; ok {
+			status.AppliedTime = &t
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Pending returns the migrations that have not been applied yet
+func (m *Migrator) Pending(ctx context.Context) ([]Migration, error) {
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, s := range statuses {
+		if s.AppliedTime == nil {
+			pending = append(pending, s.Migration)
+		}
+	}
+	return pending, nil
+}
+
+// withLock runs fn on a connection holding the migration lock
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(m.lockTimeout)
+	for {
+		locked, err := m.dialect.tryLock(ctx, conn, m.lockName)
+		if err != nil {
+			return err
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("timed out waiting for migration lock %v", m.lockName)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+	defer m.dialect.unlock(conn, m.lockName)
+	return fn(conn)
+}
+
+// Up applies every pending migration in order. With dryRun set the statements are written to out instead.
+// On PostgreSQL and SQLite a migration and its record are committed together, a failing migration leaves
+// nothing behind. MySQL commits DDL implicitly, so a migration failing halfway is not rolled back and has to
+// be fixed by hand.
+func (m *Migrator) Up(ctx context.Context, dryRun bool, out io.Writer) ([]Migration, error) {
+	var done []Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		if err := m.ensureTable(ctx, conn); err != nil {
+			return err
+		}
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for _, migration := range m.migrations {
+			if _, ok := applied[migration.Version]; ok {
+				continue
+			}
+			record := "INSERT INTO " + m.table + " (version, name) VALUES (?, ?)"
+			if err := m.apply(ctx, conn, migration, "up", migration.Up, dryRun, out, record, migration.Version, migration.Name); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// Down reverts the last steps applied migrations, newest first
+func (m *Migrator) Down(ctx context.Context, steps int, dryRun bool, out io.Writer) ([]Migration, error) {
+	var done []Migration
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		if err := m.ensureTable(ctx, conn); err != nil {
+			return err
+		}
+		applied, err := m.applied(ctx, conn)
+		if err != nil {
+			return err
+		}
+		for i := len(m.migrations) - 1; i >= 0 && len(done) < steps; i-- {
+			migration := m.migrations[i]
+			if _, ok := applied[migration.Version]; !ok {
+				continue
+			}
+			if strings.TrimSpace(migration.Down) == "" {
+				return fmt.Errorf("migration %v_%v cannot be reverted, it has no down script", migration.Version, migration.Name)
+			}
+			record := "DELETE FROM " + m.table + " WHERE version = ?"
+			if err := m.apply(ctx, conn, migration, "down", migration.Down, dryRun, out, record, migration.Version); err != nil {
+				return err
+			}
+			done = append(done, migration)
+		}
+		return nil
+	})
+	return done, err
+}
+
+// apply runs script and the record statement updating the migrations table, in one transaction where the
+// dialect has transactional DDL
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, migration Migration, direction string, script string,
+	dryRun bool, out io.Writer, record string, args ...any) error {
+	if dryRun {
+		fmt.Fprintf(out, "-- %v_%v\n", migration.Version, migration.Name)
+		for _, statement := range splitStatements(script) {
+			fmt.Fprintf(out, "%v;\n", statement)
+		}
+		return nil
+	}
+	slog.InfoContext(ctx, "Running migration", "version", migration.Version, "name", migration.Name, "direction", direction)
+	if !m.dialect.transactionalDDL() {
+		if err := m.run(ctx, conn, migration, script); err != nil {
+			return err
+		}
+		_, err := conn.ExecContext(ctx, m.dialect.bind(record), args...)
+		return err
+	}
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := m.run(ctx, tx, migration, script); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, m.dialect.bind(record), args...); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func (m *Migrator) run(ctx context.Context, q querier, migration Migration, script string) error {
+	for _, statement := range splitStatements(script) {
+		if _, err := q.ExecContext(ctx, statement); err != nil {
+			return fmt.Errorf("migration %v_%v: %w", migration.Version, migration.Name, err)
+		}
+	}
+	return nil
+}
+
+// migrationCheck reports not ready while embedded migrations are missing from the database
+func migrationCheck(migrator *Migrator) HealthCheck {
+	return HealthCheck{Name: "migrations", Check: func(ctx context.Context) error {
+		pending, err := migrator.Pending(ctx)
+		if err != nil {
+			return err
+		}
+		if len(pending) > 0 {
+			return fmt.Errorf("%v pending migrations, first is %v_%v", len(pending), pending[0].Version, pending[0].Name)
+		}
+		return nil
+	}}
+}
+
+var errUsage = errors.New("usage: device-store migrate up|down [steps]|status|dry-run")
+
+// runMigrateCommand implements the migrate subcommand
+func runMigrateCommand(ctx context.Context, migrator *Migrator, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	switch args[0] {
+	case "up", "dry-run":
+		dryRun := args[0] == "dry-run"
+		applied, err := migrator.Up(ctx, dryRun, out)
+		if err != nil {
+			return err
+		}
+		if !dryRun {
+			for _, m := range applied {
+				fmt.Fprintf(out, "applied %v_%v\n", m.Version, m.Name)
+			}
+			if len(applied) == 0 {
+				fmt.Fprintln(out, "nothing to apply")
+			}
+		}
+		return nil
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n <= 0 {
+				return errUsage
+			}
+			steps = n
+		}
+		reverted, err := migrator.Down(ctx, steps, false, out)
+		if err != nil {
+			return err
+		}
+		for _, m := range reverted {
+			fmt.Fprintf(out, "reverted %v_%v\n", m.Version, m.Name)
+		}
+		return nil
+	case "status":
+		if err := migrator.ensureTable(ctx, migrator.db); err != nil {
+			return err
+		}
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedTime != nil {
+				applied = "applied " + s.AppliedTime.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(out, "%04d %-40v %v\n", s.Version, s.Name, applied)
+		}
+		return nil
+	}
+	return errUsage
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+)
+
+// testMigrator migrates its own tables so it does not interfere with the schema the other tests use
+func testMigrator(t *testing.T) *Migrator {
+	t.Helper()
+	migrations, err := loadMigrations(fstest.MapFS{
+		"m/0001_create_things.up.sql":   {Data: []byte("CREATE TABLE migration_test_things (id INT NOT NULL PRIMARY KEY, name VARCHAR(10) NOT NULL DEFAULT 'a;b');")},
+		"m/0001_create_things.down.sql": {Data: []byte("DROP TABLE migration_test_things;")},
+		"m/0002_seed_things.up.sql":     {Data: []byte("-- two statements\nINSERT INTO migration_test_things (id) VALUES (1);\nINSERT INTO migration_test_things (id) VALUES (2);\n")},
+		"m/0002_seed_things.down.sql":   {Data: []byte("DELETE FROM migration_test_things;")},
+	}, "m")
+	if err != nil {
+		t.Fatal(err)
+	}
+	impl := repository.(RepositoryImpl)
+	migrator := NewMigrator(impl.db, impl.dialect, migrations)
+	migrator.table = "schema_migrations_test"
+	migrator.lockName = "device_store_migrations_test"
+	t.Cleanup(func() {
+		migrator.db.Exec("DROP TABLE IF EXISTS migration_test_things")
+		migrator.db.Exec("DROP TABLE IF EXISTS schema_migrations_test")
+	})
+	return migrator
+}
+
+func countThings(t *testing.T, migrator *Migrator) int {
+	t.Helper()
+	var count int
+	if err := migrator.db.QueryRow("SELECT COUNT(*) FROM migration_test_things").Scan(&count); err != nil {
+		t.Fatal(err)
+	}
+	return count
+}
+
+func Test_Migrator(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("should apply pending migrations once and in order", func(t *testing.T) {
+		migrator := testMigrator(t)
+		applied, err := migrator.Up(ctx, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != 2 || applied[0].Version != 1 || applied[1].Version != 2 {
+			t.Errorf("expected migrations 1 and 2, got %v", applied)
+		}
+		if count := countThings(t, migrator); count != 2 {
+			t.Errorf("expected 2 rows, got %v", count)
+		}
+		applied, err = migrator.Up(ctx, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(applied) != 0 {
+			t.Errorf("expected nothing left to apply, got %v", applied)
+		}
+		pending, err := migrator.Pending(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 0 {
+			t.Errorf("expected no pending migrations, got %v", pending)
+		}
+	})
+
+	t.Run("should revert migrations newest first", func(t *testing.T) {
+		migrator := testMigrator(t)
+		if _, err := migrator.Up(ctx, false, nil); err != nil {
+			t.Fatal(err)
+		}
+		reverted, err := migrator.Down(ctx, 1, false, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reverted) != 1 || reverted[0].Version != 2 {
+			t.Errorf("expected migration 2 to be reverted, got %v", reverted)
+		}
+		if count := countThings(t, migrator); count != 0 {
+			t.Errorf("expected seeded rows to be removed, got %v", count)
+		}
+		statuses, err := migrator.Status(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if statuses[0].AppliedTime == nil || statuses[1].AppliedTime != nil {
+			t.Errorf("expected only migration 1 to be applied, got %v", statuses)
+		}
+	})
+
+	t.Run("should only print statements on dry run", func(t *testing.T) {
+		migrator := testMigrator(t)
+		var out bytes.Buffer
+		if err := runMigrateCommand(ctx, migrator, []string{"dry-run"}, &out); err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(out.String(), "-- 1_create_things\nCREATE TABLE migration_test_things") ||
+			!strings.Contains(out.String(), "-- 2_seed_things\nINSERT INTO migration_test_things (id) VALUES (1);") {
+			t.Errorf("expected statements of both migrations, got\n%v", out.String())
+		}
+		pending, err := migrator.Pending(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 2 {
+			t.Errorf("expected dry run to apply nothing, got %v pending", len(pending))
+		}
+		out.Reset()
+		if err := runMigrateCommand(ctx, migrator, []string{"status"}, &out); err != nil {
+			t.Fatal(err)
+		}
+		if strings.Count(out.String(), "pending") != 2 {
+			t.Errorf("expected both migrations pending, got\n%v", out.String())
+		}
+	})
+
+	t.Run("should let only one replica migrate", func(t *testing.T) {
+		first, second := testMigrator(t), testMigrator(t)
+		var wg sync.WaitGroup
+		results := make([][]Migration, 2)
+		errs := make([]error, 2)
+		for i, migrator := range []*Migrator{first, second} {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results[i], errs[i] = migrator.Up(ctx, false, nil)
+			}()
+		}
+		wg.Wait()
+		if errs[0] != nil || errs[1] != nil {
+			t.Fatal(errs)
+		}
+		if len(results[0])+len(results[1]) != 2 {
+			t.Errorf("expected each migration to be applied once, got %v and %v", results[0], results[1])
+		}
+		if count := countThings(t, first); count != 2 {
+			t.Errorf("expected 2 rows, got %v", count)
+		}
+	})
+
+	t.Run("should roll back a failing migration with its record", func(t *testing.T) {
+		migrator := testMigrator(t)
+		if !migrator.dialect.transactionalDDL() {
+			t.Skip("DDL is committed implicitly on " + migrator.dialect.name())
+		}
+		t.Cleanup(func() { migrator.db.Exec("DROP TABLE IF EXISTS migration_test_halfway") })
+		migrator.migrations = append(migrator.migrations, Migration{Version: 3, Name: "fail_halfway",
+			Up: "CREATE TABLE migration_test_halfway (id INT NOT NULL PRIMARY KEY);\nINSERT INTO migration_test_missing (id) VALUES (1);"})
+		if _, err := migrator.Up(ctx, false, nil); err == nil {
+			t.Fatal("expected migration 3 to fail")
+		}
+		if count := countThings(t, migrator); count != 2 {
+			t.Errorf("expected the migrations before it to stay applied, got %v rows", count)
+		}
+		if _, err := migrator.db.Exec("SELECT COUNT(*) FROM migration_test_halfway"); err == nil {
+			t.Error("expected the table created before the failure to be rolled back")
+		}
+		pending, err := migrator.Pending(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 1 || pending[0].Version != 3 {
+			t.Errorf("expected migration 3 to stay pending, got %v", pending)
+		}
+	})
+
+	t.Run("should apply the embedded migrations", func(t *testing.T) {
+		impl := repository.(RepositoryImpl)
+		pending, err := NewMigrator(impl.db, impl.dialect, embeddedMigrations(impl.dialect)).Pending(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(pending) != 0 {
+			t.Errorf("expected the test database to be migrated, got %v pending", pending)
+		}
+	})
+}
+
+func Test_LoadMigrations(t *testing.T) {
+	t.Run("should reject malformed migration sets", func(t *testing.T) {
+		for name, files := range map[string]fstest.MapFS{
+			"unexpected file": {"m/readme.md": {Data: []byte("x")}},
+			"missing up":      {"m/0001_a.down.sql": {Data: []byte("DROP TABLE a;")}},
+			"two names":       {"m/0001_a.up.sql": {Data: []byte("SELECT 1;")}, "m/0001_b.down.sql": {Data: []byte("SELECT 1;")}},
+		} {
+			if _, err := loadMigrations(files, "m"); err == nil {
+				t.Errorf("%v: expected an error", name)
+			}
+		}
+	})
+
+	t.Run("should split statements outside of quotes and comments", func(t *testing.T) {
+		statements := splitStatements("-- comment; with semicolon\nINSERT INTO t VALUES ('a;b', \"c\\\";d\");\n\nSELECT 1;")
+		expected := []string{"INSERT INTO t VALUES ('a;b', \"c\\\";d\")", "SELECT 1"}
+		if !reflect.DeepEqual(statements, expected) {
+			t.Errorf("expected %q, got %q", expected, statements)
+		}
+	})
+}
+
+// baselineSchema is the devices table init.sql created before migrations existed
+const baselineSchema = `CREATE TABLE IF NOT EXISTS devices (
+    id INT AUTO_INCREMENT NOT NULL UNIQUE,
+    name VARCHAR(100) NOT NULL,
+    brand VARCHAR(100) NOT NULL,
+    creation_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (name, brand)
+)`
+
+func Test_MigrateBaselineDatabase(t *testing.T) {
+	serverDSN := mysqlServerDSN(t)
+
+	t.Run("should upgrade a database created from init.sql", func(t *testing.T) {
+		ctx := context.Background()
+		dsn, drop, err := createDatabase(serverDSN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { drop() })
+		db, dialect, err := openDB(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if _, err := db.Exec(baselineSchema); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := db.Exec("INSERT INTO devices (name, brand) VALUES ('Baseline', 'Legacy')"); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := NewMigrator(db, dialect, embeddedMigrations(dialect)).Up(ctx, false, io.Discard); err != nil {
+			t.Fatalf("expected the baseline database to migrate, got %v", err)
+		}
+		r := RepositoryImpl{db: db, dialect: dialect}
+		if _, err := r.BackfillPublicIDs(ctx); err != nil {
+			t.Fatal(err)
+		}
+		devices, err := r.FindAllDevices(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 1 || devices[0].Name != "Baseline" || devices[0].PublicID == "" {
+			t.Fatalf("expected the existing device in the default tenant, got %v", devices)
+		}
+		other := withTenant(ctx, "other")
+		if _, err := r.SaveDevice(other, Device{Name: "Baseline", Brand: "Legacy"}); err != nil {
+			t.Errorf("expected another tenant to reuse the name, got %v", err)
+		}
+		if _, err := r.SaveDevice(ctx, Device{Name: "Baseline", Brand: "Legacy"}); !errors.Is(err, ErrDeviceExists) {
+			t.Errorf("expected the name to stay unique in the default tenant, got %v", err)
+		}
+	})
+}
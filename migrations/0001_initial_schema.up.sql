@@ -0,0 +1,60 @@
+-- Schema as previously created by init.sql. IF NOT EXISTS lets databases created from init.sql adopt migrations,
+-- so devices must stay exactly as init.sql created it; later versions change it.
+
+CREATE TABLE IF NOT EXISTS devices (
+    id INT AUTO_INCREMENT NOT NULL UNIQUE,
+    name VARCHAR(100) NOT NULL,
+    brand VARCHAR(100) NOT NULL,
+    creation_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (name, brand)
+);
+
+CREATE TABLE IF NOT EXISTS tenant_quotas (
+    tenant_id VARCHAR(64) NOT NULL PRIMARY KEY,
+    max_devices INT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+    id INT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+    url VARCHAR(2048) NOT NULL,
+    events VARCHAR(255) NOT NULL DEFAULT '',
+    brand VARCHAR(100) NOT NULL DEFAULT '',
+    secret VARCHAR(255) NOT NULL,
+    creation_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id INT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+    webhook_id INT NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    payload TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_status_code INT NULL,
+    last_error TEXT NULL,
+    creation_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    INDEX idx_webhook_deliveries_due (status, next_attempt_time),
+    FOREIGN KEY (webhook_id) REFERENCES webhooks(id) ON DELETE CASCADE
+);
+
+CREATE TABLE IF NOT EXISTS device_outbox (
+    id BIGINT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+    tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+    device_id INT NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    payload TEXT NOT NULL,
+    creation_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    published_time TIMESTAMP NULL,
+    INDEX idx_device_outbox_unpublished (published_time, id)
+);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id INT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+    name VARCHAR(100) NOT NULL,
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    scopes VARCHAR(255) NOT NULL,
+    tenant_id VARCHAR(64) NULL,
+    creation_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    revoked_time TIMESTAMP NULL
+);
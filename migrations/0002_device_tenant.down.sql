@@ -0,0 +1,3 @@
+-- fails while two tenants have a device with the same name and brand
+ALTER TABLE devices DROP PRIMARY KEY, ADD PRIMARY KEY (name, brand);
+ALTER TABLE devices DROP COLUMN tenant_id;
@@ -0,0 +1,4 @@
+-- Devices belong to a tenant, existing devices to the default one. (tenant_id, name, brand) replaces (name, brand)
+-- as the key so each tenant has its own names.
+ALTER TABLE devices ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default' AFTER id;
+ALTER TABLE devices DROP PRIMARY KEY, ADD PRIMARY KEY (tenant_id, name, brand);
@@ -0,0 +1,3 @@
+ALTER TABLE devices ADD UNIQUE INDEX id (id);
+ALTER TABLE devices DROP INDEX uq_devices_tenant_name_brand;
+ALTER TABLE devices DROP PRIMARY KEY, ADD PRIMARY KEY (tenant_id, name, brand);
@@ -0,0 +1,5 @@
+-- Make id the primary key so renames no longer rewrite the clustered key, (tenant_id, name, brand) stays unique
+ALTER TABLE devices DROP PRIMARY KEY, ADD PRIMARY KEY (id);
+ALTER TABLE devices ADD UNIQUE INDEX uq_devices_tenant_name_brand (tenant_id, name, brand);
+-- the UNIQUE constraint on id is covered by the primary key now
+ALTER TABLE devices DROP INDEX id;
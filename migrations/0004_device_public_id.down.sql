@@ -0,0 +1,2 @@
+ALTER TABLE devices DROP INDEX uq_devices_public_id;
+ALTER TABLE devices DROP COLUMN public_id;
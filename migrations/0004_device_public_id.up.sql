@@ -0,0 +1,3 @@
+-- Opaque public id for the API, id stays for joins. Existing rows are backfilled by BackfillPublicIDs after migrating.
+ALTER TABLE devices ADD COLUMN public_id CHAR(26) NULL;
+ALTER TABLE devices ADD UNIQUE INDEX uq_devices_public_id (public_id);
@@ -0,0 +1,26 @@
+-- People devices are loaned to and the loans. open_device_id is set while a loan is open, its unique index
+-- keeps a device from being checked out twice.
+CREATE TABLE IF NOT EXISTS assignees (
+    id INT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+    public_id CHAR(26) NOT NULL,
+    tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+    name VARCHAR(100) NOT NULL,
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    creation_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE INDEX uq_assignees_public_id (public_id)
+);
+
+CREATE TABLE IF NOT EXISTS device_assignments (
+    id INT AUTO_INCREMENT NOT NULL PRIMARY KEY,
+    tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+    device_id INT NOT NULL,
+    assignee_id INT NOT NULL,
+    open_device_id INT NULL,
+    checkout_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    due_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    checkin_time TIMESTAMP NULL,
+    UNIQUE INDEX uq_device_assignments_open (open_device_id),
+    INDEX idx_device_assignments_due (tenant_id, checkin_time, due_time),
+    FOREIGN KEY (device_id) REFERENCES devices(id) ON DELETE CASCADE,
+    FOREIGN KEY (assignee_id) REFERENCES assignees(id) ON DELETE CASCADE
+);
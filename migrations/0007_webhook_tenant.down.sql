@@ -0,0 +1,3 @@
+ALTER TABLE webhook_deliveries DROP COLUMN tenant_id;
+ALTER TABLE webhooks DROP INDEX idx_webhooks_tenant;
+ALTER TABLE webhooks DROP COLUMN tenant_id;
@@ -0,0 +1,2 @@
+ALTER TABLE webhook_deliveries DROP INDEX uq_webhook_deliveries_event;
+ALTER TABLE webhook_deliveries DROP COLUMN event_id;
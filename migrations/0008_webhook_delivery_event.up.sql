@@ -0,0 +1,3 @@
+-- The outbox event a delivery was queued for, a webhook gets each event once however often it is published
+ALTER TABLE webhook_deliveries ADD COLUMN event_id BIGINT NULL AFTER webhook_id;
+ALTER TABLE webhook_deliveries ADD UNIQUE INDEX uq_webhook_deliveries_event (webhook_id, event_id);
@@ -0,0 +1,14 @@
+-- Responses to requests carrying an Idempotency-Key, status_code is NULL while the first request is running
+CREATE TABLE IF NOT EXISTS idempotency_keys (
+    tenant_id VARCHAR(64) NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    fingerprint CHAR(64) NOT NULL,
+    status_code INT NULL,
+    content_type VARCHAR(255) NOT NULL DEFAULT '',
+    body TEXT NULL,
+    creation_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (tenant_id, idempotency_key)
+);
+
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires ON idempotency_keys (expires_time);
@@ -0,0 +1,3 @@
+DELETE FROM idempotency_keys WHERE subject <> '';
+ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey, ADD PRIMARY KEY (tenant_id, idempotency_key);
+ALTER TABLE idempotency_keys DROP COLUMN subject;
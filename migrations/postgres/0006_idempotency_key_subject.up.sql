@@ -0,0 +1,3 @@
+-- Idempotency keys belong to the principal that sent them, another caller of the tenant cannot replay the response
+ALTER TABLE idempotency_keys ADD COLUMN subject VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE idempotency_keys DROP CONSTRAINT idempotency_keys_pkey, ADD PRIMARY KEY (tenant_id, subject, idempotency_key);
@@ -0,0 +1,64 @@
+-- SQLite schema, equivalent to the MySQL migrations up to 0004. Name and brand compare case insensitively
+-- like they do with the default MySQL collation. New versions are added to every set.
+
+CREATE TABLE IF NOT EXISTS devices (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    public_id CHAR(26) NULL,
+    tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+    name VARCHAR(100) NOT NULL COLLATE NOCASE,
+    brand VARCHAR(100) NOT NULL COLLATE NOCASE,
+    creation_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT uq_devices_public_id UNIQUE (public_id),
+    CONSTRAINT uq_devices_tenant_name_brand UNIQUE (tenant_id, name, brand)
+);
+
+CREATE TABLE IF NOT EXISTS tenant_quotas (
+    tenant_id VARCHAR(64) NOT NULL PRIMARY KEY,
+    max_devices INT NOT NULL
+);
+
+CREATE TABLE IF NOT EXISTS webhooks (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    url VARCHAR(2048) NOT NULL,
+    events VARCHAR(255) NOT NULL DEFAULT '',
+    brand VARCHAR(100) NOT NULL DEFAULT '' COLLATE NOCASE,
+    secret VARCHAR(255) NOT NULL,
+    creation_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    webhook_id INT NOT NULL REFERENCES webhooks(id) ON DELETE CASCADE,
+    event_type VARCHAR(50) NOT NULL,
+    payload TEXT NOT NULL,
+    status VARCHAR(20) NOT NULL DEFAULT 'pending',
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    last_status_code INT NULL,
+    last_error TEXT NULL,
+    creation_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries (status, next_attempt_time);
+
+CREATE TABLE IF NOT EXISTS device_outbox (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+    device_id INT NOT NULL,
+    event_type VARCHAR(50) NOT NULL,
+    payload TEXT NOT NULL,
+    creation_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    published_time TIMESTAMP NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_outbox_unpublished ON device_outbox (published_time, id);
+
+CREATE TABLE IF NOT EXISTS api_keys (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    name VARCHAR(100) NOT NULL,
+    key_hash CHAR(64) NOT NULL UNIQUE,
+    scopes VARCHAR(255) NOT NULL,
+    tenant_id VARCHAR(64) NULL,
+    creation_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    revoked_time TIMESTAMP NULL
+);
@@ -0,0 +1,25 @@
+-- People devices are loaned to and the loans. open_device_id is set while a loan is open, its unique index
+-- keeps a device from being checked out twice.
+CREATE TABLE IF NOT EXISTS assignees (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    public_id CHAR(26) NOT NULL,
+    tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+    name VARCHAR(100) NOT NULL,
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    creation_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    CONSTRAINT uq_assignees_public_id UNIQUE (public_id)
+);
+
+CREATE TABLE IF NOT EXISTS device_assignments (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    tenant_id VARCHAR(64) NOT NULL DEFAULT 'default',
+    device_id INT NOT NULL REFERENCES devices(id) ON DELETE CASCADE,
+    assignee_id INT NOT NULL REFERENCES assignees(id) ON DELETE CASCADE,
+    open_device_id INT NULL,
+    checkout_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    due_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    checkin_time TIMESTAMP NULL,
+    CONSTRAINT uq_device_assignments_open UNIQUE (open_device_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_device_assignments_due ON device_assignments (tenant_id, checkin_time, due_time);
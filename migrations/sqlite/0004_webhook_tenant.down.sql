@@ -0,0 +1,3 @@
+ALTER TABLE webhook_deliveries DROP COLUMN tenant_id;
+DROP INDEX IF EXISTS idx_webhooks_tenant;
+ALTER TABLE webhooks DROP COLUMN tenant_id;
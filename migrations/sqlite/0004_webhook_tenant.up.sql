@@ -0,0 +1,5 @@
+-- Webhooks belong to a tenant and only receive its events, existing ones to the default tenant. Deliveries
+-- carry the tenant so the worker can load their webhook.
+ALTER TABLE webhooks ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default';
+CREATE INDEX IF NOT EXISTS idx_webhooks_tenant ON webhooks (tenant_id);
+ALTER TABLE webhook_deliveries ADD COLUMN tenant_id VARCHAR(64) NOT NULL DEFAULT 'default';
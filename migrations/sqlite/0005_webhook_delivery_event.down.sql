@@ -0,0 +1,2 @@
+DROP INDEX IF EXISTS uq_webhook_deliveries_event;
+ALTER TABLE webhook_deliveries DROP COLUMN event_id;
@@ -0,0 +1,3 @@
+-- The outbox event a delivery was queued for, a webhook gets each event once however often it is published
+ALTER TABLE webhook_deliveries ADD COLUMN event_id BIGINT NULL;
+CREATE UNIQUE INDEX IF NOT EXISTS uq_webhook_deliveries_event ON webhook_deliveries (webhook_id, event_id);
@@ -0,0 +1,16 @@
+CREATE TABLE idempotency_keys_by_tenant (
+    tenant_id VARCHAR(64) NOT NULL,
+    idempotency_key VARCHAR(255) NOT NULL,
+    fingerprint CHAR(64) NOT NULL,
+    status_code INT NULL,
+    content_type VARCHAR(255) NOT NULL DEFAULT '',
+    body TEXT NULL,
+    creation_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (tenant_id, idempotency_key)
+);
+INSERT INTO idempotency_keys_by_tenant (tenant_id, idempotency_key, fingerprint, status_code, content_type, body, creation_time, expires_time)
+    SELECT tenant_id, idempotency_key, fingerprint, status_code, content_type, body, creation_time, expires_time FROM idempotency_keys WHERE subject = '';
+DROP TABLE idempotency_keys;
+ALTER TABLE idempotency_keys_by_tenant RENAME TO idempotency_keys;
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires ON idempotency_keys (expires_time);
@@ -0,0 +1,19 @@
+-- Idempotency keys belong to the principal that sent them, another caller of the tenant cannot replay the response.
+-- SQLite cannot change a primary key, the table is copied into one with the new key.
+CREATE TABLE idempotency_keys_by_subject (
+    tenant_id VARCHAR(64) NOT NULL,
+    subject VARCHAR(255) NOT NULL DEFAULT '',
+    idempotency_key VARCHAR(255) NOT NULL,
+    fingerprint CHAR(64) NOT NULL,
+    status_code INT NULL,
+    content_type VARCHAR(255) NOT NULL DEFAULT '',
+    body TEXT NULL,
+    creation_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    expires_time TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    PRIMARY KEY (tenant_id, subject, idempotency_key)
+);
+INSERT INTO idempotency_keys_by_subject (tenant_id, idempotency_key, fingerprint, status_code, content_type, body, creation_time, expires_time)
+    SELECT tenant_id, idempotency_key, fingerprint, status_code, content_type, body, creation_time, expires_time FROM idempotency_keys;
+DROP TABLE idempotency_keys;
+ALTER TABLE idempotency_keys_by_subject RENAME TO idempotency_keys;
+CREATE INDEX IF NOT EXISTS idx_idempotency_keys_expires ON idempotency_keys (expires_time);
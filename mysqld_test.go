@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// mysqlServer is a throwaway mysqld started from the binary at MYSQLD or on the PATH, so the tests need
+// no docker compose. Its data directory lives in a temporary directory removed by Stop.
+type mysqlServer struct {
+	cmd *exec.Cmd
+	dir string
+	dsn string
+	// exited is closed when the process ends
+	exited chan struct{}
+}
+
+// testMySQL is the server started by TestMain when TEST_DATABASE=mysqld, nil otherwise
+var testMySQL *mysqlServer
+
+// startMySQL initializes a data directory under dir and starts mysqld on a free port. It fails
+// when no mysqld binary is found, see MYSQLD.
+func startMySQL(dir string) (*mysqlServer, error) {
+	binary := getEnv("MYSQLD", "mysqld")
+	path, err := exec.LookPath(binary)
+	if err != nil {
+		return nil, fmt.Errorf("no mysqld binary found, install MySQL 8 or set MYSQLD: %w", err)
+	}
+	dataDir := filepath.Join(dir, "data")
+	base := []string{"--no-defaults", "--datadir=" + dataDir}
+	if os.Geteuid() == 0 {
+		// mysqld refuses to run as root unless told to
+		base = append(base, "--user=root")
+	}
+	initialize := exec.Command(path, append(base, "--initialize-insecure", "--log-error="+filepath.Join(dir, "initialize.log"))...)
+	if out, err := initialize.CombinedOutput(); err != nil {
+		log, _ := os.ReadFile(filepath.Join(dir, "initialize.log"))
+		return nil, fmt.Errorf("initializing mysqld: %v\n%s%s", err, out, log)
+	}
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	cmd := exec.Command(path, append(base,
+		"--port="+strconv.Itoa(port),
+		"--bind-address=127.0.0.1",
+		"--socket="+filepath.Join(dir, "mysqld.sock"),
+		"--pid-file="+filepath.Join(dir, "mysqld.pid"),
+		"--tmpdir="+dir,
+		"--log-error="+filepath.Join(dir, "error.log"),
+		"--mysqlx=OFF",
+		"--skip-log-bin",
+	)...)
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	server := &mysqlServer{cmd: cmd, dir: dir, dsn: fmt.Sprintf("root@tcp(127.0.0.1:%d)/?parseTime=true", port), exited: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(server.exited)
+	}()
+	if err := server.waitReady(time.Minute); err != nil {
+		server.Stop()
+		log, _ := os.ReadFile(filepath.Join(dir, "error.log"))
+		return nil, fmt.Errorf("%w\n%s", err, log)
+	}
+	return server, nil
+}
+
+func freePort() (int, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return 0, err
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port, nil
+}
+
+func (s *mysqlServer) waitReady(timeout time.Duration) error {
+	db, err := sql.Open("mysql", s.dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.exited:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := connectDB(ctx, db); err != nil {
+		select {
+		case <-s.exited:
+			return errors.New("mysqld exited before accepting connections")
+		default:
+			return fmt.Errorf("mysqld did not accept connections within %v", timeout)
+		}
+	}
+	return nil
+}
+
+// Stop shuts mysqld down and removes its data
+func (s *mysqlServer) Stop() {
+	s.cmd.Process.Signal(syscall.SIGTERM)
+	select {
+	case <-s.exited:
+	case <-time.After(30 * time.Second):
+		s.cmd.Process.Kill()
+		<-s.exited
+	}
+	os.RemoveAll(filepath.Join(s.dir, "data"))
+}
+
+var databaseNames atomic.Int64
+
+// createDatabase creates a schema with a name unique to this test process on the server at serverDSN
+// and returns the DSN of the new schema
+func createDatabase(serverDSN string) (string, func() error, error) {
+	config, err := mysql.ParseDSN(serverDSN)
+	if err != nil {
+		return "", nil, err
+	}
+	name := fmt.Sprintf("device_store_test_%d_%d", os.Getpid(), databaseNames.Add(1))
+	config.DBName = ""
+	db, err := sql.Open("mysql", config.FormatDSN())
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := db.Exec("CREATE DATABASE " + name); err != nil {
+		db.Close()
+		return "", nil, err
+	}
+	drop := func() error {
+		defer db.Close()
+		_, err := db.Exec("DROP DATABASE IF EXISTS " + name)
+		return err
+	}
+	config.DBName = name
+	config.ParseTime = true
+	return config.FormatDSN(), drop, nil
+}
+
+// mysqlDatabase gives the test its own migrated schema on the server at serverDSN, dropped when the test
+// ends, so tests using it can run in parallel
+func mysqlDatabase(t *testing.T, serverDSN string) RepositoryImpl {
+	t.Helper()
+	dsn, drop, err := createDatabase(serverDSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := drop(); err != nil {
+			t.Errorf("dropping test database: %v", err)
+		}
+	})
+	return migratedRepository(t, dsn)
+}
+
+// mysqlServerDSN is the server tests create their schemas on: the one TestMain started, TEST_MYSQL_DSN
+// or none, in which case the test is skipped
+func mysqlServerDSN(t *testing.T) string {
+	t.Helper()
+	if testMySQL != nil {
+		return testMySQL.dsn
+	}
+	if dsn := os.Getenv("TEST_MYSQL_DSN"); dsn != "" {
+		return dsn
+	}
+	t.Skip("no MySQL server, run with TEST_DATABASE=mysqld or set TEST_MYSQL_DSN")
+	return ""
+}
+
+func Test_MySQLHarness(t *testing.T) {
+	serverDSN := mysqlServerDSN(t)
+
+	t.Run("should give every test its own migrated schema", func(t *testing.T) {
+		ctx := context.Background()
+		first, second := mysqlDatabase(t, serverDSN), mysqlDatabase(t, serverDSN)
+		if _, err := first.SaveDevice(ctx, Device{Name: "Isolated", Brand: "Harness"}); err != nil {
+			t.Fatal(err)
+		}
+		devices, err := second.FindAllDevices(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 0 {
+			t.Errorf("expected schemas to be isolated, got %v", devices)
+		}
+		if _, err := second.SaveDevice(ctx, Device{Name: "Isolated", Brand: "Harness"}); err != nil {
+			t.Errorf("expected the same device to be allowed in another schema, got %v", err)
+		}
+	})
+}
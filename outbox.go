@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	EventDeviceCreated = "device.created"
+	EventDeviceUpdated = "device.updated"
+	EventDeviceDeleted = "device.deleted"
+	// EventDeviceCheckedOut and EventDeviceCheckedIn carry the device as it is after the change
+	EventDeviceCheckedOut = "device.checked_out"
+	EventDeviceCheckedIn  = "device.checked_in"
+)
+
+// DeviceEvent is the payload of an outbox event and the body posted to webhook subscribers. ID is the
+// outbox id, set when the event is posted; it stays the same when an event is delivered again.
+type DeviceEvent struct {
+	ID         int64     `json:"id,omitempty"`
+	Type       string    `json:"type"`
+	Tenant     string    `json:"tenant"`
+	OccurredAt time.Time `json:"occurred_at"`
+	Device     Device    `json:"device"`
+}
+
+// OutboxEvent is a device change recorded in the same transaction as the change itself
+type OutboxEvent struct {
+	ID           int64           `json:"id"`
+	DeviceID     int             `json:"device_id"`
+	Type         string          `json:"type"`
+	Payload      json.RawMessage `json:"payload"`
+	CreationTime time.Time       `json:"creation_time"`
+}
+
+// Publisher delivers outbox events downstream. Publish may be called more than once for the
+// same event, so implementations must tolerate duplicates.
+type Publisher interface {
+	Publish(ctx context.Context, event OutboxEvent) error
+}
+
+var outboxRepository OutboxRepository
+
+type OutboxRepository interface {
+	FindUnpublishedEvents(limit int) ([]OutboxEvent, error)
+	MarkEventPublished(id int64) error
+	// DeletePublishedEvents deletes the events published before before and returns how many
+	DeletePublishedEvents(ctx context.Context, before time.Time) (int64, error)
+	// TryLock takes the relay lock so only one replica publishes at a time
+	TryLock(ctx context.Context) (unlock func(), ok bool, err error)
+}
+
+type OutboxRepositoryImpl struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+const outboxLockName = "device_store_outbox_relay"
+
+// insertOutboxEvent records a device event, q is expected to be the transaction that changed the device
+func insertOutboxEvent(ctx context.Context, q querier, eventType string, device Device) error {
+	tenant := tenantFromContext(ctx)
+	payload, err := json.Marshal(DeviceEvent{Type: eventType, Tenant: tenant, OccurredAt: time.Now().UTC(), Device: device})
+	if err != nil {
+		return err
+	}
+	query := "INSERT INTO device_outbox (tenant_id, device_id, event_type, payload, creation_time) VALUES (?, ?, ?, ?, NOW())"
+	_, err = q.ExecContext(ctx, query, tenant, device.ID, eventType, string(payload))
+	return err
+}
+
+func (r OutboxRepositoryImpl) FindUnpublishedEvents(limit int) ([]OutboxEvent, error) {
+	query := "SELECT id, device_id, event_type, payload, creation_time FROM device_outbox WHERE published_time IS NULL ORDER BY id LIMIT ?"
+	rows, err := r.db.Query(r.dialect.bind(query), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []OutboxEvent{}
+	for rows.Next() {
+		var event OutboxEvent
+		var payload string
+		err := rows.Scan(&event.ID, &event.DeviceID, &event.Type, &payload, &event.CreationTime)
+		if err != nil {
+			return nil, err
+		}
+		event.Payload = []byte(payload)
+		events = append(events, event)
+	}
+	return events, rows.Err()
+}
+
+func (r OutboxRepositoryImpl) MarkEventPublished(id int64) error {
+	query := "UPDATE device_outbox SET published_time = NOW() WHERE id = ?"
+	_, err := r.db.Exec(r.dialect.bind(query), id)
+	return err
+}
+
+func (r OutboxRepositoryImpl) DeletePublishedEvents(ctx context.Context, before time.Time) (int64, error) {
+	query := "DELETE FROM device_outbox WHERE published_time < ?"
+	result, err := r.db.ExecContext(ctx, r.dialect.bind(query), before.UTC())
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (r OutboxRepositoryImpl) TryLock(ctx context.Context) (func(), bool, error) {
+	return tryNamedLock(ctx, r.db, r.dialect, outboxLockName)
+}
+
+type OutboxRelay struct {
+	repo      OutboxRepository
+	publisher Publisher
+	interval  time.Duration
+	batch     int
+}
+
+func NewOutboxRelay(repo OutboxRepository, publisher Publisher) *OutboxRelay {
+	return &OutboxRelay{
+		repo:      repo,
+		publisher: publisher,
+		interval:  500 * time.Millisecond,
+		batch:     100,
+	}
+}
+
+// Run relays outbox events until ctx is cancelled
+func (o *OutboxRelay) Run(ctx context.Context) {
+	ticker := time.NewTicker(o.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			o.RelayPending(ctx)
+		}
+	}
+}
+
+// RelayPending publishes unpublished events in insertion order. When publishing an event fails
+// the remaining events of that device are held back until the next run so per-device order is kept.
+func (o *OutboxRelay) RelayPending(ctx context.Context) {
+	unlock, ok, err := o.repo.TryLock(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error acquiring outbox relay lock", "error", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	events, err := o.repo.FindUnpublishedEvents(o.batch)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error finding outbox events", "error", err)
+		return
+	}
+	blocked := map[int]bool{}
+	for _, event := range events {
+		if blocked[event.DeviceID] {
+			continue
+		}
+		if err := o.publisher.Publish(ctx, event); err != nil {
+			slog.ErrorContext(ctx, "Error publishing outbox event", "event_id", event.ID, "error", err)
+			blocked[event.DeviceID] = true
+			continue
+		}
+		if err := o.repo.MarkEventPublished(event.ID); err != nil {
+			slog.ErrorContext(ctx, "Error marking outbox event published", "event_id", event.ID, "error", err)
+			blocked[event.DeviceID] = true
+		}
+	}
+}
+
+// outboxRetention is how long published events are kept. The invalidation bus follows device_outbox and waits
+// at most its grace period for ids committed out of order, every replica has read the events long before.
+const outboxRetention = time.Hour
+
+// pruneOutbox deletes the events published more than retention ago every interval until ctx is cancelled
+func pruneOutbox(repo OutboxRepository, interval time.Duration, retention time.Duration) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			deleted, err := repo.DeletePublishedEvents(ctx, time.Now().Add(-retention))
+			if err != nil {
+				slog.ErrorContext(ctx, "Error deleting published outbox events", "error", err)
+			} else if deleted > 0 {
+				slog.DebugContext(ctx, "Deleted published outbox events", "events", deleted)
+			}
+		}
+	}
+}
+
+// ChannelPublisher hands events to an in-process consumer
+type ChannelPublisher struct {
+	Events chan OutboxEvent
+}
+
+func NewChannelPublisher(size int) ChannelPublisher {
+	return ChannelPublisher{Events: make(chan OutboxEvent, size)}
+}
+
+func (cp ChannelPublisher) Publish(ctx context.Context, event OutboxEvent) error {
+	select {
+	case cp.Events <- event:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// FilePublisher appends events to a file as JSON lines
+type FilePublisher struct {
+	mu   sync.Mutex
+	file *os.File
+}
+
+func NewFilePublisher(path string) (*FilePublisher, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FilePublisher{file: file}, nil
+}
+
+func (fp *FilePublisher) Publish(ctx context.Context, event OutboxEvent) error {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	fp.mu.Lock()
+	defer fp.mu.Unlock()
+	if _, err := fp.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return fp.file.Sync()
+}
+
+func (fp *FilePublisher) Close() error {
+	return fp.file.Close()
+}
+
+// MultiPublisher publishes every event to each publisher in turn and fails on the first error
+type MultiPublisher []Publisher
+
+func (mp MultiPublisher) Publish(ctx context.Context, event OutboxEvent) error {
+	for _, p := range mp {
+		if err := p.Publish(ctx, event); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes the publishers that hold resources, such as a FilePublisher
+func (mp MultiPublisher) Close() error {
+	var errs []error
+	for _, p := range mp {
+		if c, ok := p.(io.Closer); ok {
+			errs = append(errs, c.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
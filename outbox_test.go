@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type failingPublisher struct {
+	deviceID  int
+	published []OutboxEvent
+}
+
+func (fp *failingPublisher) Publish(ctx context.Context, event OutboxEvent) error {
+	if event.DeviceID == fp.deviceID {
+		return errors.New("publish failed")
+	}
+	fp.published = append(fp.published, event)
+	return nil
+}
+
+// drainOutbox marks every pending event published so tests only see their own events
+func drainOutbox(t *testing.T) {
+	t.Helper()
+	relay := NewOutboxRelay(outboxRepository, MultiPublisher{})
+	for i := 0; i < 100; i++ {
+		events, err := outboxRepository.FindUnpublishedEvents(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) == 0 {
+			return
+		}
+		relay.RelayPending(context.Background())
+	}
+	t.Fatal("expected outbox to be drained")
+}
+
+func Test_OutboxRelay(t *testing.T) {
+	t.Run("should record an event for every device mutation", func(t *testing.T) {
+		drainOutbox(t)
+		device, err := repository.SaveDevice(context.Background(), Device{Name: "Outbox Device", Brand: "Outbox Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		device.Name = "Renamed Outbox Device"
+		_, err = repository.UpdateDevice(context.Background(), device)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = repository.DeleteDevice(context.Background(), device.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		publisher := NewChannelPublisher(10)
+		NewOutboxRelay(outboxRepository, publisher).RelayPending(context.Background())
+		close(publisher.Events)
+		var types []string
+		for event := range publisher.Events {
+			if event.DeviceID != device.ID {
+				t.Errorf("expected device id %v, got %v", device.ID, event.DeviceID)
+			}
+			var deviceEvent DeviceEvent
+			err := json.Unmarshal(event.Payload, &deviceEvent)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if deviceEvent.Device.Brand != device.Brand {
+				t.Errorf("expected brand %v, got %v", device.Brand, deviceEvent.Device.Brand)
+			}
+			types = append(types, event.Type)
+		}
+		expected := []string{EventDeviceCreated, EventDeviceUpdated, EventDeviceDeleted}
+		if len(types) != len(expected) {
+			t.Fatalf("expected events %v, got %v", expected, types)
+		}
+		for i := range expected {
+			if types[i] != expected[i] {
+				t.Errorf("expected events %v, got %v", expected, types)
+			}
+		}
+		drainOutbox(t)
+	})
+
+	t.Run("should not record an event when the mutation fails", func(t *testing.T) {
+		drainOutbox(t)
+		device, err := repository.SaveDevice(context.Background(), Device{Name: "Outbox Duplicate", Brand: "Outbox Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = repository.SaveDevice(context.Background(), Device{Name: "Outbox Duplicate", Brand: "Outbox Brand"})
+		if err == nil {
+			t.Fatal("expected duplicate device to fail")
+		}
+		events, err := outboxRepository.FindUnpublishedEvents(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0].DeviceID != device.ID {
+			t.Errorf("expected only the created event, got %v", events)
+		}
+		drainOutbox(t)
+	})
+
+	t.Run("should hold back later events of a device whose publish failed", func(t *testing.T) {
+		drainOutbox(t)
+		failing, err := repository.SaveDevice(context.Background(), Device{Name: "Failing Outbox Device", Brand: "Outbox Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		other, err := repository.SaveDevice(context.Background(), Device{Name: "Other Outbox Device", Brand: "Outbox Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = repository.UpdateDevice(context.Background(), failing)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		publisher := &failingPublisher{deviceID: failing.ID}
+		NewOutboxRelay(outboxRepository, publisher).RelayPending(context.Background())
+		if len(publisher.published) != 1 || publisher.published[0].DeviceID != other.ID {
+			t.Errorf("expected only the other device to be published, got %v", publisher.published)
+		}
+		events, err := outboxRepository.FindUnpublishedEvents(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 2 || events[0].Type != EventDeviceCreated || events[1].Type != EventDeviceUpdated {
+			t.Errorf("expected created and updated events to stay pending, got %v", events)
+		}
+		drainOutbox(t)
+	})
+
+	t.Run("should delete events published before the cutoff only", func(t *testing.T) {
+		r := sqliteRepository(t)
+		outbox := OutboxRepositoryImpl{db: r.db, dialect: r.dialect}
+		ctx := context.Background()
+		published, err := r.SaveDevice(ctx, Device{Name: "Published Device", Brand: "Outbox Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		pending, err := r.SaveDevice(ctx, Device{Name: "Pending Device", Brand: "Outbox Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		NewOutboxRelay(outbox, &failingPublisher{deviceID: pending.ID}).RelayPending(ctx)
+
+		if deleted, err := outbox.DeletePublishedEvents(ctx, time.Now().Add(-time.Hour)); err != nil || deleted != 0 {
+			t.Errorf("expected events published within the retention to be kept, deleted %d: %v", deleted, err)
+		}
+		if deleted, err := outbox.DeletePublishedEvents(ctx, time.Now().Add(time.Hour)); err != nil || deleted != 1 {
+			t.Errorf("expected the published event of %v to be deleted, deleted %d: %v", published.ID, deleted, err)
+		}
+		events, err := outbox.FindUnpublishedEvents(10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(events) != 1 || events[0].DeviceID != pending.ID {
+			t.Errorf("expected the unpublished event to be kept, got %v", events)
+		}
+	})
+
+	t.Run("should append events to a file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "outbox.jsonl")
+		publisher, err := NewFilePublisher(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer publisher.Close()
+		for i := 1; i <= 2; i++ {
+			err := publisher.Publish(context.Background(), OutboxEvent{ID: int64(i), DeviceID: 1, Type: EventDeviceUpdated, Payload: []byte("{}")})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		file, err := os.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		var ids []int64
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			var event OutboxEvent
+			err := json.Unmarshal(scanner.Bytes(), &event)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, event.ID)
+		}
+		if len(ids) != 2 || ids[0] != 1 || ids[1] != 2 {
+			t.Errorf("expected events 1 and 2, got %v", ids)
+		}
+	})
+	repository.DeleteAllDevices()
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// postgresServer is a throwaway PostgreSQL started from the initdb and postgres binaries in POSTGRES_BIN or
+// on the PATH, like mysqlServer. Its data directory lives in a temporary directory removed by Stop.
+type postgresServer struct {
+	cmd *exec.Cmd
+	dir string
+	dsn string
+	// exited is closed when the process ends
+	exited chan struct{}
+}
+
+// testPostgres is the server started by TestMain when TEST_DATABASE=postgres, nil otherwise
+var testPostgres *postgresServer
+
+// postgresBinary finds name in POSTGRES_BIN, the bin directory of a PostgreSQL installation, or on the PATH
+func postgresBinary(name string) (string, error) {
+	if dir := os.Getenv("POSTGRES_BIN"); dir != "" {
+		name = filepath.Join(dir, name)
+	}
+	path, err := exec.LookPath(name)
+	if err != nil {
+		return "", fmt.Errorf("no %v binary found, install PostgreSQL or set POSTGRES_BIN: %w", filepath.Base(name), err)
+	}
+	return path, nil
+}
+
+// startPostgres initializes a cluster under dir and starts postgres on a free port. It fails when no
+// binaries are found, see POSTGRES_BIN, or when run as root, postgres refuses to.
+func startPostgres(dir string) (*postgresServer, error) {
+	initdb, err := postgresBinary("initdb")
+	if err != nil {
+		return nil, err
+	}
+	postgres, err := postgresBinary("postgres")
+	if err != nil {
+		return nil, err
+	}
+	if os.Geteuid() == 0 {
+		return nil, errors.New("postgres cannot run as root, run the tests as another user")
+	}
+	dataDir := filepath.Join(dir, "pgdata")
+	initialize := exec.Command(initdb, "--pgdata="+dataDir, "--username=postgres", "--auth=trust", "--encoding=UTF8", "--no-sync")
+	if out, err := initialize.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("initializing postgres: %v\n%s", err, out)
+	}
+	port, err := freePort()
+	if err != nil {
+		return nil, err
+	}
+	logFile, err := os.Create(filepath.Join(dir, "postgres.log"))
+	if err != nil {
+		return nil, err
+	}
+	defer logFile.Close()
+	cmd := exec.Command(postgres,
+		"-D", dataDir,
+		"-p", strconv.Itoa(port),
+		"-c", "listen_addresses=127.0.0.1",
+		"-c", "unix_socket_directories="+dir,
+		"-c", "fsync=off",
+		"-c", "max_connections=200",
+	)
+	cmd.Stdout, cmd.Stderr = logFile, logFile
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	dsn := fmt.Sprintf("postgres://postgres@127.0.0.1:%d/postgres?sslmode=disable", port)
+	server := &postgresServer{cmd: cmd, dir: dir, dsn: dsn, exited: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		close(server.exited)
+	}()
+	if err := server.waitReady(time.Minute); err != nil {
+		server.Stop()
+		log, _ := os.ReadFile(filepath.Join(dir, "postgres.log"))
+		return nil, fmt.Errorf("%w\n%s", err, log)
+	}
+	return server, nil
+}
+
+func (s *postgresServer) waitReady(timeout time.Duration) error {
+	db, err := sql.Open("postgres", s.dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	go func() {
+		select {
+		case <-s.exited:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	if err := connectDB(ctx, db); err != nil {
+		select {
+		case <-s.exited:
+			return errors.New("postgres exited before accepting connections")
+		default:
+			return fmt.Errorf("postgres did not accept connections within %v", timeout)
+		}
+	}
+	return nil
+}
+
+// Stop shuts postgres down and removes its data
+func (s *postgresServer) Stop() {
+	// SIGINT is the fast shutdown, open sessions are disconnected
+	s.cmd.Process.Signal(syscall.SIGINT)
+	select {
+	case <-s.exited:
+	case <-time.After(30 * time.Second):
+		s.cmd.Process.Kill()
+		<-s.exited
+	}
+	os.RemoveAll(filepath.Join(s.dir, "pgdata"))
+}
+
+// createPostgresDatabase creates a database with a name unique to this test process on the server at
+// serverDSN and returns its DSN
+func createPostgresDatabase(serverDSN string) (string, func() error, error) {
+	u, err := url.Parse(serverDSN)
+	if err != nil {
+		return "", nil, err
+	}
+	name := fmt.Sprintf("device_store_test_%d_%d", os.Getpid(), databaseNames.Add(1))
+	db, err := sql.Open("postgres", serverDSN)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := db.Exec("CREATE DATABASE " + name); err != nil {
+		db.Close()
+		return "", nil, err
+	}
+	drop := func() error {
+		defer db.Close()
+		_, err := db.Exec("DROP DATABASE IF EXISTS " + name + " WITH (FORCE)")
+		return err
+	}
+	u.Path = "/" + name
+	return u.String(), drop, nil
+}
+
+// postgresDatabase gives the test its own migrated database on the server at serverDSN, dropped when the
+// test ends, so tests using it can run in parallel
+func postgresDatabase(t *testing.T, serverDSN string) RepositoryImpl {
+	t.Helper()
+	dsn, drop, err := createPostgresDatabase(serverDSN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := drop(); err != nil {
+			t.Errorf("dropping test database: %v", err)
+		}
+	})
+	return migratedRepository(t, dsn)
+}
+
+// postgresServerDSN is the server tests create their databases on: the one TestMain started or
+// TEST_POSTGRES_DSN, a user that may create databases. Without one the test is skipped, on CI it fails so
+// the PostgreSQL suite cannot silently stop running.
+func postgresServerDSN(t *testing.T) string {
+	t.Helper()
+	if testPostgres != nil {
+		return testPostgres.dsn
+	}
+	if dsn := os.Getenv("TEST_POSTGRES_DSN"); dsn != "" {
+		return dsn
+	}
+	if os.Getenv("CI") != "" {
+		t.Fatal("no PostgreSQL server on CI, run with TEST_DATABASE=postgres or set TEST_POSTGRES_DSN")
+	}
+	t.Skip("no PostgreSQL server, run with TEST_DATABASE=postgres or set TEST_POSTGRES_DSN")
+	return ""
+}
+
+func Test_PostgresHarness(t *testing.T) {
+	serverDSN := postgresServerDSN(t)
+
+	t.Run("should give every test its own migrated database", func(t *testing.T) {
+		ctx := context.Background()
+		first, second := postgresDatabase(t, serverDSN), postgresDatabase(t, serverDSN)
+		if _, err := first.SaveDevice(ctx, Device{Name: "Isolated", Brand: "Harness"}); err != nil {
+			t.Fatal(err)
+		}
+		devices, err := second.FindAllDevices(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 0 {
+			t.Errorf("expected databases to be isolated, got %v", devices)
+		}
+	})
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Limit allows Requests per Per, refilled continuously
+type Limit struct {
+	Requests int
+	Per      time.Duration
+}
+
+// ParseLimit reads limits such as "100/1m" or "5/1s"
+func ParseLimit(s string) (Limit, error) {
+	requests, per, ok := strings.Cut(s, "/")
+	if !ok {
+		return Limit{}, fmt.Errorf("invalid limit %q, expected <requests>/<duration>", s)
+	}
+	n, err := strconv.Atoi(requests)
+	if err != nil || n <= 0 {
+		return Limit{}, fmt.Errorf("invalid request count in limit %q", s)
+	}
+	d, err := time.ParseDuration(per)
+	if err != nil || d <= 0 {
+		return Limit{}, fmt.Errorf("invalid duration in limit %q", s)
+	}
+	return Limit{Requests: n, Per: d}, nil
+}
+
+func (l Limit) String() string {
+	return fmt.Sprintf("%d;w=%d", l.Requests, int(math.Ceil(l.Per.Seconds())))
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// RateLimiter is a set of token buckets keyed by client
+type RateLimiter struct {
+	limit Limit
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func NewRateLimiter(limit Limit) *RateLimiter {
+	return &RateLimiter{limit: limit, now: time.Now, buckets: map[string]*bucket{}}
+}
+
+// Take removes a token from the client's bucket. It returns whether the request is allowed,
+// the tokens left and how long until the bucket is full again (or, when denied, until the next token).
+func (rl *RateLimiter) Take(key string) (bool, int, time.Duration) {
+	rl.mu.Lock()
+	defer rl.mu.Unlock()
+	now := rl.now()
+	rate := float64(rl.limit.Requests) / rl.limit.Per.Seconds()
+	capacity := float64(rl.limit.Requests)
+
+	b, ok := rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: capacity, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens = math.Min(capacity, b.tokens+now.Sub(b.last).Seconds()*rate)
+	b.last = now
+	rl.sweep(now)
+
+	if b.tokens < 1 {
+		wait := time.Duration((1 - b.tokens) / rate * float64(time.Second))
+		return false, 0, wait
+	}
+	b.tokens--
+	reset := time.Duration((capacity - b.tokens) / rate * float64(time.Second))
+	return true, int(b.tokens), reset
+}
+
+// sweep drops buckets that have refilled completely, they behave the same as a new bucket
+func (rl *RateLimiter) sweep(now time.Time) {
+	if now.Sub(rl.swept) < rl.limit.Per {
+		return
+	}
+	rl.swept = now
+	for key, b := range rl.buckets {
+		if now.Sub(b.last) >= rl.limit.Per {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+// RouteLimits are the separate budgets for reading and changing requests of a route
+type RouteLimits struct {
+	Read  Limit
+	Write Limit
+}
+
+// clientKey identifies the caller by the principal authentication verified, otherwise by client IP. A bearer
+// token that was not verified yet is no key, made up tokens would each get a fresh bucket.
+func clientKey(r *http.Request) string {
+	if principal, ok := principalFromContext(r.Context()); ok {
+		return "principal:" + principal.Subject
+	}
+	return "ip:" + clientIP(r)
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// rateLimit applies limits per client to next, with one budget for GET/HEAD and one for other methods. It runs
+// after authentication so callers are told apart by principal.
+func rateLimit(limits RouteLimits, next http.HandlerFunc) http.HandlerFunc {
+	read := NewRateLimiter(limits.Read)
+	write := NewRateLimiter(limits.Write)
+	return func(w http.ResponseWriter, r *http.Request) {
+		limiter := write
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			limiter = read
+		}
+		allowed, remaining, reset := limiter.Take(clientKey(r))
+		seconds := strconv.Itoa(int(math.Ceil(reset.Seconds())))
+		w.Header().Set("RateLimit-Policy", limiter.limit.String())
+		w.Header().Set("RateLimit-Limit", strconv.Itoa(limiter.limit.Requests))
+		w.Header().Set("RateLimit-Remaining", strconv.Itoa(remaining))
+		w.Header().Set("RateLimit-Reset", seconds)
+		if !allowed {
+			w.Header().Set("Retry-After", seconds)
+			writeProblem(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next(w, r)
+	}
+}
+
+// limitClientIPs applies one budget per client IP to every request before its credentials are verified, it
+// bounds the requests and credential lookups a client can cause whatever keys it sends
+func limitClientIPs(limit Limit, next http.Handler) http.Handler {
+	limiter := NewRateLimiter(limit)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed, _, wait := limiter.Take(clientIP(r))
+		if !allowed {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			writeProblem(w, http.StatusTooManyRequests, "rate limit exceeded")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// limitInFlight sheds requests with 503 once max requests are being served
+func limitInFlight(max int, next http.Handler) http.Handler {
+	slots := make(chan struct{}, max)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case slots <- struct{}{}:
+			defer func() { <-slots }()
+			next.ServeHTTP(w, r)
+		default:
+			w.Header().Set("Retry-After", "1")
+			writeProblem(w, http.StatusServiceUnavailable, "server is busy")
+		}
+	})
+}
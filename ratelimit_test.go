@@ -0,0 +1,192 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_RateLimiter(t *testing.T) {
+	t.Run("should refill tokens over time", func(t *testing.T) {
+		now := time.Unix(1000, 0)
+		limiter := NewRateLimiter(Limit{Requests: 2, Per: time.Second})
+		limiter.now = func() time.Time { return now }
+
+		for i := 0; i < 2; i++ {
+			if allowed, _, _ := limiter.Take("client"); !allowed {
+				t.Fatalf("expected request %d to be allowed", i)
+			}
+		}
+		allowed, remaining, retryAfter := limiter.Take("client")
+		if allowed || remaining != 0 {
+			t.Errorf("expected third request to be denied, got allowed %v remaining %v", allowed, remaining)
+		}
+		if retryAfter != 500*time.Millisecond {
+			t.Errorf("expected retry after 500ms, got %v", retryAfter)
+		}
+		if allowed, _, _ := limiter.Take("other client"); !allowed {
+			t.Error("expected other client to have its own bucket")
+		}
+
+		now = now.Add(500 * time.Millisecond)
+		if allowed, _, _ := limiter.Take("client"); !allowed {
+			t.Error("expected request to be allowed after refill")
+		}
+	})
+
+	t.Run("should parse limits", func(t *testing.T) {
+		limit, err := ParseLimit("100/1m")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limit.Requests != 100 || limit.Per != time.Minute {
+			t.Errorf("expected 100 per minute, got %v", limit)
+		}
+		for _, invalid := range []string{"100", "x/1m", "100/x", "0/1m", "-1/1m"} {
+			if _, err := ParseLimit(invalid); err == nil {
+				t.Errorf("expected %q to be invalid", invalid)
+			}
+		}
+	})
+}
+
+func Test_RateLimitMiddleware(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusOK) }
+	handler := rateLimit(RouteLimits{
+		Read:  Limit{Requests: 2, Per: time.Minute},
+		Write: Limit{Requests: 1, Per: time.Minute},
+	}, ok)
+	// subject stands in for the principal authentication verified, token for a credential that was not verified
+	request := func(method string, remoteAddr string, subject string, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/devices", nil)
+		req.RemoteAddr = remoteAddr
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		if subject != "" {
+			req = req.WithContext(withPrincipal(req.Context(), Principal{Subject: subject}))
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	t.Run("should keep separate read and write budgets", func(t *testing.T) {
+		if rr := request("POST", "10.0.0.1:1234", "", ""); rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		rr := request("DELETE", "10.0.0.1:1234", "", "")
+		if rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected status code %d, got %d", http.StatusTooManyRequests, rr.Code)
+		}
+		if rr.Header().Get("Retry-After") != "60" {
+			t.Errorf("expected Retry-After 60, got %v", rr.Header().Get("Retry-After"))
+		}
+		rr = request("GET", "10.0.0.1:4321", "", "")
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected reads to have their own budget, got %d", rr.Code)
+		}
+		if rr.Header().Get("RateLimit-Limit") != "2" || rr.Header().Get("RateLimit-Remaining") != "1" {
+			t.Errorf("expected limit 2 remaining 1, got %v %v", rr.Header().Get("RateLimit-Limit"), rr.Header().Get("RateLimit-Remaining"))
+		}
+		if rr.Header().Get("RateLimit-Policy") != "2;w=60" {
+			t.Errorf("expected policy 2;w=60, got %v", rr.Header().Get("RateLimit-Policy"))
+		}
+	})
+
+	t.Run("should key clients by principal before ip", func(t *testing.T) {
+		if rr := request("POST", "10.0.0.2:1234", "api-key:1", ""); rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		if rr := request("POST", "10.0.0.2:1234", "api-key:2", ""); rr.Code != http.StatusOK {
+			t.Errorf("expected second principal on the same ip to be allowed, got %d", rr.Code)
+		}
+		if rr := request("POST", "10.0.0.3:1234", "api-key:1", ""); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected first principal to be limited from another ip, got %d", rr.Code)
+		}
+	})
+
+	t.Run("should not key clients by unverified tokens", func(t *testing.T) {
+		if rr := request("POST", "10.0.0.4:1234", "", "ds_made_up_1"); rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		if rr := request("POST", "10.0.0.4:1234", "", "ds_made_up_2"); rr.Code != http.StatusTooManyRequests {
+			t.Errorf("expected another made up token from the same ip to be limited, got %d", rr.Code)
+		}
+	})
+}
+
+func Test_LimitClientIPs(t *testing.T) {
+	var authenticated int
+	handler := limitClientIPs(Limit{Requests: 2, Per: time.Minute}, requireScope(APIKeyAuthenticator{repo: apiKeyRepository},
+		deviceScope, func(w http.ResponseWriter, r *http.Request) { authenticated++ }))
+
+	t.Run("should limit clients sending a new key with every request before looking the keys up", func(t *testing.T) {
+		codes := map[int]int{}
+		for i := 0; i < 5; i++ {
+			req := httptest.NewRequest("GET", "/devices", nil)
+			req.RemoteAddr = "10.0.1.1:1234"
+			req.Header.Set("Authorization", "Bearer ds_made_up_"+strconv.Itoa(i))
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			codes[rr.Code]++
+		}
+		if codes[http.StatusUnauthorized] != 2 || codes[http.StatusTooManyRequests] != 3 {
+			t.Errorf("expected 2 rejected keys and 3 limited requests, got %v", codes)
+		}
+		if authenticated != 0 {
+			t.Errorf("expected no request to be authenticated, got %d", authenticated)
+		}
+
+		req := httptest.NewRequest("GET", "/devices", nil)
+		req.RemoteAddr = "10.0.1.2:1234"
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if rr.Code == http.StatusTooManyRequests {
+			t.Error("expected another ip to have its own budget")
+		}
+	})
+}
+
+func Test_LimitInFlight(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	handler := limitInFlight(1, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- struct{}{}
+		<-release
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	first := httptest.NewRecorder()
+	go func() {
+		defer wg.Done()
+		handler.ServeHTTP(first, httptest.NewRequest("GET", "/devices", nil))
+	}()
+	<-started
+
+	shed := httptest.NewRecorder()
+	handler.ServeHTTP(shed, httptest.NewRequest("GET", "/devices", nil))
+	if shed.Code != http.StatusServiceUnavailable {
+		t.Errorf("expected status code %d, got %d", http.StatusServiceUnavailable, shed.Code)
+	}
+	if shed.Header().Get("Retry-After") == "" {
+		t.Error("expected Retry-After header")
+	}
+
+	close(release)
+	wg.Wait()
+	if first.Code != http.StatusOK {
+		t.Errorf("expected in-flight request to complete, got %d", first.Code)
+	}
+	go func() { <-started }()
+	after := httptest.NewRecorder()
+	handler.ServeHTTP(after, httptest.NewRequest("GET", "/devices", nil))
+	if after.Code != http.StatusOK {
+		t.Errorf("expected request after release to be served, got %d", after.Code)
+	}
+}
@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+)
+
+var ErrForbidden = errors.New("forbidden")
+
+// Permission grants device scopes, optionally limited to a set of brands. No brands means all brands.
+type Permission struct {
+	Scopes []string `json:"scopes"`
+	Brands []string `json:"brands,omitempty"`
+}
+
+type Role struct {
+	Name        string       `json:"name"`
+	Permissions []Permission `json:"permissions"`
+}
+
+// RoleBinding grants a role to users (principal subjects) and groups
+type RoleBinding struct {
+	Role   string   `json:"role"`
+	Users  []string `json:"users,omitempty"`
+	Groups []string `json:"groups,omitempty"`
+}
+
+type Policy struct {
+	Roles    []Role        `json:"roles"`
+	Bindings []RoleBinding `json:"bindings"`
+}
+
+func LoadPolicy(path string) (Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return Policy{}, err
+	}
+	var policy Policy
+	if err := json.Unmarshal(b, &policy); err != nil {
+		return Policy{}, err
+	}
+	return policy, policy.Validate()
+}
+
+func (p Policy) Validate() error {
+	roles := map[string]bool{}
+	for _, role := range p.Roles {
+		if role.Name == "" {
+			return errors.New("role name is required")
+		}
+		for _, permission := range role.Permissions {
+			if err := validateScopes(permission.Scopes); err != nil {
+				return fmt.Errorf("role %v: %w", role.Name, err)
+			}
+		}
+		roles[role.Name] = true
+	}
+	for _, binding := range p.Bindings {
+		if !roles[binding.Role] {
+			return fmt.Errorf("binding references unknown role %q", binding.Role)
+		}
+	}
+	return nil
+}
+
+// Allowed reports whether the principal may use scope on devices of the given brand.
+// Admins are not subject to the policy.
+func (p Policy) Allowed(principal Principal, scope string, brand string) bool {
+	if principal.HasScope(ScopeAdmin) {
+		return true
+	}
+	for _, binding := range p.Bindings {
+		if !binding.appliesTo(principal) {
+			continue
+		}
+		for _, role := range p.Roles {
+			if role.Name == binding.Role && role.allows(scope, brand) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (b RoleBinding) appliesTo(principal Principal) bool {
+	for _, user := range b.Users {
+		if user == principal.Subject {
+			return true
+		}
+	}
+	for _, group := range b.Groups {
+		for _, g := range principal.Groups {
+			if group == g {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (r Role) allows(scope string, brand string) bool {
+	for _, permission := range r.Permissions {
+		if !contains(permission.Scopes, scope) {
+			continue
+		}
+		if len(permission.Brands) == 0 || contains(permission.Brands, brand) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthorizedRepository enforces the policy for the principal found in the context. Devices the
+// principal may not read are reported as not found; devices it can read but not change return
+// ErrForbidden. Changes are checked in the transaction that makes them, so the brand cannot change in between.
+type AuthorizedRepository struct {
+	next   Repository
+	policy Policy
+}
+
+func NewAuthorizedRepository(next Repository, policy Policy) AuthorizedRepository {
+	return AuthorizedRepository{next: next, policy: policy}
+}
+
+func (r AuthorizedRepository) allowed(ctx context.Context, scope string, brand string) bool {
+	principal, ok := principalFromContext(ctx)
+	return ok && r.policy.Allowed(principal, scope, brand)
+}
+
+// findVisible loads a device, hiding it when the principal cannot read its brand
+func (r AuthorizedRepository) findVisible(ctx context.Context, id int) (Device, error) {
+	device, err := r.next.FindDeviceByID(ctx, id)
+	if err != nil {
+		return Device{}, err
+	}
+	if !r.allowed(ctx, ScopeDevicesRead, device.Brand) {
+		return Device{}, sql.ErrNoRows
+	}
+	return device, nil
+}
+
+func (r AuthorizedRepository) filter(ctx context.Context, devices []Device) []Device {
+	var visible []Device
+	for _, device := range devices {
+		if r.allowed(ctx, ScopeDevicesRead, device.Brand) {
+			visible = append(visible, device)
+		}
+	}
+	return visible
+}
+
+func (r AuthorizedRepository) SaveDevice(ctx context.Context, device Device) (Device, error) {
+	if !r.allowed(ctx, ScopeDevicesWrite, device.Brand) {
+		return Device{}, ErrForbidden
+	}
+	return r.next.SaveDevice(ctx, device)
+}
+
+func (r AuthorizedRepository) FindDeviceByID(ctx context.Context, id int) (Device, error) {
+	return r.findVisible(ctx, id)
+}
+
+func (r AuthorizedRepository) FindDeviceByPublicID(ctx context.Context, publicID string) (Device, error) {
+	device, err := r.next.FindDeviceByPublicID(ctx, publicID)
+	if err != nil {
+		return Device{}, err
+	}
+	if !r.allowed(ctx, ScopeDevicesRead, device.Brand) {
+		return Device{}, sql.ErrNoRows
+	}
+	return device, nil
+}
+
+// FindDevicesByBrand checks the brands of the devices found, not the one asked for: the database matches
+// brands case insensitively while the policy does not
+func (r AuthorizedRepository) FindDevicesByBrand(ctx context.Context, brand string) ([]Device, error) {
+	devices, err := r.next.FindDevicesByBrand(ctx, brand)
+	if err != nil {
+		return nil, err
+	}
+	return r.filter(ctx, devices), nil
+}
+
+func (r AuthorizedRepository) FindAllDevices(ctx context.Context) ([]Device, error) {
+	devices, err := r.next.FindAllDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return r.filter(ctx, devices), nil
+}
+
+func (r AuthorizedRepository) UpdateDevice(ctx context.Context, device Device) (Device, error) {
+	var updated Device
+	err := r.next.WithTx(ctx, TxOptions{}, func(tx Repository) error {
+		current, err := r.in(tx).findVisible(ctx, device.ID)
+		if err != nil {
+			return err
+		}
+		// moving a device to another brand needs write access to both brands
+		if !r.allowed(ctx, ScopeDevicesWrite, current.Brand) || !r.allowed(ctx, ScopeDevicesWrite, device.Brand) {
+			return ErrForbidden
+		}
+		updated, err = tx.UpdateDevice(ctx, device)
+		return err
+	})
+	return updated, err
+}
+
+func (r AuthorizedRepository) DeleteDevice(ctx context.Context, id int) error {
+	return r.next.WithTx(ctx, TxOptions{}, func(tx Repository) error {
+		current, err := r.in(tx).findVisible(ctx, id)
+		if err != nil {
+			return err
+		}
+		if !r.allowed(ctx, ScopeDevicesDelete, current.Brand) {
+			return ErrForbidden
+		}
+		return tx.DeleteDevice(ctx, id)
+	})
+}
+
+// CheckoutDevice and CheckinDevice need write access to the brand of the device
+func (r AuthorizedRepository) CheckoutDevice(ctx context.Context, id int, assigneeID int, due time.Time) (Device, error) {
+	var device Device
+	err := r.next.WithTx(ctx, TxOptions{}, func(tx Repository) error {
+		if err := r.in(tx).checkWritable(ctx, id); err != nil {
+			return err
+		}
+		var err error
+		device, err = tx.CheckoutDevice(ctx, id, assigneeID, due)
+		return err
+	})
+	return device, err
+}
+
+func (r AuthorizedRepository) CheckinDevice(ctx context.Context, id int) (Device, error) {
+	var device Device
+	err := r.next.WithTx(ctx, TxOptions{}, func(tx Repository) error {
+		if err := r.in(tx).checkWritable(ctx, id); err != nil {
+			return err
+		}
+		var err error
+		device, err = tx.CheckinDevice(ctx, id)
+		return err
+	})
+	return device, err
+}
+
+func (r AuthorizedRepository) checkWritable(ctx context.Context, id int) error {
+	current, err := r.findVisible(ctx, id)
+	if err != nil {
+		return err
+	}
+	if !r.allowed(ctx, ScopeDevicesWrite, current.Brand) {
+		return ErrForbidden
+	}
+	return nil
+}
+
+func (r AuthorizedRepository) FindDevicesByAssignee(ctx context.Context, assigneeID int) ([]Device, error) {
+	devices, err := r.next.FindDevicesByAssignee(ctx, assigneeID)
+	if err != nil {
+		return nil, err
+	}
+	return r.filter(ctx, devices), nil
+}
+
+func (r AuthorizedRepository) FindOverdueDevices(ctx context.Context, now time.Time) ([]Device, error) {
+	devices, err := r.next.FindOverdueDevices(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	return r.filter(ctx, devices), nil
+}
+
+func (r AuthorizedRepository) WithTx(ctx context.Context, opts TxOptions, fn func(tx Repository) error) error {
+	return r.next.WithTx(ctx, opts, func(tx Repository) error {
+		return fn(r.in(tx))
+	})
+}
+
+// in returns the repository enforcing the same policy on the unit of work tx
+func (r AuthorizedRepository) in(tx Repository) AuthorizedRepository {
+	return AuthorizedRepository{next: tx, policy: r.policy}
+}
+
+func (r AuthorizedRepository) DeleteAllDevices() {
+	r.next.DeleteAllDevices()
+}
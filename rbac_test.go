@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var testPolicy = Policy{
+	Roles: []Role{
+		{Name: "acme-maintainer", Permissions: []Permission{
+			{Scopes: []string{ScopeDevicesRead, ScopeDevicesWrite}, Brands: []string{"Acme"}},
+		}},
+		{Name: "globex-viewer", Permissions: []Permission{
+			{Scopes: []string{ScopeDevicesRead}, Brands: []string{"Globex"}},
+		}},
+		{Name: "acme-cleaner", Permissions: []Permission{
+			{Scopes: []string{ScopeDevicesRead, ScopeDevicesDelete}, Brands: []string{"Acme"}},
+		}},
+		// brands of policies are case sensitive, the database compares them case insensitively
+		{Name: "lowercase-initech-viewer", Permissions: []Permission{
+			{Scopes: []string{ScopeDevicesRead}, Brands: []string{"initech"}},
+		}},
+	},
+	Bindings: []RoleBinding{
+		{Role: "acme-maintainer", Groups: []string{"team-acme"}},
+		{Role: "globex-viewer", Users: []string{"alice"}},
+		{Role: "acme-cleaner", Users: []string{"bob"}},
+		{Role: "lowercase-initech-viewer", Users: []string{"carol"}},
+	},
+}
+
+var alice = Principal{Subject: "alice", Groups: []string{"team-acme"}}
+
+// rbacRequest runs a device request as principal against a policy enforcing repository
+func rbacRequest(t *testing.T, principal Principal, method string, url string, body any, handler http.HandlerFunc) *httptest.ResponseRecorder {
+	t.Helper()
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req = req.WithContext(withPrincipal(req.Context(), principal))
+	defer func(unrestricted Repository) { repository = unrestricted }(repository)
+	repository = NewAuthorizedRepository(repository, testPolicy)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	return rr
+}
+
+func Test_Policy(t *testing.T) {
+	t.Run("should allow scopes through user and group bindings", func(t *testing.T) {
+		cases := []struct {
+			principal Principal
+			scope     string
+			brand     string
+			allowed   bool
+		}{
+			{alice, ScopeDevicesWrite, "Acme", true},
+			{alice, ScopeDevicesRead, "Globex", true},
+			{alice, ScopeDevicesWrite, "Globex", false},
+			{alice, ScopeDevicesDelete, "Acme", false},
+			{alice, ScopeDevicesRead, "Initech", false},
+			{Principal{Subject: "bob"}, ScopeDevicesDelete, "Acme", true},
+			{Principal{Subject: "mallory", Groups: []string{"team-globex"}}, ScopeDevicesRead, "Acme", false},
+			{Principal{Subject: "root", Scopes: []string{ScopeAdmin}}, ScopeDevicesDelete, "Initech", true},
+		}
+		for _, c := range cases {
+			if testPolicy.Allowed(c.principal, c.scope, c.brand) != c.allowed {
+				t.Errorf("expected %v %v on %v allowed to be %v", c.principal.Subject, c.scope, c.brand, c.allowed)
+			}
+		}
+	})
+
+	t.Run("should reject bindings to unknown roles", func(t *testing.T) {
+		policy := Policy{Bindings: []RoleBinding{{Role: "ghost", Users: []string{"alice"}}}}
+		if policy.Validate() == nil {
+			t.Error("expected policy to be invalid")
+		}
+	})
+}
+
+func Test_AuthorizedRepository(t *testing.T) {
+	acme, err := repository.SaveDevice(context.Background(), Device{Name: "RBAC Device", Brand: "Acme"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	globex, err := repository.SaveDevice(context.Background(), Device{Name: "RBAC Device", Brand: "Globex"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	initech, err := repository.SaveDevice(context.Background(), Device{Name: "RBAC Device", Brand: "Initech"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should filter listed devices by brand permissions", func(t *testing.T) {
+		rr := rbacRequest(t, alice, "GET", "/devices", nil, CrudDevicesHandler)
+		var devices []Device
+		err := json.Unmarshal(rr.Body.Bytes(), &devices)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 2 {
+			t.Errorf("expected 2 devices, got %v", devices)
+		}
+		for _, device := range devices {
+			if device.ID == initech.ID {
+				t.Errorf("expected out of scope device to be hidden, got %v", device)
+			}
+		}
+
+		rr = rbacRequest(t, alice, "GET", "/devices?brand=Initech", nil, CrudDevicesHandler)
+		err = json.Unmarshal(rr.Body.Bytes(), &devices)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 0 {
+			t.Errorf("expected no devices, got %v", devices)
+		}
+
+		// the brand filter matches Initech, which the policy does not grant
+		rr = rbacRequest(t, Principal{Subject: "carol"}, "GET", "/devices?brand=initech", nil, CrudDevicesHandler)
+		devices = nil
+		err = json.Unmarshal(rr.Body.Bytes(), &devices)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 0 {
+			t.Errorf("expected devices of a brand differing in case to be hidden, got %v", devices)
+		}
+	})
+
+	t.Run("should return 404 for devices outside every permitted brand", func(t *testing.T) {
+		for _, method := range []string{"GET", "PUT", "DELETE"} {
+			rr := rbacRequest(t, alice, method, "/device/"+initech.PublicID, Device{Name: "x", Brand: "Acme"}, CrudDeviceHandler)
+			if rr.Code != http.StatusNotFound {
+				t.Errorf("expected status code %d for %v, got %d", http.StatusNotFound, method, rr.Code)
+			}
+		}
+	})
+
+	t.Run("should return 403 for visible devices without the needed permission", func(t *testing.T) {
+		rr := rbacRequest(t, alice, "PUT", "/device/"+globex.PublicID, Device{Name: "Renamed", Brand: "Globex"}, CrudDeviceHandler)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		rr = rbacRequest(t, alice, "PUT", "/device/"+acme.PublicID, Device{Name: "Moved", Brand: "Globex"}, CrudDeviceHandler)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d moving brands, got %d", http.StatusForbidden, rr.Code)
+		}
+		rr = rbacRequest(t, alice, "DELETE", "/device/"+acme.PublicID, nil, CrudDeviceHandler)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		rr = rbacRequest(t, alice, "POST", "/device/", Device{Name: "New", Brand: "Globex"}, CrudDeviceHandler)
+		if rr.Code != http.StatusForbidden {
+			t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+		}
+		device, err := repository.FindDeviceByID(context.Background(), globex.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if device.Name != globex.Name {
+			t.Errorf("expected device to be unchanged, got %v", device)
+		}
+	})
+
+	t.Run("should allow permitted changes", func(t *testing.T) {
+		rr := rbacRequest(t, alice, "PUT", "/device/"+acme.PublicID, Device{Name: "Renamed RBAC Device", Brand: "Acme"}, CrudDeviceHandler)
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		rr = rbacRequest(t, Principal{Subject: "bob"}, "DELETE", "/device/"+acme.PublicID, nil, CrudDeviceHandler)
+		if rr.Code != http.StatusNoContent {
+			t.Errorf("expected status code %d, got %d", http.StatusNoContent, rr.Code)
+		}
+	})
+	repository.DeleteAllDevices()
+}
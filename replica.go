@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	repositoryReads = newCounterVec("repository_reads_total",
+		"Repository reads by the database that served them, primary or replica.", "target")
+	replicaFailovers = newCounterVec("db_replica_failovers_total",
+		"Reads retried on the primary because a replica failed, by replica.", "replica")
+)
+
+// replica is a read only copy of the primary, healthy while it answers pings and keeps up with it
+type replica struct {
+	name    string
+	db      *sql.DB
+	healthy atomic.Bool
+}
+
+// ReplicaSet spreads reads over the healthy replicas of the primary round robin
+type ReplicaSet struct {
+	replicas []*replica
+	next     atomic.Uint64
+	interval time.Duration
+	// maxLag is how far behind the primary a replica may be and still take reads, nil lag skips the check
+	maxLag time.Duration
+	lag    func(ctx context.Context, db *sql.DB) (time.Duration, error)
+}
+
+// readYourWritesConfig reads READ_YOUR_WRITES_WINDOW, how long a client reads from the primary after a write.
+// Replicas lagging further behind are taken out of rotation, the window would not cover their lag.
+func readYourWritesConfig() (time.Duration, error) {
+	window, err := time.ParseDuration(getEnv("READ_YOUR_WRITES_WINDOW", "5s"))
+	if err != nil || window < 0 {
+		return 0, fmt.Errorf("invalid READ_YOUR_WRITES_WINDOW %q", os.Getenv("READ_YOUR_WRITES_WINDOW"))
+	}
+	return window, nil
+}
+
+// openReplicas opens DATABASE_REPLICA_URLS, a comma separated list of DSNs of the primary's dialect.
+// Without replicas it returns nil and every read goes to the primary.
+func openReplicas(dialect Dialect) (*ReplicaSet, error) {
+	urls := os.Getenv("DATABASE_REPLICA_URLS")
+	if urls == "" {
+		return nil, nil
+	}
+	if dialect == SQLite {
+		return nil, errors.New("SQLite has no replicas, unset DATABASE_REPLICA_URLS")
+	}
+	interval, err := time.ParseDuration(getEnv("REPLICA_HEALTH_INTERVAL", "5s"))
+	if err != nil || interval <= 0 {
+		return nil, fmt.Errorf("invalid REPLICA_HEALTH_INTERVAL %q", os.Getenv("REPLICA_HEALTH_INTERVAL"))
+	}
+	window, err := readYourWritesConfig()
+	if err != nil {
+		return nil, err
+	}
+	set := &ReplicaSet{interval: interval, maxLag: window, lag: dialect.replicationLag}
+	for i, dsn := range strings.Split(urls, ",") {
+		db, replicaDialect, err := openDB(strings.TrimSpace(dsn))
+		if err != nil {
+			return nil, err
+		}
+		if replicaDialect != dialect {
+			return nil, fmt.Errorf("replica %d is %v, the primary %v", i, replicaDialect.name(), dialect.name())
+		}
+		configurePool(db)
+		set.replicas = append(set.replicas, &replica{name: strconv.Itoa(i), db: db})
+	}
+	return set, nil
+}
+
+// pick returns the next healthy replica, nil when there is none
+func (rs *ReplicaSet) pick() *replica {
+	if rs == nil {
+		return nil
+	}
+	n := uint64(len(rs.replicas))
+	start := rs.next.Add(1)
+	for i := uint64(0); i < n; i++ {
+		if r := rs.replicas[(start+i)%n]; r.healthy.Load() {
+			return r
+		}
+	}
+	return nil
+}
+
+// Run checks the replicas right away and then every interval until ctx is cancelled. Replicas take
+// reads once they answered a ping and their replication lag is within maxLag.
+func (rs *ReplicaSet) Run(ctx context.Context) {
+	ticker := time.NewTicker(rs.interval)
+	defer ticker.Stop()
+	for {
+		for _, r := range rs.replicas {
+			rs.check(ctx, r)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (rs *ReplicaSet) check(ctx context.Context, r *replica) {
+	pingCtx, cancel := context.WithTimeout(ctx, 2*time.Second)
+	defer cancel()
+	err := r.db.PingContext(pingCtx)
+	if err == nil && rs.lag != nil {
+		var lag time.Duration
+		lag, err = rs.lag(pingCtx, r.db)
+		if err == nil && lag > rs.maxLag {
+			err = fmt.Errorf("replication lag %v exceeds %v", lag, rs.maxLag)
+		}
+	}
+	if ctx.Err() != nil {
+		return
+	}
+	if err != nil {
+		r.fail(ctx, err)
+		return
+	}
+	if !r.healthy.Swap(true) {
+		slog.InfoContext(ctx, "Replica is healthy", "replica", r.name)
+	}
+}
+
+// fail takes the replica out of rotation until the next successful check
+func (r *replica) fail(ctx context.Context, err error) {
+	if r.healthy.Swap(false) {
+		slog.WarnContext(ctx, "Replica is unhealthy", "replica", r.name, "error", err)
+	}
+}
+
+func (rs *ReplicaSet) Close() error {
+	var errs []error
+	for _, r := range rs.replicas {
+		errs = append(errs, r.db.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// replicationLag reports how far the replica db is behind its primary. MySQL reads Seconds_Behind_Source
+// of SHOW REPLICA STATUS, PostgreSQL the age of the last replayed transaction unless all WAL received is
+// replayed. A server that is not replicating has no lag, one whose replication stopped is an error.
+func (d Dialect) replicationLag(ctx context.Context, db *sql.DB) (time.Duration, error) {
+	if d == Postgres {
+		var seconds float64
+		query := "SELECT CASE WHEN NOT pg_is_in_recovery() OR pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0 " +
+			"ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0) END"
+		err := db.QueryRowContext(ctx, query).Scan(&seconds)
+		return time.Duration(seconds * float64(time.Second)), err
+	}
+	rows, err := db.QueryContext(ctx, "SHOW REPLICA STATUS")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil || !rows.Next() {
+		return 0, errors.Join(err, rows.Err())
+	}
+	values := make([]sql.NullString, len(columns))
+	dest := make([]any, len(columns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	if err := rows.Scan(dest...); err != nil {
+		return 0, err
+	}
+	for i, column := range columns {
+		// MySQL before 8.0.22 calls the column Seconds_Behind_Master
+		if column != "Seconds_Behind_Source" && column != "Seconds_Behind_Master" {
+			continue
+		}
+		if !values[i].Valid {
+			return 0, errors.New("replication is not running")
+		}
+		seconds, err := strconv.Atoi(values[i].String)
+		return time.Duration(seconds) * time.Second, err
+	}
+	return 0, errors.New("SHOW REPLICA STATUS has no Seconds_Behind_Source")
+}
+
+// isConnectionError reports whether err means the database could not be reached rather than that the query failed
+func isConnectionError(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, driver.ErrBadConn) || errors.Is(err, mysql.ErrInvalidConn) || errors.As(err, &netErr)
+}
+
+type primaryKey struct{}
+
+// withPrimaryReads makes the reads of ctx go to the primary, for data that must not lag behind
+func withPrimaryReads(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+func primaryReads(ctx context.Context) bool {
+	primary, _ := ctx.Value(primaryKey{}).(bool)
+	return primary
+}
+
+// readYourWritesCookie holds the time in unix milliseconds until which the client reads from the primary
+const readYourWritesCookie = "read_your_writes"
+
+// readYourWrites sends the reads of a client to the primary for window after each of its writes, so it sees
+// them even while the replicas lag. Writes read from the primary themselves. Cookies further out than
+// window are ignored, a client cannot pin itself to the primary.
+func readYourWrites(window time.Duration, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			until := now.Add(window)
+			http.SetCookie(w, &http.Cookie{
+				Name:     readYourWritesCookie,
+				Value:    strconv.FormatInt(until.UnixMilli(), 10),
+				Path:     "/",
+				Expires:  until,
+				HttpOnly: true,
+				SameSite: http.SameSiteLaxMode,
+			})
+			next(w, r.WithContext(withPrimaryReads(r.Context())))
+			return
+		}
+		if cookie, err := r.Cookie(readYourWritesCookie); err == nil {
+			millis, err := strconv.ParseInt(cookie.Value, 10, 64)
+			until := time.UnixMilli(millis)
+			if err == nil && now.Before(until) && !until.After(now.Add(window)) {
+				r = r.WithContext(withPrimaryReads(r.Context()))
+			}
+		}
+		next(w, r)
+	}
+}
@@ -1,54 +1,275 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 )
 
+// Repository is scoped to the tenant found in the context of each call, see tenantFromContext. Lists are
+// ordered by creation, missing devices are reported as sql.ErrNoRows. repository_contract_test.go checks
+// every implementation against these semantics.
 type Repository interface {
-	SaveDevice(device Device) (Device, error)
-	FindDeviceByID(id int) (Device, error)
-	FindDevicesByBrand(brand string) ([]Device, error)
-	FindAllDevices() ([]Device, error)
-	UpdateDevice(device Device) (Device, error)
-	DeleteDevice(id int) error
+	SaveDevice(ctx context.Context, device Device) (Device, error)
+	FindDeviceByID(ctx context.Context, id int) (Device, error)
+	FindDeviceByPublicID(ctx context.Context, publicID string) (Device, error)
+	FindDevicesByBrand(ctx context.Context, brand string) ([]Device, error)
+	FindAllDevices(ctx context.Context) ([]Device, error)
+	UpdateDevice(ctx context.Context, device Device) (Device, error)
+	// DeleteDevice removes the device, ErrDeviceCheckedOut while it is on loan
+	DeleteDevice(ctx context.Context, id int) error
+	// CheckoutDevice loans the device to the assignee until due, ErrDeviceCheckedOut when it is on loan already
+	CheckoutDevice(ctx context.Context, id int, assigneeID int, due time.Time) (Device, error)
+	// CheckinDevice ends the loan of the device, ErrDeviceNotCheckedOut when there is none
+	CheckinDevice(ctx context.Context, id int) (Device, error)
+	FindDevicesByAssignee(ctx context.Context, assigneeID int) ([]Device, error)
+	// FindOverdueDevices lists the devices on loan whose due time is before now
+	FindOverdueDevices(ctx context.Context, now time.Time) ([]Device, error)
+	// WithTx runs fn as one unit of work: the calls on tx are committed together when fn returns nil and
+	// rolled back otherwise. Devices read through tx stay locked until the end, a call that fails is undone
+	// on its own. On a deadlock or serialization failure fn is run again, so it must not have other effects.
+	WithTx(ctx context.Context, opts TxOptions, fn func(tx Repository) error) error
 	DeleteAllDevices()
 }
+
+// TxOptions configure a unit of work, the zero value uses the isolation level of the database
+// and up to defaultTxAttempts attempts
+type TxOptions struct {
+	Isolation   sql.IsolationLevel
+	MaxAttempts int
+}
+
+const defaultTxAttempts = 3
+
 type RepositoryImpl struct {
-	db *sql.DB
+	db      *sql.DB
+	dialect Dialect
+	// replicas serve the reads when set, see read
+	replicas *ReplicaSet
+	// tx is the transaction of the unit of work the repository belongs to, see WithTx
+	tx *sql.Tx
+}
+
+// querier is satisfied by both *sql.DB and *sql.Tx
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+}
+
+const deviceColumns = "id, public_id, name, brand, creation_time"
+
+// q returns the pool with every statement bound for the dialect and traced
+func (r RepositoryImpl) q() querier {
+	if r.tx != nil {
+		return r.wrap(r.tx)
+	}
+	return r.wrap(r.db)
+}
+
+func (r RepositoryImpl) wrap(q querier) querier {
+	return tracedQuerier{q: boundQuerier{q: q, dialect: r.dialect}, dialect: r.dialect}
+}
+
+// read runs fn on a healthy replica. It falls back to the primary when there is none, when the replica
+// cannot be reached or when ctx asks for primary reads.
+func (r RepositoryImpl) read(ctx context.Context, fn func(q querier) error) error {
+	if r.tx == nil && !primaryReads(ctx) {
+		if replica := r.replicas.pick(); replica != nil {
+			err := fn(r.wrap(replica.db))
+			if !isConnectionError(err) {
+				repositoryReads.WithLabelValues("replica").Inc()
+				return err
+			}
+			replica.fail(ctx, err)
+			replicaFailovers.WithLabelValues(replica.name).Inc()
+		}
+	}
+	repositoryReads.WithLabelValues("primary").Inc()
+	return fn(r.q())
+}
+
+// inTx runs fn in a transaction, committing if it returns nil and rolling back otherwise. Within a unit
+// of work fn runs in a savepoint of its transaction.
+func (r RepositoryImpl) inTx(ctx context.Context, fn func(tx querier) error) error {
+	if r.tx != nil {
+		return r.savepoint(ctx, func() error { return fn(r.q()) })
+	}
+	return r.runTx(ctx, TxOptions{}, func(tx RepositoryImpl) error { return fn(tx.q()) })
+}
+
+// WithTx nested in a unit of work runs fn in a savepoint, opts are those of the outer unit
+func (r RepositoryImpl) WithTx(ctx context.Context, opts TxOptions, fn func(tx Repository) error) error {
+	if r.tx != nil {
+		return r.savepoint(ctx, func() error { return fn(r) })
+	}
+	return r.runTx(ctx, opts, func(tx RepositoryImpl) error { return fn(tx) })
+}
+
+// runTx runs fn in a new transaction and runs it again while it fails with a deadlock or serialization failure
+func (r RepositoryImpl) runTx(ctx context.Context, opts TxOptions, fn func(tx RepositoryImpl) error) error {
+	attempts := opts.MaxAttempts
+	if attempts <= 0 {
+		attempts = defaultTxAttempts
+	}
+	for attempt := 1; ; attempt++ {
+		err := r.attemptTx(ctx, opts, fn)
+		if err == nil || attempt >= attempts || !r.dialect.isRetryable(err) {
+			return err
+		}
+		transactionRetries.Inc()
+		backoff := time.Duration(attempt)*10*time.Millisecond + time.Duration(rand.Int63n(int64(10*time.Millisecond)))
+		slog.DebugContext(ctx, "Retrying transaction", "attempt", attempt, "backoff", backoff, "error", err)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+func (r RepositoryImpl) attemptTx(ctx context.Context, opts TxOptions, fn func(tx RepositoryImpl) error) error {
+	tx, err := r.db.BeginTx(ctx, &sql.TxOptions{Isolation: opts.Isolation})
+	if err != nil {
+		return err
+	}
+	r.tx = tx
+	if err := fn(r); err != nil {
+		slog.DebugContext(ctx, "Rolling back transaction", "error", err)
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+var savepoints atomic.Int64
+
+// savepoint runs fn so that when it fails only its own statements are undone, PostgreSQL would otherwise
+// refuse every further statement of the transaction
+func (r RepositoryImpl) savepoint(ctx context.Context, fn func() error) error {
+	name := "sp_" + strconv.FormatInt(savepoints.Add(1), 10)
+	if _, err := r.q().ExecContext(ctx, "SAVEPOINT "+name); err != nil {
+		return err
+	}
+	if err := fn(); err != nil {
+		// after a deadlock MySQL has rolled back the whole transaction and the savepoint with it
+		r.q().ExecContext(ctx, "ROLLBACK TO SAVEPOINT "+name)
+		return err
+	}
+	_, err := r.q().ExecContext(ctx, "RELEASE SAVEPOINT "+name)
+	return err
 }
 
-func (r RepositoryImpl) FindDeviceByID(id int) (Device, error) {
-	query := "SELECT * FROM devices WHERE id = ?"
-	row := r.db.QueryRow(query, id)
+func scanDevice(row rowScanner) (Device, error) {
 	var device Device
-	err := row.Scan(&device.ID, &device.Name, &device.Brand, &device.CreationTime)
+	var publicID sql.NullString
+	err := row.Scan(&device.ID, &publicID, &device.Name, &device.Brand, &device.CreationTime)
 	if err != nil {
 		return Device{}, err
 	}
+	device.PublicID = publicID.String
 	return device, nil
 }
 
-func (r RepositoryImpl) SaveDevice(device Device) (Device, error) {
-	query := "INSERT INTO devices (name, brand, creation_time) VALUES (?, ?, NOW())"
-	result, err := r.db.Exec(query, device.Name, device.Brand)
+// findDevice reads a device and its holder, with lock the device row stays locked until the transaction of q ends
+func findDevice(ctx context.Context, q querier, query string, lock bool, args ...any) (Device, error) {
+	if lock {
+		query += " FOR UPDATE"
+	}
+	device, err := scanDevice(q.QueryRowContext(ctx, query, args...))
 	if err != nil {
 		return Device{}, err
 	}
-	deviceID, err := result.LastInsertId()
+	holders, err := findHolders(ctx, q, " AND a.device_id = ?", device.ID)
 	if err != nil {
 		return Device{}, err
 	}
-	device, err = r.FindDeviceByID(int(deviceID))
+	device.Holder = holders[device.ID]
+	return device, nil
+}
+
+func findDeviceByID(ctx context.Context, q querier, id int, lock bool) (Device, error) {
+	query := "SELECT " + deviceColumns + " FROM devices WHERE id = ? AND tenant_id = ?"
+	return findDevice(ctx, q, query, lock, id, tenantFromContext(ctx))
+}
+
+func (r RepositoryImpl) FindDeviceByID(ctx context.Context, id int) (Device, error) {
+	var device Device
+	err := r.read(ctx, func(q querier) (err error) {
+		device, err = findDeviceByID(ctx, q, id, r.tx != nil)
+		return err
+	})
+	return device, err
+}
+
+func (r RepositoryImpl) FindDeviceByPublicID(ctx context.Context, publicID string) (Device, error) {
+	query := "SELECT " + deviceColumns + " FROM devices WHERE public_id = ? AND tenant_id = ?"
+	var device Device
+	err := r.read(ctx, func(q querier) (err error) {
+		device, err = findDevice(ctx, q, query, r.tx != nil, publicID, tenantFromContext(ctx))
+		return err
+	})
+	return device, err
+}
+
+func (r RepositoryImpl) SaveDevice(ctx context.Context, device Device) (Device, error) {
+	tenant := tenantFromContext(ctx)
+	err := r.inTx(ctx, func(tx querier) error {
+		if err := checkQuota(ctx, tx, tenant); err != nil {
+			return err
+		}
+		query := "INSERT INTO devices (tenant_id, public_id, name, brand, creation_time) VALUES (?, ?, ?, ?, NOW())"
+		deviceID, err := r.dialect.insertID(ctx, tx, query, tenant, newULID(time.Now()), device.Name, device.Brand)
+		if r.dialect.isUniqueViolation(err) {
+			return ErrDeviceExists
+		}
+		if err != nil {
+			return err
+		}
+		device, err = findDeviceByID(ctx, tx, int(deviceID), false)
+		if err != nil {
+			return err
+		}
+		return insertOutboxEvent(ctx, tx, EventDeviceCreated, device)
+	})
 	if err != nil {
 		return Device{}, err
 	}
+	slog.DebugContext(ctx, "Device saved", "device_id", device.ID, "tenant", tenant)
 	return device, nil
 }
 
-func (r RepositoryImpl) FindDevicesByBrand(brand string) ([]Device, error) {
-	query := "SELECT * FROM devices WHERE brand = ?"
-	rows, err := r.db.Query(query, brand)
+func (r RepositoryImpl) FindDevicesByBrand(ctx context.Context, brand string) ([]Device, error) {
+	query := "SELECT " + deviceColumns + " FROM devices WHERE brand = ? AND tenant_id = ? ORDER BY id"
+	return r.queryDevices(ctx, query, brand, tenantFromContext(ctx))
+}
+
+func (r RepositoryImpl) FindAllDevices(ctx context.Context) ([]Device, error) {
+	query := "SELECT " + deviceColumns + " FROM devices WHERE tenant_id = ? ORDER BY id"
+	return r.queryDevices(ctx, query, tenantFromContext(ctx))
+}
+
+func (r RepositoryImpl) queryDevices(ctx context.Context, query string, args ...any) ([]Device, error) {
+	var devices []Device
+	err := r.read(ctx, func(q querier) (err error) {
+		devices, err = queryDevices(ctx, q, query, args...)
+		return err
+	})
+	return devices, err
+}
+
+// holderBatchSize is the number of devices whose holders are read by one query
+const holderBatchSize = 500
+
+func queryDevices(ctx context.Context, q querier, query string, args ...any) ([]Device, error) {
+	rows, err := q.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -56,63 +277,169 @@ func (r RepositoryImpl) FindDevicesByBrand(brand string) ([]Device, error) {
 
 	var devices []Device
 	for rows.Next() {
-		var device Device
-		err := rows.Scan(&device.ID, &device.Name, &device.Brand, &device.CreationTime)
+		device, err := scanDevice(rows)
 		if err != nil {
 			return nil, err
 		}
 		devices = append(devices, device)
 	}
-	return devices, nil
-}
-
-func (r RepositoryImpl) FindAllDevices() ([]Device, error) {
-	query := "SELECT * FROM devices"
-	rows, err := r.db.Query(query)
-	if err != nil {
-		return nil, err
+	if err := rows.Err(); err != nil || len(devices) == 0 {
+		return devices, err
 	}
-	defer rows.Close()
-
-	var devices []Device
-	for rows.Next() {
-		var device Device
-		err := rows.Scan(&device.ID, &device.Name, &device.Brand, &device.CreationTime)
+	rows.Close()
+	// the holders are read in batches, one bind parameter per device would exceed the limits of the databases
+	// for large tenants
+	for start := 0; start < len(devices); start += holderBatchSize {
+		batch := devices[start:min(start+holderBatchSize, len(devices))]
+		ids := make([]any, len(batch))
+		for i, device := range batch {
+			ids[i] = device.ID
+		}
+		holders, err := findHolders(ctx, q, " AND a.device_id IN (?"+strings.Repeat(", ?", len(ids)-1)+")", ids...)
 		if err != nil {
 			return nil, err
 		}
-		devices = append(devices, device)
+		for i := range batch {
+			batch[i].Holder = holders[batch[i].ID]
+		}
 	}
 	return devices, nil
 }
 
-func (r RepositoryImpl) UpdateDevice(device Device) (Device, error) {
-	query := "UPDATE devices SET name = ?, brand = ? WHERE id = ?"
-	_, err := r.db.Exec(query, device.Name, device.Brand, device.ID)
+// ErrDeviceExists is returned by SaveDevice when the tenant already has a device with the name and brand
+var ErrDeviceExists = errors.New("device already exists")
+
+// DeviceConflictError is returned when another device of the tenant already has the name and brand
+type DeviceConflictError struct {
+	PublicID string
+}
+
+func (e *DeviceConflictError) Error() string {
+	return fmt.Sprintf("device with id %v has the same name and brand", e.PublicID)
+}
+
+func (r RepositoryImpl) UpdateDevice(ctx context.Context, device Device) (Device, error) {
+	err := r.inTx(ctx, func(tx querier) error {
+		// make sure the device belongs to the tenant before touching it
+		_, err := findDeviceByID(ctx, tx, device.ID, true)
+		if err != nil {
+			return err
+		}
+		query := "UPDATE devices SET name = ?, brand = ? WHERE id = ? AND tenant_id = ?"
+		_, err = tx.ExecContext(ctx, query, device.Name, device.Brand, device.ID, tenantFromContext(ctx))
+		if err != nil {
+			return err
+		}
+		return insertOutboxEvent(ctx, tx, EventDeviceUpdated, device)
+	})
+	if r.dialect.isUniqueViolation(err) {
+		var conflictID sql.NullString
+		query := "SELECT public_id FROM devices WHERE tenant_id = ? AND name = ? AND brand = ?"
+		lookupErr := r.q().QueryRowContext(ctx, query, tenantFromContext(ctx), device.Name, device.Brand).Scan(&conflictID)
+		if lookupErr != nil {
+			return Device{}, err
+		}
+		return Device{}, &DeviceConflictError{PublicID: conflictID.String}
+	}
 	if err != nil {
 		return Device{}, err
 	}
+	slog.DebugContext(ctx, "Device updated", "device_id", device.ID, "tenant", tenantFromContext(ctx))
 	return device, nil
 }
 
-func (r RepositoryImpl) DeleteDevice(id int) error {
-	_, err := r.FindDeviceByID(id)
-	if err != nil {
-		return err
-	}
-	query := "DELETE FROM devices WHERE id = ?"
-	_, err = r.db.Exec(query, id)
+func (r RepositoryImpl) DeleteDevice(ctx context.Context, id int) error {
+	err := r.inTx(ctx, func(tx querier) error {
+		device, err := findDeviceByID(ctx, tx, id, true)
+		if err != nil {
+			return err
+		}
+		if device.Holder != nil {
+			return ErrDeviceCheckedOut
+		}
+		query := "DELETE FROM devices WHERE id = ? AND tenant_id = ?"
+		_, err = tx.ExecContext(ctx, query, id, tenantFromContext(ctx))
+		if err != nil {
+			return err
+		}
+		return insertOutboxEvent(ctx, tx, EventDeviceDeleted, device)
+	})
 	if err != nil {
 		return err
 	}
+	slog.DebugContext(ctx, "Device deleted", "device_id", id, "tenant", tenantFromContext(ctx))
 	return nil
 }
 
-// DeleteAllDevices helper function just for tests
+// DeleteAllDevices helper function just for tests, clears every tenant
 func (r RepositoryImpl) DeleteAllDevices() {
 	query := "DELETE FROM devices"
 	_, err := r.db.Exec(query)
 	if err != nil {
-		log.Fatal("Error deleting devices:", err)
+		fatal("Error deleting devices", "error", err)
+	}
+}
+
+// BackfillPublicIDs gives devices created before public ids existed one, it returns how many were updated
+func (r RepositoryImpl) BackfillPublicIDs(ctx context.Context) (int, error) {
+	rows, err := r.db.QueryContext(ctx, "SELECT id, creation_time FROM devices WHERE public_id IS NULL")
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		id           int
+		creationTime time.Time
+	}
+	var devices []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.creationTime); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		devices = append(devices, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	updated := 0
+	for _, p := range devices {
+		// the creation time keeps backfilled ids sorted like the devices were created
+		result, err := r.db.ExecContext(ctx, r.dialect.bind("UPDATE devices SET public_id = ? WHERE id = ? AND public_id IS NULL"),
+			newULID(p.creationTime), p.id)
+		if err != nil {
+			return updated, err
+		}
+		n, _ := result.RowsAffected()
+		updated += int(n)
+	}
+	return updated, nil
+}
+
+// BrandCount is the number of devices of a brand within a tenant
+type BrandCount struct {
+	Tenant string
+	Brand  string
+	Count  int
+}
+
+// CountDevicesByBrand counts devices of every tenant, it backs the devices metric and is not tenant scoped
+func (r RepositoryImpl) CountDevicesByBrand(ctx context.Context) ([]BrandCount, error) {
+	query := "SELECT tenant_id, brand, COUNT(*) FROM devices GROUP BY tenant_id, brand ORDER BY tenant_id, brand"
+	rows, err := r.db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []BrandCount
+	for rows.Next() {
+		var c BrandCount
+		if err := rows.Scan(&c.Tenant, &c.Brand, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
 	}
+	return counts, rows.Err()
 }
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// repositoryFactory returns an empty Repository, removing what the test stored when it ends, and the
+// assignees of its database to lend devices to
+type repositoryFactory func(t *testing.T) (Repository, AssigneeRepository)
+
+// migratedRepository opens dsn, migrates it and clears the devices before and after the test
+func migratedRepository(t *testing.T, dsn string) RepositoryImpl {
+	t.Helper()
+	db, dialect, err := openDB(dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	if _, err := NewMigrator(db, dialect, embeddedMigrations(dialect)).Up(context.Background(), false, io.Discard); err != nil {
+		t.Fatal(err)
+	}
+	r := RepositoryImpl{db: db, dialect: dialect}
+	r.DeleteAllDevices()
+	t.Cleanup(r.DeleteAllDevices)
+	return r
+}
+
+// withAssignees pairs r with the assignees of its database
+func withAssignees(r RepositoryImpl) (Repository, AssigneeRepository) {
+	return r, AssigneeRepositoryImpl{db: r.db, dialect: r.dialect}
+}
+
+func sqliteRepository(t *testing.T) RepositoryImpl {
+	return migratedRepository(t, "sqlite://"+filepath.Join(t.TempDir(), "contract.db"))
+}
+
+// contractBackend creates the repositories of one backend, isolated backends give every test its own
+// database so the contract runs in parallel
+type contractBackend struct {
+	newRepository repositoryFactory
+	isolated      bool
+}
+
+func Test_RepositoryContract(t *testing.T) {
+	backends := map[string]func(t *testing.T) contractBackend{
+		"sqlite": func(t *testing.T) contractBackend {
+			return contractBackend{func(t *testing.T) (Repository, AssigneeRepository) {
+				return withAssignees(sqliteRepository(t))
+			}, true}
+		},
+		// the decorators must not change the semantics of the repository they wrap
+		"sqlite decorated": func(t *testing.T) contractBackend {
+			return contractBackend{func(t *testing.T) (Repository, AssigneeRepository) {
+				cache := CacheConfig{Size: 100, TTL: time.Minute, NegativeTTL: time.Second}
+				r, assignees := withAssignees(sqliteRepository(t))
+				return NewTracedRepository(NewInstrumentedRepository(NewCachedRepository(r, cache, nil))), assignees
+			}, true}
+		},
+		// a schema per test on the mysqld of TEST_DATABASE=mysqld or the server of TEST_MYSQL_DSN
+		"mysql": func(t *testing.T) contractBackend {
+			serverDSN := mysqlServerDSN(t)
+			return contractBackend{func(t *testing.T) (Repository, AssigneeRepository) {
+				return withAssignees(mysqlDatabase(t, serverDSN))
+			}, true}
+		},
+		// a database per test on the postgres of TEST_DATABASE=postgres or the server of TEST_POSTGRES_DSN
+		"postgres": func(t *testing.T) contractBackend {
+			serverDSN := postgresServerDSN(t)
+			return contractBackend{func(t *testing.T) (Repository, AssigneeRepository) {
+				return withAssignees(postgresDatabase(t, serverDSN))
+			}, true}
+		},
+	}
+	for name, backend := range backends {
+		t.Run(name, func(t *testing.T) {
+			testRepositoryContract(t, backend(t))
+		})
+	}
+}
+
+// testRepositoryContract verifies the semantics every Repository implementation has to provide
+func testRepositoryContract(t *testing.T, backend contractBackend) {
+	newRepository := backend.newRepository
+	ctx := withTenant(context.Background(), "contract-tenant")
+	otherTenant := withTenant(context.Background(), "contract-other-tenant")
+
+	t.Run("should assign ids and creation time on save", func(t *testing.T) {
+		parallel(t, backend)
+		r, _ := newRepository(t)
+		first, err := r.SaveDevice(ctx, Device{Name: "First", Brand: "Contract Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		second, err := r.SaveDevice(ctx, Device{Name: "Second", Brand: "Contract Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, device := range []Device{first, second} {
+			if device.ID == 0 || !isULID(device.PublicID) || device.CreationTime.IsZero() {
+				t.Errorf("expected id, public id and creation time to be set, got %+v", device)
+			}
+		}
+		if first.ID == second.ID || first.PublicID == second.PublicID {
+			t.Errorf("expected distinct ids, got %+v and %+v", first, second)
+		}
+		found, err := r.FindDeviceByID(ctx, first.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameDevice(found, first) {
+			t.Errorf("expected %+v, got %+v", first, found)
+		}
+		found, err = r.FindDeviceByPublicID(ctx, second.PublicID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameDevice(found, second) {
+			t.Errorf("expected %+v, got %+v", second, found)
+		}
+	})
+
+	t.Run("should detect duplicates per tenant", func(t *testing.T) {
+		parallel(t, backend)
+		r, _ := newRepository(t)
+		if _, err := r.SaveDevice(ctx, Device{Name: "Taken", Brand: "Contract Brand"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.SaveDevice(ctx, Device{Name: "Taken", Brand: "Contract Brand"}); !errors.Is(err, ErrDeviceExists) {
+			t.Errorf("expected ErrDeviceExists, got %v", err)
+		}
+		if _, err := r.SaveDevice(ctx, Device{Name: "Taken", Brand: "Other Brand"}); err != nil {
+			t.Errorf("expected the same name with another brand to be allowed, got %v", err)
+		}
+		if _, err := r.SaveDevice(otherTenant, Device{Name: "Taken", Brand: "Contract Brand"}); err != nil {
+			t.Errorf("expected the same device in another tenant to be allowed, got %v", err)
+		}
+	})
+
+	t.Run("should report missing devices as no rows", func(t *testing.T) {
+		parallel(t, backend)
+		r, _ := newRepository(t)
+		device, err := r.SaveDevice(ctx, Device{Name: "Hidden", Brand: "Contract Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.FindDeviceByID(ctx, device.ID+1000)
+		expectNoRows(t, "FindDeviceByID of unknown id", err)
+		_, err = r.FindDeviceByPublicID(ctx, "01ARZ3NDEKTSV4RRFFQ69G5FAV")
+		expectNoRows(t, "FindDeviceByPublicID of unknown id", err)
+		_, err = r.FindDeviceByID(otherTenant, device.ID)
+		expectNoRows(t, "FindDeviceByID of another tenant", err)
+		_, err = r.FindDeviceByPublicID(otherTenant, device.PublicID)
+		expectNoRows(t, "FindDeviceByPublicID of another tenant", err)
+		_, err = r.UpdateDevice(ctx, Device{ID: device.ID + 1000, Name: "x", Brand: "y"})
+		expectNoRows(t, "UpdateDevice of unknown id", err)
+		_, err = r.UpdateDevice(otherTenant, Device{ID: device.ID, Name: "x", Brand: "y"})
+		expectNoRows(t, "UpdateDevice of another tenant", err)
+		expectNoRows(t, "DeleteDevice of unknown id", r.DeleteDevice(ctx, device.ID+1000))
+		expectNoRows(t, "DeleteDevice of another tenant", r.DeleteDevice(otherTenant, device.ID))
+	})
+
+	t.Run("should list devices by brand in creation order", func(t *testing.T) {
+		parallel(t, backend)
+		r, _ := newRepository(t)
+		var saved []Device
+		for i, brand := range []string{"Brand A", "Brand B", "Brand A", "Brand A"} {
+			device, err := r.SaveDevice(ctx, Device{Name: fmt.Sprintf("Listed %d", i), Brand: brand})
+			if err != nil {
+				t.Fatal(err)
+			}
+			saved = append(saved, device)
+		}
+		if _, err := r.SaveDevice(otherTenant, Device{Name: "Foreign", Brand: "Brand A"}); err != nil {
+			t.Fatal(err)
+		}
+
+		devices, err := r.FindDevicesByBrand(ctx, "Brand A")
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectDevices(t, "Brand A", devices, saved[0], saved[2], saved[3])
+		devices, err = r.FindAllDevices(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectDevices(t, "all devices", devices, saved...)
+		devices, err = r.FindDevicesByBrand(ctx, "Unknown Brand")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 0 {
+			t.Errorf("expected no devices of an unknown brand, got %v", devices)
+		}
+	})
+
+	t.Run("should update in place and report conflicts", func(t *testing.T) {
+		parallel(t, backend)
+		r, _ := newRepository(t)
+		existing, err := r.SaveDevice(ctx, Device{Name: "Existing", Brand: "Contract Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		device, err := r.SaveDevice(ctx, Device{Name: "Renamed Later", Brand: "Contract Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		device.Name = "Renamed"
+		device.Brand = "New Brand"
+		if _, err := r.UpdateDevice(ctx, device); err != nil {
+			t.Fatal(err)
+		}
+		found, err := r.FindDeviceByPublicID(ctx, device.PublicID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !sameDevice(found, device) {
+			t.Errorf("expected %+v after update, got %+v", device, found)
+		}
+
+		device.Name = existing.Name
+		device.Brand = existing.Brand
+		_, err = r.UpdateDevice(ctx, device)
+		var conflict *DeviceConflictError
+		if !errors.As(err, &conflict) || conflict.PublicID != existing.PublicID {
+			t.Errorf("expected a conflict with %v, got %v", existing.PublicID, err)
+		}
+	})
+
+	t.Run("should delete devices", func(t *testing.T) {
+		parallel(t, backend)
+		r, _ := newRepository(t)
+		device, err := r.SaveDevice(ctx, Device{Name: "Deleted", Brand: "Contract Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := r.DeleteDevice(ctx, device.ID); err != nil {
+			t.Fatal(err)
+		}
+		_, err = r.FindDeviceByID(ctx, device.ID)
+		expectNoRows(t, "FindDeviceByID after delete", err)
+		if _, err := r.SaveDevice(ctx, Device{Name: "Deleted", Brand: "Contract Brand"}); err != nil {
+			t.Errorf("expected the name to be free again, got %v", err)
+		}
+	})
+
+	t.Run("should refuse to delete devices on loan", func(t *testing.T) {
+		parallel(t, backend)
+		r, assignees := newRepository(t)
+		device, err := r.SaveDevice(ctx, Device{Name: "On Loan", Brand: "Contract Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		assignee, err := assignees.SaveAssignee(ctx, Assignee{Name: "Contract Borrower"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.CheckoutDevice(ctx, device.ID, assignee.ID, time.Now().Add(time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.DeleteDevice(ctx, device.ID); !errors.Is(err, ErrDeviceCheckedOut) {
+			t.Fatalf("expected ErrDeviceCheckedOut, got %v", err)
+		}
+		found, err := r.FindDeviceByID(ctx, device.ID)
+		if err != nil || found.Holder == nil || found.Holder.AssigneeID != assignee.PublicID {
+			t.Fatalf("expected the device to stay on loan to %v, got %+v, %v", assignee.PublicID, found.Holder, err)
+		}
+		if _, err := r.CheckinDevice(ctx, device.ID); err != nil {
+			t.Fatal(err)
+		}
+		if err := r.DeleteDevice(ctx, device.ID); err != nil {
+			t.Errorf("expected a returned device to be deleted, got %v", err)
+		}
+	})
+
+	t.Run("should commit units of work as a whole", func(t *testing.T) {
+		parallel(t, backend)
+		r, _ := newRepository(t)
+		var saved []Device
+		err := r.WithTx(ctx, TxOptions{}, func(tx Repository) error {
+			for _, name := range []string{"Unit A", "Unit B"} {
+				device, err := tx.SaveDevice(ctx, Device{Name: name, Brand: "Contract Brand"})
+				if err != nil {
+					return err
+				}
+				saved = append(saved, device)
+			}
+			found, err := tx.FindDeviceByPublicID(ctx, saved[0].PublicID)
+			if err != nil || !sameDevice(found, saved[0]) {
+				t.Errorf("expected the unit of work to see its own changes, got %+v, %v", found, err)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		errAbort := errors.New("abort")
+		err = r.WithTx(ctx, TxOptions{}, func(tx Repository) error {
+			if _, err := tx.SaveDevice(ctx, Device{Name: "Unit C", Brand: "Contract Brand"}); err != nil {
+				return err
+			}
+			if err := tx.DeleteDevice(ctx, saved[0].ID); err != nil {
+				return err
+			}
+			return errAbort
+		})
+		if !errors.Is(err, errAbort) {
+			t.Errorf("expected the error of the unit of work, got %v", err)
+		}
+		devices, err := r.FindAllDevices(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expectDevices(t, "after a committed and a rolled back unit of work", devices, saved...)
+	})
+
+	t.Run("should undo only the failed call of a unit of work", func(t *testing.T) {
+		parallel(t, backend)
+		r, _ := newRepository(t)
+		err := r.WithTx(ctx, TxOptions{}, func(tx Repository) error {
+			if _, err := tx.SaveDevice(ctx, Device{Name: "Kept", Brand: "Contract Brand"}); err != nil {
+				return err
+			}
+			if _, err := tx.SaveDevice(ctx, Device{Name: "Kept", Brand: "Contract Brand"}); !errors.Is(err, ErrDeviceExists) {
+				t.Errorf("expected ErrDeviceExists, got %v", err)
+			}
+			_, err := tx.SaveDevice(ctx, Device{Name: "Kept Too", Brand: "Contract Brand"})
+			return err
+		})
+		if err != nil {
+			t.Fatalf("expected the unit of work to go on after a failed call, got %v", err)
+		}
+		devices, err := r.FindAllDevices(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 2 {
+			t.Errorf("expected both devices to be committed, got %v", devices)
+		}
+	})
+
+	t.Run("should show the changes of a unit of work afterwards", func(t *testing.T) {
+		parallel(t, backend)
+		r, _ := newRepository(t)
+		device, err := r.SaveDevice(ctx, Device{Name: "Before", Brand: "Contract Brand"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.FindDeviceByPublicID(ctx, device.PublicID)
+		err = r.WithTx(ctx, TxOptions{Isolation: sql.LevelSerializable}, func(tx Repository) error {
+			current, err := tx.FindDeviceByID(ctx, device.ID)
+			if err != nil {
+				return err
+			}
+			current.Name = "After"
+			_, err = tx.UpdateDevice(ctx, current)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		found, err := r.FindDeviceByPublicID(ctx, device.PublicID)
+		if err != nil || found.Name != "After" {
+			t.Errorf("expected the device as changed by the unit of work, got %+v, %v", found, err)
+		}
+	})
+
+	t.Run("should be safe for concurrent use", func(t *testing.T) {
+		parallel(t, backend)
+		r, _ := newRepository(t)
+		const writers = 10
+		var wg sync.WaitGroup
+		distinct := make([]Device, writers)
+		distinctErrs := make([]error, writers)
+		sameErrs := make([]error, writers)
+		for i := 0; i < writers; i++ {
+			wg.Add(2)
+			go func() {
+				defer wg.Done()
+				distinct[i], distinctErrs[i] = r.SaveDevice(ctx, Device{Name: fmt.Sprintf("Concurrent %d", i), Brand: "Contract Brand"})
+			}()
+			go func() {
+				defer wg.Done()
+				_, sameErrs[i] = r.SaveDevice(ctx, Device{Name: "Contended", Brand: "Contract Brand"})
+			}()
+		}
+		wg.Wait()
+
+		ids := map[int]bool{}
+		for i, err := range distinctErrs {
+			if err != nil {
+				t.Errorf("expected concurrent saves of distinct devices to succeed, got %v", err)
+				continue
+			}
+			ids[distinct[i].ID] = true
+		}
+		if len(ids) != writers {
+			t.Errorf("expected %d distinct ids, got %v", writers, ids)
+		}
+		saved := 0
+		for _, err := range sameErrs {
+			switch {
+			case err == nil:
+				saved++
+			case !errors.Is(err, ErrDeviceExists):
+				t.Errorf("expected ErrDeviceExists for the losers, got %v", err)
+			}
+		}
+		if saved != 1 {
+			t.Errorf("expected exactly one save of the same device to win, got %d", saved)
+		}
+	})
+}
+
+func parallel(t *testing.T, backend contractBackend) {
+	if backend.isolated {
+		t.Parallel()
+	}
+}
+
+// sameDevice compares devices field by field, times by instant as drivers return them in different locations
+func sameDevice(a, b Device) bool {
+	return a.ID == b.ID && a.PublicID == b.PublicID && a.Name == b.Name && a.Brand == b.Brand && a.CreationTime.Equal(b.CreationTime)
+}
+
+func expectNoRows(t *testing.T, what string, err error) {
+	t.Helper()
+	if !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("%v: expected sql.ErrNoRows, got %v", what, err)
+	}
+}
+
+func expectDevices(t *testing.T, what string, devices []Device, expected ...Device) {
+	t.Helper()
+	if len(devices) != len(expected) {
+		t.Errorf("%v: expected %d devices, got %v", what, len(expected), devices)
+		return
+	}
+	for i := range expected {
+		if !sameDevice(devices[i], expected[i]) {
+			t.Errorf("%v: expected %+v at %d, got %+v", what, expected[i], i, devices[i])
+		}
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+func Test_WithTx(t *testing.T) {
+	ctx := context.Background()
+	deadlock := &mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"}
+
+	t.Run("should run the unit of work again after a deadlock", func(t *testing.T) {
+		r := sqliteRepository(t)
+		attempts := 0
+		err := r.WithTx(ctx, TxOptions{}, func(tx Repository) error {
+			attempts++
+			if _, err := tx.SaveDevice(ctx, Device{Name: "Retried", Brand: "Tx Brand"}); err != nil {
+				return err
+			}
+			if attempts == 1 {
+				return deadlock
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if attempts != 2 {
+			t.Errorf("expected 2 attempts, got %d", attempts)
+		}
+		devices, err := r.FindAllDevices(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 1 {
+			t.Errorf("expected the first attempt to be rolled back, got %v", devices)
+		}
+	})
+
+	t.Run("should give up after the attempts", func(t *testing.T) {
+		r := sqliteRepository(t)
+		attempts := 0
+		err := r.WithTx(ctx, TxOptions{MaxAttempts: 4}, func(tx Repository) error {
+			attempts++
+			return deadlock
+		})
+		if !errors.Is(err, deadlock) || attempts != 4 {
+			t.Errorf("expected the deadlock after 4 attempts, got %v after %d", err, attempts)
+		}
+	})
+
+	t.Run("should not run the unit of work again after other errors", func(t *testing.T) {
+		r := sqliteRepository(t)
+		attempts := 0
+		errAbort := errors.New("abort")
+		err := r.WithTx(ctx, TxOptions{}, func(tx Repository) error {
+			attempts++
+			return errAbort
+		})
+		if !errors.Is(err, errAbort) || attempts != 1 {
+			t.Errorf("expected the error after 1 attempt, got %v after %d", err, attempts)
+		}
+	})
+
+	t.Run("should roll back a nested unit of work on its own", func(t *testing.T) {
+		r := sqliteRepository(t)
+		errAbort := errors.New("abort")
+		err := r.WithTx(ctx, TxOptions{}, func(tx Repository) error {
+			if _, err := tx.SaveDevice(ctx, Device{Name: "Outer", Brand: "Tx Brand"}); err != nil {
+				return err
+			}
+			nested := tx.WithTx(ctx, TxOptions{}, func(tx Repository) error {
+				if _, err := tx.SaveDevice(ctx, Device{Name: "Inner", Brand: "Tx Brand"}); err != nil {
+					return err
+				}
+				return errAbort
+			})
+			if !errors.Is(nested, errAbort) {
+				t.Errorf("expected the error of the nested unit of work, got %v", nested)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		devices, err := r.FindAllDevices(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 1 || devices[0].Name != "Outer" {
+			t.Errorf("expected only the outer device, got %v", devices)
+		}
+	})
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// newServer wraps handler in a server with timeouts so slow or idle clients cannot hold connections forever
+func newServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       15 * time.Second,
+		WriteTimeout:      30 * time.Second,
+		IdleTimeout:       60 * time.Second,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+	}
+}
+
+// serve runs srv on ln until ctx is cancelled, then stops accepting connections and waits up to
+// drainTimeout for in-flight requests to complete
+func serve(ctx context.Context, srv *http.Server, ln net.Listener, drainTimeout time.Duration) error {
+	errs := make(chan error, 1)
+	go func() {
+		errs <- srv.Serve(ln)
+	}()
+
+	select {
+	case err := <-errs:
+		return err
+	case <-ctx.Done():
+	}
+
+	slog.Info("Shutting down, draining in-flight requests", "timeout", drainTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	if err := srv.Shutdown(shutdownCtx); err != nil {
+		// close whatever is left so the process can exit
+		srv.Close()
+		return err
+	}
+	if err := <-errs; !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+// Workers runs background loops and stops them together
+type Workers struct {
+	cancel context.CancelFunc
+	ctx    context.Context
+	wg     sync.WaitGroup
+}
+
+func NewWorkers() *Workers {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Workers{ctx: ctx, cancel: cancel}
+}
+
+// Go starts run, which must return once its context is cancelled
+func (ws *Workers) Go(run func(ctx context.Context)) {
+	ws.wg.Add(1)
+	go func() {
+		defer ws.wg.Done()
+		run(ws.ctx)
+	}()
+}
+
+// Stop cancels the workers and waits for the iteration in progress to finish
+func (ws *Workers) Stop() {
+	ws.cancel()
+	ws.wg.Wait()
+}
+
+// after delays run until ready is closed, run is skipped when the workers stop first
+func after(ready <-chan struct{}, run func(ctx context.Context)) func(ctx context.Context) {
+	return func(ctx context.Context) {
+		select {
+		case <-ready:
+			run(ctx)
+		case <-ctx.Done():
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func Test_GracefulShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := "http://" + ln.Addr().String() + "/devices"
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() {
+		served <- serve(ctx, newServer(ln.Addr().String(), handler), ln, 5*time.Second)
+	}()
+
+	type result struct {
+		body string
+		err  error
+	}
+	inFlight := make(chan result, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			inFlight <- result{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		inFlight <- result{body: string(body), err: err}
+	}()
+	<-started
+	cancel()
+
+	t.Run("should stop accepting new connections", func(t *testing.T) {
+		deadline := time.Now().Add(2 * time.Second)
+		for {
+			conn, err := net.DialTimeout("tcp", ln.Addr().String(), 100*time.Millisecond)
+			if err != nil {
+				return
+			}
+			conn.Close()
+			if time.Now().After(deadline) {
+				t.Fatal("expected listener to be closed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("should complete in-flight requests", func(t *testing.T) {
+		select {
+		case <-served:
+			t.Fatal("expected shutdown to wait for the in-flight request")
+		default:
+		}
+		close(release)
+		r := <-inFlight
+		if r.err != nil {
+			t.Fatalf("expected in-flight request to complete, got %v", r.err)
+		}
+		if r.body != "done" {
+			t.Errorf("expected body done, got %q", r.body)
+		}
+		if err := <-served; err != nil {
+			t.Errorf("expected clean shutdown, got %v", err)
+		}
+	})
+}
+
+func Test_Workers(t *testing.T) {
+	workers := NewWorkers()
+	stopped := make(chan struct{})
+	workers.Go(func(ctx context.Context) {
+		<-ctx.Done()
+		time.Sleep(50 * time.Millisecond)
+		close(stopped)
+	})
+	workers.Stop()
+	select {
+	case <-stopped:
+	default:
+		t.Error("expected Stop to wait for workers to return")
+	}
+}
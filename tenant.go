@@ -0,0 +1,204 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+const DefaultTenant = "default"
+
+var (
+	ErrQuotaExceeded = errors.New("tenant device quota exceeded")
+	tenantIDPattern  = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+)
+
+type tenantKey struct{}
+
+func withTenant(ctx context.Context, tenant string) context.Context {
+	return context.WithValue(ctx, tenantKey{}, tenant)
+}
+
+// tenantFromContext returns the tenant of the request, or the default tenant when none was resolved
+func tenantFromContext(ctx context.Context) string {
+	if tenant, ok := ctx.Value(tenantKey{}).(string); ok && tenant != "" {
+		return tenant
+	}
+	return DefaultTenant
+}
+
+// resolveTenant picks the tenant for a request. Principals bound to a tenant always use it and
+// may not name another one in X-Tenant-ID; only admins may choose any tenant through the header.
+func resolveTenant(r *http.Request) (string, error) {
+	header := r.Header.Get("X-Tenant-ID")
+	if header != "" && !tenantIDPattern.MatchString(header) {
+		return "", fmt.Errorf("invalid tenant id %q", header)
+	}
+	principal, _ := principalFromContext(r.Context())
+	switch {
+	case principal.Tenant != "":
+		if header != "" && header != principal.Tenant {
+			return "", fmt.Errorf("not allowed to access tenant %v", header)
+		}
+		return principal.Tenant, nil
+	case header != "" && principal.HasScope(ScopeAdmin):
+		return header, nil
+	case header != "" && header != DefaultTenant:
+		return "", fmt.Errorf("not allowed to access tenant %v", header)
+	}
+	return DefaultTenant, nil
+}
+
+// requireTenant resolves the tenant of the request and stores it in the request context
+func requireTenant(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		tenant, err := resolveTenant(r)
+		if err != nil {
+			writeProblem(w, http.StatusForbidden, err.Error())
+			return
+		}
+		next(w, r.WithContext(withTenant(r.Context(), tenant)))
+	}
+}
+
+// checkQuota fails with ErrQuotaExceeded when the tenant already holds its maximum number of
+// devices. The quota row is locked so concurrent inserts for the same tenant are serialized.
+func checkQuota(ctx context.Context, q querier, tenant string) error {
+	var maxDevices int
+	query := "SELECT max_devices FROM tenant_quotas WHERE tenant_id = ? FOR UPDATE"
+	err := q.QueryRowContext(ctx, query, tenant).Scan(&maxDevices)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var count int
+	query = "SELECT COUNT(*) FROM devices WHERE tenant_id = ?"
+	err = q.QueryRowContext(ctx, query, tenant).Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count >= maxDevices {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+type TenantQuota struct {
+	TenantID   string `json:"tenant_id"`
+	MaxDevices int    `json:"max_devices"`
+}
+
+type TenantQuotaRepository interface {
+	FindQuota(tenant string) (TenantQuota, error)
+	SaveQuota(quota TenantQuota) (TenantQuota, error)
+	DeleteQuota(tenant string) error
+}
+
+type TenantQuotaRepositoryImpl struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+var tenantQuotaRepository TenantQuotaRepository
+
+func (r TenantQuotaRepositoryImpl) FindQuota(tenant string) (TenantQuota, error) {
+	quota := TenantQuota{TenantID: tenant}
+	query := "SELECT max_devices FROM tenant_quotas WHERE tenant_id = ?"
+	err := r.db.QueryRow(r.dialect.bind(query), tenant).Scan(&quota.MaxDevices)
+	if err != nil {
+		return TenantQuota{}, err
+	}
+	return quota, nil
+}
+
+func (r TenantQuotaRepositoryImpl) SaveQuota(quota TenantQuota) (TenantQuota, error) {
+	query := "INSERT INTO tenant_quotas (tenant_id, max_devices) VALUES (?, ?) ON DUPLICATE KEY UPDATE max_devices = VALUES(max_devices)"
+	if r.dialect == Postgres || r.dialect == SQLite {
+		query = "INSERT INTO tenant_quotas (tenant_id, max_devices) VALUES (?, ?) ON CONFLICT (tenant_id) DO UPDATE SET max_devices = EXCLUDED.max_devices"
+	}
+	_, err := r.db.Exec(r.dialect.bind(query), quota.TenantID, quota.MaxDevices)
+	if err != nil {
+		return TenantQuota{}, err
+	}
+	return quota, nil
+}
+
+func (r TenantQuotaRepositoryImpl) DeleteQuota(tenant string) error {
+	query := "DELETE FROM tenant_quotas WHERE tenant_id = ?"
+	_, err := r.db.Exec(r.dialect.bind(query), tenant)
+	return err
+}
+
+// CrudTenantQuotaHandler reads and sets the quota of a tenant, admins bound to a tenant only their own
+func CrudTenantQuotaHandler(w http.ResponseWriter, r *http.Request) {
+	tenant, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/admin/tenants/"), "/")
+	if sub != "quota" {
+		http.NotFound(w, r)
+		return
+	}
+	if !tenantIDPattern.MatchString(tenant) {
+		http.Error(w, "Invalid tenant ID", http.StatusBadRequest)
+		return
+	}
+	if principal, _ := principalFromContext(r.Context()); principal.Tenant != "" && principal.Tenant != tenant {
+		http.Error(w, fmt.Sprintf("Not allowed to access tenant %v", tenant), http.StatusForbidden)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		quota, err := tenantQuotaRepository.FindQuota(tenant)
+		if err != nil {
+			if strings.Contains(err.Error(), "no rows in result set") {
+				http.Error(w, fmt.Sprintf("No quota set for tenant %v", tenant), http.StatusNotFound)
+				return
+			}
+			slog.ErrorContext(r.Context(), "Error finding tenant quota", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(quota)
+
+	case http.MethodPut:
+		var quota TenantQuota
+		err := json.NewDecoder(r.Body).Decode(&quota)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		if quota.MaxDevices < 0 {
+			http.Error(w, "max_devices must not be negative", http.StatusBadRequest)
+			return
+		}
+		quota.TenantID = tenant
+		quota, err = tenantQuotaRepository.SaveQuota(quota)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error saving tenant quota", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(quota)
+
+	case http.MethodDelete:
+		err := tenantQuotaRepository.DeleteQuota(tenant)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error deleting tenant quota", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
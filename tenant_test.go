@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// tenantRequest runs a device request as principal through tenant resolution
+func tenantRequest(t *testing.T, principal Principal, header string, method string, url string, body any, handler http.HandlerFunc) *httptest.ResponseRecorder {
+	t.Helper()
+	var payload []byte
+	if body != nil {
+		var err error
+		payload, err = json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	req, err := http.NewRequest(method, url, bytes.NewReader(payload))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header != "" {
+		req.Header.Set("X-Tenant-ID", header)
+	}
+	req = req.WithContext(withPrincipal(req.Context(), principal))
+	rr := httptest.NewRecorder()
+	requireTenant(handler).ServeHTTP(rr, req)
+	return rr
+}
+
+func Test_TenantIsolation(t *testing.T) {
+	ctxA := withTenant(context.Background(), "tenant-a")
+	ctxB := withTenant(context.Background(), "tenant-b")
+	device, err := repository.SaveDevice(ctxA, Device{Name: "Tenant Device", Brand: "Tenant Brand"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("should not read devices of another tenant", func(t *testing.T) {
+		_, err := repository.FindDeviceByID(ctxB, device.ID)
+		if err == nil || !strings.Contains(err.Error(), "no rows in result set") {
+			t.Errorf("expected device to be invisible to tenant-b, got %v", err)
+		}
+		devices, err := repository.FindAllDevices(ctxB)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 0 {
+			t.Errorf("expected no devices for tenant-b, got %v", devices)
+		}
+		devices, err = repository.FindDevicesByBrand(ctxB, device.Brand)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 0 {
+			t.Errorf("expected no devices for tenant-b, got %v", devices)
+		}
+		devices, err = repository.FindAllDevices(ctxA)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(devices) != 1 || devices[0].ID != device.ID {
+			t.Errorf("expected tenant-a to see its device, got %v", devices)
+		}
+	})
+
+	t.Run("should not write devices of another tenant", func(t *testing.T) {
+		_, err := repository.UpdateDevice(ctxB, Device{ID: device.ID, Name: "Hijacked", Brand: "Tenant Brand"})
+		if err == nil || !strings.Contains(err.Error(), "no rows in result set") {
+			t.Errorf("expected update from tenant-b to fail, got %v", err)
+		}
+		err = repository.DeleteDevice(ctxB, device.ID)
+		if err == nil || !strings.Contains(err.Error(), "no rows in result set") {
+			t.Errorf("expected delete from tenant-b to fail, got %v", err)
+		}
+		stored, err := repository.FindDeviceByID(ctxA, device.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if stored.Name != device.Name {
+			t.Errorf("expected device to be unchanged, got %v", stored)
+		}
+	})
+
+	t.Run("should only enforce name and brand uniqueness within a tenant", func(t *testing.T) {
+		_, err := repository.SaveDevice(ctxB, Device{Name: device.Name, Brand: device.Brand})
+		if err != nil {
+			t.Errorf("expected same device in another tenant to be accepted, got %v", err)
+		}
+		_, err = repository.SaveDevice(ctxA, Device{Name: device.Name, Brand: device.Brand})
+		if err == nil {
+			t.Error("expected duplicate device in the same tenant to fail")
+		}
+	})
+
+	t.Run("should return 404 for devices of another tenant over http", func(t *testing.T) {
+		rr := tenantRequest(t, Principal{Subject: "b", Tenant: "tenant-b", Scopes: []string{ScopeDevicesRead}}, "", "GET", "/device/"+device.PublicID, nil, CrudDeviceHandler)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+		rr = tenantRequest(t, Principal{Subject: "a", Tenant: "tenant-a", Scopes: []string{ScopeDevicesRead}}, "", "GET", "/device/"+device.PublicID, nil, CrudDeviceHandler)
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+	})
+	repository.DeleteAllDevices()
+}
+
+func Test_ResolveTenant(t *testing.T) {
+	cases := []struct {
+		name      string
+		principal Principal
+		header    string
+		tenant    string
+		forbidden bool
+	}{
+		{"bound principal", Principal{Tenant: "tenant-a"}, "", "tenant-a", false},
+		{"bound principal naming its tenant", Principal{Tenant: "tenant-a"}, "tenant-a", "tenant-a", false},
+		{"bound principal naming another tenant", Principal{Tenant: "tenant-a"}, "tenant-b", "", true},
+		{"admin choosing a tenant", Principal{Scopes: []string{ScopeAdmin}}, "tenant-b", "tenant-b", false},
+		{"unbound principal", Principal{}, "", DefaultTenant, false},
+		{"unbound principal naming a tenant", Principal{}, "tenant-b", "", true},
+		{"invalid tenant id", Principal{Scopes: []string{ScopeAdmin}}, "../etc", "", true},
+	}
+	for _, c := range cases {
+		var resolved string
+		rr := tenantRequest(t, c.principal, c.header, "GET", "/devices", nil, func(w http.ResponseWriter, r *http.Request) {
+			resolved = tenantFromContext(r.Context())
+		})
+		if c.forbidden {
+			if rr.Code != http.StatusForbidden {
+				t.Errorf("%v: expected status code %d, got %d", c.name, http.StatusForbidden, rr.Code)
+			}
+			continue
+		}
+		if resolved != c.tenant {
+			t.Errorf("%v: expected tenant %v, got %v", c.name, c.tenant, resolved)
+		}
+	}
+}
+
+func Test_TenantQuota(t *testing.T) {
+	ctx := withTenant(context.Background(), "tenant-quota")
+	_, err := tenantQuotaRepository.SaveQuota(TenantQuota{TenantID: "tenant-quota", MaxDevices: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tenantQuotaRepository.DeleteQuota("tenant-quota")
+
+	_, err = repository.SaveDevice(ctx, Device{Name: "Quota Device 1", Brand: "Quota Brand"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = repository.SaveDevice(ctx, Device{Name: "Quota Device 2", Brand: "Quota Brand"})
+	if !errors.Is(err, ErrQuotaExceeded) {
+		t.Errorf("expected quota to be exceeded, got %v", err)
+	}
+	rr := tenantRequest(t, Principal{Tenant: "tenant-quota"}, "", "POST", "/device/", Device{Name: "Quota Device 3", Brand: "Quota Brand"}, CrudDeviceHandler)
+	if rr.Code != http.StatusForbidden {
+		t.Errorf("expected status code %d, got %d", http.StatusForbidden, rr.Code)
+	}
+	_, err = repository.SaveDevice(withTenant(context.Background(), "tenant-unlimited"), Device{Name: "Quota Device 2", Brand: "Quota Brand"})
+	if err != nil {
+		t.Errorf("expected tenant without quota to be unlimited, got %v", err)
+	}
+	repository.DeleteAllDevices()
+}
+
+func Test_TenantBoundAdmin(t *testing.T) {
+	auth := APIKeyAuthenticator{repo: apiKeyRepository, adminKey: testAdminKey}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/api-keys", requireScope(auth, adminScope, CrudAPIKeysHandler))
+	mux.HandleFunc("/admin/api-keys/", requireScope(auth, adminScope, CrudAPIKeyHandler))
+	mux.HandleFunc("/admin/tenants/", requireScope(auth, adminScope, CrudTenantQuotaHandler))
+	adminRequest := func(t *testing.T, token string, method string, url string, body any) *httptest.ResponseRecorder {
+		t.Helper()
+		payload, err := json.Marshal(body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(method, url, bytes.NewReader(payload))
+		req.Header.Set("Authorization", "Bearer "+token)
+		rr := httptest.NewRecorder()
+		mux.ServeHTTP(rr, req)
+		return rr
+	}
+	issue := func(t *testing.T, token string, key APIKey) APIKey {
+		t.Helper()
+		rr := adminRequest(t, token, "POST", "/admin/api-keys", key)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d: %v", http.StatusCreated, rr.Code, rr.Body.String())
+		}
+		var issued APIKey
+		if err := json.Unmarshal(rr.Body.Bytes(), &issued); err != nil {
+			t.Fatal(err)
+		}
+		return issued
+	}
+	admin := issue(t, testAdminKey, APIKey{Name: "bound admin", Scopes: []string{ScopeAdmin}, Tenant: "tenant-admin-a"})
+	other := issue(t, testAdminKey, APIKey{Name: "other tenant", Scopes: []string{ScopeDevicesRead}, Tenant: "tenant-admin-b"})
+
+	t.Run("should not issue keys of another tenant or without one", func(t *testing.T) {
+		for _, tenant := range []string{"tenant-admin-b", ""} {
+			rr := adminRequest(t, admin.Key, "POST", "/admin/api-keys", APIKey{Name: "escalated", Scopes: []string{ScopeAdmin}, Tenant: tenant})
+			if rr.Code != http.StatusForbidden {
+				t.Errorf("expected status code %d for tenant %q, got %d", http.StatusForbidden, tenant, rr.Code)
+			}
+		}
+		issued := issue(t, admin.Key, APIKey{Name: "own tenant", Scopes: []string{ScopeDevicesRead}, Tenant: "tenant-admin-a"})
+		if issued.Tenant != "tenant-admin-a" {
+			t.Errorf("expected key of tenant-admin-a, got %v", issued.Tenant)
+		}
+	})
+
+	t.Run("should only list keys of its tenant", func(t *testing.T) {
+		rr := adminRequest(t, admin.Key, "GET", "/admin/api-keys", nil)
+		var keys []APIKey
+		if err := json.Unmarshal(rr.Body.Bytes(), &keys); err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) == 0 {
+			t.Fatalf("expected keys of tenant-admin-a, got none")
+		}
+		for _, key := range keys {
+			if key.Tenant != "tenant-admin-a" {
+				t.Errorf("expected only keys of tenant-admin-a, got %v", key)
+			}
+		}
+	})
+
+	t.Run("should not revoke keys of another tenant", func(t *testing.T) {
+		rr := adminRequest(t, admin.Key, "DELETE", "/admin/api-keys/"+strconv.Itoa(other.ID), nil)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+		key, err := apiKeyRepository.FindAPIKeyByID(other.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if key.RevokedTime != nil {
+			t.Errorf("expected key of tenant-admin-b to stay valid")
+		}
+	})
+
+	t.Run("should only set the quota of its tenant", func(t *testing.T) {
+		for _, method := range []string{"GET", "PUT", "DELETE"} {
+			rr := adminRequest(t, admin.Key, method, "/admin/tenants/tenant-admin-b/quota", TenantQuota{MaxDevices: 1})
+			if rr.Code != http.StatusForbidden {
+				t.Errorf("expected status code %d for %v, got %d", http.StatusForbidden, method, rr.Code)
+			}
+		}
+		if _, err := tenantQuotaRepository.FindQuota("tenant-admin-b"); err == nil {
+			t.Errorf("expected no quota for tenant-admin-b")
+		}
+		rr := adminRequest(t, admin.Key, "PUT", "/admin/tenants/tenant-admin-a/quota", TenantQuota{MaxDevices: 1})
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d: %v", http.StatusOK, rr.Code, rr.Body.String())
+		}
+		tenantQuotaRepository.DeleteQuota("tenant-admin-a")
+	})
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	"go.opentelemetry.io/otel/trace/noop"
+)
+
+// instrumentationName names the tracer spans of this service are recorded by
+const instrumentationName = "github.com/paulj19/device-store"
+
+// tracer starts every span. It records nothing until main installs the provider from newTracerProvider.
+var tracer trace.Tracer = noop.NewTracerProvider().Tracer(instrumentationName)
+
+// traceContext reads and writes W3C traceparent headers
+var traceContext = propagation.TraceContext{}
+
+// recordError marks span failed with err
+func recordError(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// errorStatus marks span failed unless err only means nothing was found
+func errorStatus(span trace.Span, err error) {
+	if !errors.Is(err, sql.ErrNoRows) {
+		recordError(span, err)
+	}
+}
+
+// traced starts a server span for each request to route, continuing the trace of a traceparent header
+func traced(route string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		ctx := traceContext.Extract(r.Context(), propagation.HeaderCarrier(r.Header))
+		ctx, span := tracer.Start(ctx, r.Method+" "+route, trace.WithSpanKind(trace.SpanKindServer), trace.WithAttributes(
+			attribute.String("http.request.method", r.Method),
+			attribute.String("http.route", route),
+			attribute.String("url.path", r.URL.Path),
+		))
+		defer span.End()
+
+		rec := &statusRecorder{ResponseWriter: w}
+		next(rec, r.WithContext(ctx))
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		span.SetAttributes(attribute.Int("http.response.status_code", rec.status))
+		if rec.status >= 500 {
+			span.SetStatus(codes.Error, http.StatusText(rec.status))
+		}
+	}
+}
+
+// TracedRepository wraps every call to next in a span
+type TracedRepository struct {
+	next Repository
+}
+
+func NewTracedRepository(next Repository) TracedRepository {
+	return TracedRepository{next: next}
+}
+
+func (r TracedRepository) SaveDevice(ctx context.Context, device Device) (Device, error) {
+	ctx, span := tracer.Start(ctx, "Repository.SaveDevice")
+	defer span.End()
+	device, err := r.next.SaveDevice(ctx, device)
+	errorStatus(span, err)
+	return device, err
+}
+
+func (r TracedRepository) FindDeviceByID(ctx context.Context, id int) (Device, error) {
+	ctx, span := tracer.Start(ctx, "Repository.FindDeviceByID")
+	defer span.End()
+	span.SetAttributes(attribute.Int("device.id", id))
+	device, err := r.next.FindDeviceByID(ctx, id)
+	errorStatus(span, err)
+	return device, err
+}
+
+func (r TracedRepository) FindDeviceByPublicID(ctx context.Context, publicID string) (Device, error) {
+	ctx, span := tracer.Start(ctx, "Repository.FindDeviceByPublicID")
+	defer span.End()
+	span.SetAttributes(attribute.String("device.public_id", publicID))
+	device, err := r.next.FindDeviceByPublicID(ctx, publicID)
+	errorStatus(span, err)
+	return device, err
+}
+
+func (r TracedRepository) FindDevicesByBrand(ctx context.Context, brand string) ([]Device, error) {
+	ctx, span := tracer.Start(ctx, "Repository.FindDevicesByBrand")
+	defer span.End()
+	devices, err := r.next.FindDevicesByBrand(ctx, brand)
+	errorStatus(span, err)
+	span.SetAttributes(attribute.Int("devices.count", len(devices)))
+	return devices, err
+}
+
+func (r TracedRepository) FindAllDevices(ctx context.Context) ([]Device, error) {
+	ctx, span := tracer.Start(ctx, "Repository.FindAllDevices")
+	defer span.End()
+	devices, err := r.next.FindAllDevices(ctx)
+	errorStatus(span, err)
+	span.SetAttributes(attribute.Int("devices.count", len(devices)))
+	return devices, err
+}
+
+func (r TracedRepository) UpdateDevice(ctx context.Context, device Device) (Device, error) {
+	ctx, span := tracer.Start(ctx, "Repository.UpdateDevice")
+	defer span.End()
+	span.SetAttributes(attribute.Int("device.id", device.ID))
+	device, err := r.next.UpdateDevice(ctx, device)
+	errorStatus(span, err)
+	return device, err
+}
+
+func (r TracedRepository) DeleteDevice(ctx context.Context, id int) error {
+	ctx, span := tracer.Start(ctx, "Repository.DeleteDevice")
+	defer span.End()
+	span.SetAttributes(attribute.Int("device.id", id))
+	err := r.next.DeleteDevice(ctx, id)
+	errorStatus(span, err)
+	return err
+}
+
+func (r TracedRepository) CheckoutDevice(ctx context.Context, id int, assigneeID int, due time.Time) (Device, error) {
+	ctx, span := tracer.Start(ctx, "Repository.CheckoutDevice")
+	defer span.End()
+	span.SetAttributes(attribute.Int("device.id", id))
+	span.SetAttributes(attribute.Int("assignee.id", assigneeID))
+	device, err := r.next.CheckoutDevice(ctx, id, assigneeID, due)
+	errorStatus(span, err)
+	return device, err
+}
+
+func (r TracedRepository) CheckinDevice(ctx context.Context, id int) (Device, error) {
+	ctx, span := tracer.Start(ctx, "Repository.CheckinDevice")
+	defer span.End()
+	span.SetAttributes(attribute.Int("device.id", id))
+	device, err := r.next.CheckinDevice(ctx, id)
+	errorStatus(span, err)
+	return device, err
+}
+
+func (r TracedRepository) FindDevicesByAssignee(ctx context.Context, assigneeID int) ([]Device, error) {
+	ctx, span := tracer.Start(ctx, "Repository.FindDevicesByAssignee")
+	defer span.End()
+	span.SetAttributes(attribute.Int("assignee.id", assigneeID))
+	devices, err := r.next.FindDevicesByAssignee(ctx, assigneeID)
+	errorStatus(span, err)
+	span.SetAttributes(attribute.Int("devices.count", len(devices)))
+	return devices, err
+}
+
+func (r TracedRepository) FindOverdueDevices(ctx context.Context, now time.Time) ([]Device, error) {
+	ctx, span := tracer.Start(ctx, "Repository.FindOverdueDevices")
+	defer span.End()
+	devices, err := r.next.FindOverdueDevices(ctx, now)
+	errorStatus(span, err)
+	span.SetAttributes(attribute.Int("devices.count", len(devices)))
+	return devices, err
+}
+
+func (r TracedRepository) WithTx(ctx context.Context, opts TxOptions, fn func(tx Repository) error) error {
+	ctx, span := tracer.Start(ctx, "Repository.WithTx")
+	defer span.End()
+	err := r.next.WithTx(ctx, opts, func(tx Repository) error {
+		return fn(NewTracedRepository(tx))
+	})
+	errorStatus(span, err)
+	return err
+}
+
+func (r TracedRepository) DeleteAllDevices() {
+	r.next.DeleteAllDevices()
+}
+
+// tracedQuerier runs each statement in a client span
+type tracedQuerier struct {
+	q       querier
+	dialect Dialect
+}
+
+var (
+	sqlStringLiteral  = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'`)
+	sqlNumericLiteral = regexp.MustCompile(`\b\d+(?:\.\d+)?\b`)
+)
+
+// sanitizeSQL replaces literals with ? so values never end up in traces. The repositories only use
+// placeholders, this guards against statements built with values in the future.
+func sanitizeSQL(query string) string {
+	query = sqlStringLiteral.ReplaceAllString(query, "?")
+	return sqlNumericLiteral.ReplaceAllString(query, "?")
+}
+
+func (tq tracedQuerier) startSQLSpan(ctx context.Context, query string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "SQL "+strings.SplitN(strings.TrimSpace(query), " ", 2)[0], trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("db.system", tq.dialect.name()),
+			attribute.String("db.statement", sanitizeSQL(query)),
+		))
+}
+
+func (tq tracedQuerier) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
+	ctx, span := tq.startSQLSpan(ctx, query)
+	defer span.End()
+	result, err := tq.q.ExecContext(ctx, query, args...)
+	if err != nil {
+		recordError(span, err)
+		return nil, err
+	}
+	if affected, err := result.RowsAffected(); err == nil {
+		span.SetAttributes(attribute.Int64("db.rows_affected", affected))
+	}
+	return result, nil
+}
+
+func (tq tracedQuerier) QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error) {
+	ctx, span := tq.startSQLSpan(ctx, query)
+	defer span.End()
+	rows, err := tq.q.QueryContext(ctx, query, args...)
+	recordError(span, err)
+	return rows, err
+}
+
+func (tq tracedQuerier) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
+	ctx, span := tq.startSQLSpan(ctx, query)
+	defer span.End()
+	row := tq.q.QueryRowContext(ctx, query, args...)
+	errorStatus(span, row.Err())
+	return row
+}
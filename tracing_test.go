@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// traceRequests swaps in a tracer that records to memory, runs fn and returns the ended spans
+func traceRequests(t *testing.T, fn func()) tracetest.SpanStubs {
+	t.Helper()
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previousTracer, previousRepository := tracer, repository
+	tracer = provider.Tracer(instrumentationName)
+	repository = NewTracedRepository(repository)
+	defer func() {
+		tracer, repository = previousTracer, previousRepository
+	}()
+
+	fn()
+	// the syncer exports spans as they end, shutting the exporter down would drop them
+	spans := exporter.GetSpans()
+	if err := provider.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return spans
+}
+
+func findSpan(spans tracetest.SpanStubs, name string) (tracetest.SpanStub, bool) {
+	for _, s := range spans {
+		if s.Name == name {
+			return s, true
+		}
+	}
+	return tracetest.SpanStub{}, false
+}
+
+// spanAttribute is the value of the attribute key of span, an empty value when it has none
+func spanAttribute(span tracetest.SpanStub, key string) attribute.Value {
+	for _, a := range span.Attributes {
+		if string(a.Key) == key {
+			return a.Value
+		}
+	}
+	return attribute.Value{}
+}
+
+func Test_Tracing(t *testing.T) {
+	t.Run("should trace a request from the handler to the sql statement", func(t *testing.T) {
+		traceparent := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+		spans := traceRequests(t, func() {
+			req := httptest.NewRequest("GET", "/devices", nil)
+			req.Header.Set("traceparent", traceparent)
+			traced("/devices", CrudDevicesHandler)(httptest.NewRecorder(), req)
+		})
+
+		server, ok := findSpan(spans, "GET /devices")
+		if !ok {
+			t.Fatalf("expected server span, got %v", spans)
+		}
+		if server.SpanContext.TraceID().String() != "4bf92f3577b34da6a3ce929d0e0e4736" ||
+			server.Parent.SpanID().String() != "00f067aa0ba902b7" || !server.Parent.IsRemote() {
+			t.Errorf("expected server span to continue the incoming trace, got %v", server)
+		}
+		if server.SpanKind != trace.SpanKindServer {
+			t.Errorf("expected a server span, got %v", server.SpanKind)
+		}
+		if spanAttribute(server, "http.response.status_code").AsInt64() != http.StatusOK {
+			t.Errorf("expected status code attribute, got %v", server.Attributes)
+		}
+		repo, ok := findSpan(spans, "Repository.FindAllDevices")
+		if !ok || repo.Parent.SpanID() != server.SpanContext.SpanID() {
+			t.Fatalf("expected repository span below the server span, got %v", spans)
+		}
+		statement, ok := findSpan(spans, "SQL SELECT")
+		if !ok || statement.Parent.SpanID() != repo.SpanContext.SpanID() {
+			t.Fatalf("expected sql span below the repository span, got %v", spans)
+		}
+		if statement.SpanKind != trace.SpanKindClient {
+			t.Errorf("expected a client span, got %v", statement.SpanKind)
+		}
+		if !strings.HasPrefix(spanAttribute(statement, "db.statement").AsString(), "SELECT id, public_id, name, brand") {
+			t.Errorf("expected statement text, got %v", statement.Attributes)
+		}
+		encode, ok := findSpan(spans, "encode devices")
+		if !ok || encode.Parent.SpanID() != server.SpanContext.SpanID() {
+			t.Errorf("expected encoding span below the server span, got %v", spans)
+		}
+		for _, s := range spans {
+			if s.SpanContext.TraceID() != server.SpanContext.TraceID() {
+				t.Errorf("expected every span in one trace, got %v", s)
+			}
+		}
+	})
+
+	t.Run("should record rows affected by statements in a transaction", func(t *testing.T) {
+		spans := traceRequests(t, func() {
+			_, err := repository.SaveDevice(context.Background(), Device{Name: "Traced Device", Brand: "Traced Brand"})
+			if err != nil {
+				t.Fatal(err)
+			}
+		})
+		defer repository.DeleteAllDevices()
+
+		insert, ok := findSpan(spans, "SQL INSERT")
+		if !ok {
+			t.Fatalf("expected insert span, got %v", spans)
+		}
+		if spanAttribute(insert, "db.rows_affected").AsInt64() != 1 {
+			t.Errorf("expected 1 row affected, got %v", insert.Attributes)
+		}
+		save, _ := findSpan(spans, "Repository.SaveDevice")
+		if insert.Parent.SpanID() != save.SpanContext.SpanID() {
+			t.Errorf("expected insert span below the repository span, got %v", spans)
+		}
+	})
+
+	t.Run("should not export traces the caller did not sample", func(t *testing.T) {
+		spans := traceRequests(t, func() {
+			req := httptest.NewRequest("GET", "/devices", nil)
+			req.Header.Set("traceparent", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00")
+			traced("/devices", CrudDevicesHandler)(httptest.NewRecorder(), req)
+		})
+		if len(spans) != 0 {
+			t.Errorf("expected no spans, got %v", spans)
+		}
+	})
+}
+
+func Test_SanitizeSQL(t *testing.T) {
+	query := "SELECT id FROM devices WHERE name = 'O''Brien' AND tenant_id = ? LIMIT 10"
+	expected := "SELECT id FROM devices WHERE name = ? AND tenant_id = ? LIMIT ?"
+	if got := sanitizeSQL(query); got != expected {
+		t.Errorf("expected %q, got %q", expected, got)
+	}
+}
+
+func Test_TracerProvider(t *testing.T) {
+	t.Run("should export spans over OTLP/HTTP to the collector", func(t *testing.T) {
+		var body []byte
+		var path, contentType string
+		collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			path, contentType = r.URL.Path, r.Header.Get("Content-Type")
+			body, _ = io.ReadAll(r.Body)
+		}))
+		defer collector.Close()
+		t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+		t.Setenv("OTEL_SERVICE_NAME", "device-store-test")
+
+		provider := newTracerProvider()
+		_, span := provider.Tracer(instrumentationName).Start(context.Background(), "test")
+		span.End()
+		if err := provider.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		if path != "/v1/traces" || contentType != "application/x-protobuf" {
+			t.Errorf("expected spans to be posted to /v1/traces as protobuf, got %v %v", path, contentType)
+		}
+		traceID := span.SpanContext().TraceID()
+		for _, expected := range [][]byte{traceID[:], []byte("device-store-test")} {
+			if !bytes.Contains(body, expected) {
+				t.Errorf("expected request to contain %q, got %q", expected, body)
+			}
+		}
+	})
+
+	t.Run("should write spans to the traces file", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "traces.json")
+		t.Setenv("TRACES_FILE", path)
+
+		provider := newTracerProvider()
+		_, span := provider.Tracer(instrumentationName).Start(context.Background(), "test")
+		span.End()
+		if err := provider.Shutdown(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+
+		out, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var record struct {
+			Name        string
+			SpanContext struct{ TraceID string }
+		}
+		if err := json.Unmarshal(out, &record); err != nil {
+			t.Fatal(err)
+		}
+		if record.Name != "test" || record.SpanContext.TraceID != span.SpanContext().TraceID().String() {
+			t.Errorf("expected the span as JSON, got %s", out)
+		}
+	})
+
+	t.Run("should sample nothing without an exporter", func(t *testing.T) {
+		provider := newTracerProvider()
+		defer provider.Shutdown(context.Background())
+		_, span := provider.Tracer(instrumentationName).Start(context.Background(), "test")
+		defer span.End()
+		if span.IsRecording() || span.SpanContext().IsSampled() {
+			t.Errorf("expected span not to be sampled")
+		}
+	})
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_ULID(t *testing.T) {
+	t.Run("should generate valid ulids sorted by time", func(t *testing.T) {
+		earlier := newULID(time.UnixMilli(1469918176385))
+		later := newULID(time.UnixMilli(1469918176386))
+		if !isULID(earlier) || !isULID(later) {
+			t.Fatalf("expected valid ulids, got %v and %v", earlier, later)
+		}
+		// the timestamp of the ULID spec example
+		if earlier[:10] != "01ARYZ6S41" {
+			t.Errorf("expected timestamp 01ARYZ6S41, got %v", earlier[:10])
+		}
+		if earlier >= later {
+			t.Errorf("expected %v to sort before %v", earlier, later)
+		}
+		if newULID(time.UnixMilli(1469918176385)) == earlier {
+			t.Error("expected random part to differ")
+		}
+	})
+
+	t.Run("should reject malformed ulids", func(t *testing.T) {
+		for _, s := range []string{"", "123", "01ARZ3NDEKTSV4RRFFQ69G5FA", "01arz3ndektsv4rrffq69g5fav", "01ARZ3NDEKTSV4RRFFQ69G5FAU", "81ARZ3NDEKTSV4RRFFQ69G5FAV"} {
+			if isULID(s) {
+				t.Errorf("expected %q to be rejected", s)
+			}
+		}
+	})
+}
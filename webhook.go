@@ -0,0 +1,400 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+
+	webhookMaxAttempts = 8
+	webhookBaseBackoff = 10 * time.Second
+	webhookMaxBackoff  = time.Hour
+)
+
+var webhookEvents = []string{EventDeviceCreated, EventDeviceUpdated, EventDeviceDeleted, EventDeviceCheckedOut, EventDeviceCheckedIn}
+
+type Webhook struct {
+	ID           int       `json:"id"`
+	Tenant       string    `json:"-"`
+	URL          string    `json:"url"`
+	Events       []string  `json:"events"`
+	Brand        string    `json:"brand,omitempty"`
+	Secret       string    `json:"secret,omitempty"`
+	CreationTime time.Time `json:"creation_time"`
+}
+
+type WebhookDelivery struct {
+	ID              int             `json:"id"`
+	Tenant          string          `json:"-"`
+	WebhookID       int             `json:"webhook_id"`
+	EventID         int64           `json:"event_id"`
+	EventType       string          `json:"event_type"`
+	Payload         json.RawMessage `json:"payload"`
+	Status          string          `json:"status"`
+	Attempts        int             `json:"attempts"`
+	NextAttemptTime time.Time       `json:"next_attempt_time"`
+	LastStatusCode  int             `json:"last_status_code,omitempty"`
+	LastError       string          `json:"last_error,omitempty"`
+	CreationTime    time.Time       `json:"creation_time"`
+}
+
+var webhookRepository WebhookRepository
+
+// Matches reports whether the webhook is subscribed to the event, only events of its own tenant match
+func (wh Webhook) Matches(event DeviceEvent) bool {
+	if wh.Tenant != event.Tenant {
+		return false
+	}
+	if wh.Brand != "" && wh.Brand != event.Device.Brand {
+		return false
+	}
+	if len(wh.Events) == 0 {
+		return true
+	}
+	for _, e := range wh.Events {
+		if e == event.Type {
+			return true
+		}
+	}
+	return false
+}
+
+func validateWebhook(wh Webhook) error {
+	u, err := url.Parse(wh.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("url must be an absolute http or https URL")
+	}
+	if wh.Secret == "" {
+		return fmt.Errorf("secret is required")
+	}
+	for _, e := range wh.Events {
+		known := false
+		for _, k := range webhookEvents {
+			if e == k {
+				known = true
+				break
+			}
+		}
+		if !known {
+			return fmt.Errorf("unknown event type %q", e)
+		}
+	}
+	return nil
+}
+
+// SignWebhookPayload returns the hex encoded HMAC-SHA256 of "timestamp.body" keyed by secret
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff returns the delay before the next attempt after the given number of failed attempts
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// WebhookPublisher turns outbox events into queued deliveries for every matching subscription. Publishing
+// an event again queues nothing new for the webhooks it was queued for already.
+type WebhookPublisher struct {
+	repo WebhookRepository
+}
+
+func (wp WebhookPublisher) Publish(ctx context.Context, event OutboxEvent) error {
+	var deviceEvent DeviceEvent
+	if err := json.Unmarshal(event.Payload, &deviceEvent); err != nil {
+		return err
+	}
+	deviceEvent.ID = event.ID
+	payload, err := json.Marshal(deviceEvent)
+	if err != nil {
+		return err
+	}
+	webhooks, err := wp.repo.FindAllWebhooks(withTenant(ctx, deviceEvent.Tenant))
+	if err != nil {
+		return err
+	}
+	for _, wh := range webhooks {
+		if !wh.Matches(deviceEvent) {
+			continue
+		}
+		_, err := wp.repo.SaveDelivery(WebhookDelivery{
+			Tenant:    wh.Tenant,
+			WebhookID: wh.ID,
+			EventID:   event.ID,
+			EventType: event.Type,
+			Payload:   payload,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type WebhookWorker struct {
+	repo     WebhookRepository
+	client   *http.Client
+	interval time.Duration
+	batch    int
+}
+
+func NewWebhookWorker(repo WebhookRepository) *WebhookWorker {
+	return &WebhookWorker{
+		repo:     repo,
+		client:   &http.Client{Timeout: 10 * time.Second},
+		interval: time.Second,
+		batch:    50,
+	}
+}
+
+// Run delivers due webhooks until ctx is cancelled
+func (ww *WebhookWorker) Run(ctx context.Context) {
+	ticker := time.NewTicker(ww.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ww.ProcessDue(ctx, time.Now())
+		}
+	}
+}
+
+// ProcessDue attempts every pending delivery whose next attempt time has passed. It holds the delivery lock
+// while doing so, replicas finding it taken skip the run so each delivery is sent once.
+func (ww *WebhookWorker) ProcessDue(ctx context.Context, now time.Time) {
+	unlock, ok, err := ww.repo.TryLock(ctx)
+	if err != nil {
+		slog.ErrorContext(ctx, "Error acquiring webhook worker lock", "error", err)
+		return
+	}
+	if !ok {
+		return
+	}
+	defer unlock()
+
+	deliveries, err := ww.repo.FindDueDeliveries(now, ww.batch)
+	if err != nil {
+		slog.Error("Error finding due webhook deliveries", "error", err)
+		return
+	}
+	for _, d := range deliveries {
+		// the deliveries left stay due for the next run
+		if ctx.Err() != nil {
+			return
+		}
+		wh, err := ww.repo.FindWebhookByID(withTenant(ctx, d.Tenant), d.WebhookID)
+		if err != nil {
+			slog.Error("Error finding webhook", "webhook_id", d.WebhookID, "error", err)
+			continue
+		}
+		ww.attempt(ctx, wh, d, now)
+	}
+}
+
+// attempt delivers d and records the outcome. A delivery cut off by ctx is not an attempt, it stays due.
+func (ww *WebhookWorker) attempt(ctx context.Context, wh Webhook, d WebhookDelivery, now time.Time) {
+	statusCode, err := ww.deliver(ctx, wh, d, now)
+	if ctx.Err() != nil {
+		return
+	}
+	d.Attempts++
+	d.LastStatusCode = statusCode
+	d.LastError = ""
+	switch {
+	case err == nil:
+		d.Status = DeliveryDelivered
+	case d.Attempts >= webhookMaxAttempts:
+		d.Status = DeliveryDead
+		d.LastError = err.Error()
+		slog.Warn("Webhook delivery dead-lettered", "delivery_id", d.ID, "attempts", d.Attempts, "error", err)
+	default:
+		d.LastError = err.Error()
+		d.NextAttemptTime = now.Add(webhookBackoff(d.Attempts))
+	}
+	if _, err := ww.repo.UpdateDelivery(d); err != nil {
+		slog.Error("Error updating webhook delivery", "delivery_id", d.ID, "error", err)
+	}
+}
+
+func (ww *WebhookWorker) deliver(ctx context.Context, wh Webhook, d WebhookDelivery, now time.Time) (int, error) {
+	timestamp := now.Unix()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, wh.URL, strings.NewReader(string(d.Payload)))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Event", d.EventType)
+	req.Header.Set("X-Webhook-Delivery", strconv.Itoa(d.ID))
+	req.Header.Set("X-Webhook-Event-ID", strconv.FormatInt(d.EventID, 10))
+	req.Header.Set("X-Webhook-Timestamp", strconv.FormatInt(timestamp, 10))
+	req.Header.Set("X-Webhook-Signature", "sha256="+SignWebhookPayload(wh.Secret, timestamp, d.Payload))
+
+	resp, err := ww.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode, fmt.Errorf("receiver responded with status %d", resp.StatusCode)
+	}
+	return resp.StatusCode, nil
+}
+
+func CrudWebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		webhooks, err := webhookRepository.FindAllWebhooks(r.Context())
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error finding webhooks", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		for i := range webhooks {
+			webhooks[i].Secret = ""
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(webhooks)
+
+	case http.MethodPost:
+		var newWebhook Webhook
+		err := json.NewDecoder(r.Body).Decode(&newWebhook)
+		if err != nil {
+			http.Error(w, "Invalid request payload", http.StatusBadRequest)
+			return
+		}
+		if err := validateWebhook(newWebhook); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		newWebhook, err = webhookRepository.SaveWebhook(r.Context(), newWebhook)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error adding webhook", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		slog.InfoContext(r.Context(), "Webhook added", "webhook_id", newWebhook.ID, "url", newWebhook.URL)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(newWebhook)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func CrudWebhookHandler(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/webhooks/")
+	idPart, sub, _ := strings.Cut(path, "/")
+	webhookID, err := strconv.Atoi(idPart)
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+	webhook, err := webhookRepository.FindWebhookByID(r.Context(), webhookID)
+	if err != nil {
+		if strings.Contains(err.Error(), "no rows in result set") {
+			http.Error(w, fmt.Sprintf("Webhook with id %v not found", webhookID), http.StatusNotFound)
+			return
+		}
+		slog.ErrorContext(r.Context(), "Error finding webhook", "error", err)
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+
+	if sub == "deliveries" {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		deliveries, err := webhookRepository.FindDeliveriesByWebhook(r.Context(), webhookID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error finding webhook deliveries", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(deliveries)
+		return
+	}
+	if sub != "" {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		webhook.Secret = ""
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(webhook)
+
+	case http.MethodPut:
+		var webhookDTO Webhook
+		err := json.NewDecoder(r.Body).Decode(&webhookDTO)
+		if err != nil {
+			http.Error(w, "Invalid request body", http.StatusBadRequest)
+			return
+		}
+		// secret is write-only, keep the current one unless a new one is given
+		if webhookDTO.Secret == "" {
+			webhookDTO.Secret = webhook.Secret
+		}
+		if err := validateWebhook(webhookDTO); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		webhook.URL = webhookDTO.URL
+		webhook.Events = webhookDTO.Events
+		webhook.Brand = webhookDTO.Brand
+		webhook.Secret = webhookDTO.Secret
+
+		_, err = webhookRepository.UpdateWebhook(r.Context(), webhook)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error updating webhook", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		webhook.Secret = ""
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(webhook)
+
+	case http.MethodDelete:
+		err := webhookRepository.DeleteWebhook(r.Context(), webhookID)
+		if err != nil {
+			slog.ErrorContext(r.Context(), "Error deleting webhook", "error", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, "Method Not Allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"time"
+)
+
+// WebhookRepository keeps webhooks per tenant, the webhook methods are scoped to the tenant of the context
+type WebhookRepository interface {
+	SaveWebhook(ctx context.Context, webhook Webhook) (Webhook, error)
+	FindWebhookByID(ctx context.Context, id int) (Webhook, error)
+	FindAllWebhooks(ctx context.Context) ([]Webhook, error)
+	UpdateWebhook(ctx context.Context, webhook Webhook) (Webhook, error)
+	DeleteWebhook(ctx context.Context, id int) error
+	// SaveDelivery queues a delivery once per webhook and event, saving it again returns the queued one
+	SaveDelivery(delivery WebhookDelivery) (WebhookDelivery, error)
+	FindDueDeliveries(now time.Time, limit int) ([]WebhookDelivery, error)
+	// FindDeliveriesByWebhook finds the deliveries of a webhook of the tenant of ctx
+	FindDeliveriesByWebhook(ctx context.Context, webhookID int) ([]WebhookDelivery, error)
+	UpdateDelivery(delivery WebhookDelivery) (WebhookDelivery, error)
+	// TryLock takes the delivery lock so only one replica sends the due deliveries at a time
+	TryLock(ctx context.Context) (unlock func(), ok bool, err error)
+}
+
+type WebhookRepositoryImpl struct {
+	db      *sql.DB
+	dialect Dialect
+}
+
+const webhookWorkerLockName = "device_store_webhook_worker"
+
+const webhookColumns = "id, tenant_id, url, events, brand, secret, creation_time"
+
+const deliveryColumns = "id, tenant_id, webhook_id, event_id, event_type, payload, status, attempts, next_attempt_time, last_status_code, last_error, creation_time"
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+func scanWebhook(row rowScanner) (Webhook, error) {
+	var webhook Webhook
+	var events string
+	err := row.Scan(&webhook.ID, &webhook.Tenant, &webhook.URL, &events, &webhook.Brand, &webhook.Secret, &webhook.CreationTime)
+	if err != nil {
+		return Webhook{}, err
+	}
+	webhook.Events = splitEvents(events)
+	return webhook, nil
+}
+
+func scanDelivery(row rowScanner) (WebhookDelivery, error) {
+	var delivery WebhookDelivery
+	var eventID sql.NullInt64
+	var payload string
+	var lastStatusCode sql.NullInt64
+	var lastError sql.NullString
+	err := row.Scan(&delivery.ID, &delivery.Tenant, &delivery.WebhookID, &eventID, &delivery.EventType, &payload, &delivery.Status,
+		&delivery.Attempts, &delivery.NextAttemptTime, &lastStatusCode, &lastError, &delivery.CreationTime)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	delivery.EventID = eventID.Int64
+	delivery.Payload = []byte(payload)
+	delivery.LastStatusCode = int(lastStatusCode.Int64)
+	delivery.LastError = lastError.String
+	return delivery, nil
+}
+
+func splitEvents(events string) []string {
+	if events == "" {
+		return []string{}
+	}
+	return strings.Split(events, ",")
+}
+
+func (r WebhookRepositoryImpl) SaveWebhook(ctx context.Context, webhook Webhook) (Webhook, error) {
+	query := "INSERT INTO webhooks (tenant_id, url, events, brand, secret, creation_time) VALUES (?, ?, ?, ?, ?, NOW())"
+	webhookID, err := r.dialect.insertID(ctx, r.db, query, tenantFromContext(ctx), webhook.URL, strings.Join(webhook.Events, ","), webhook.Brand, webhook.Secret)
+	if err != nil {
+		return Webhook{}, err
+	}
+	return r.FindWebhookByID(ctx, int(webhookID))
+}
+
+func (r WebhookRepositoryImpl) FindWebhookByID(ctx context.Context, id int) (Webhook, error) {
+	query := "SELECT " + webhookColumns + " FROM webhooks WHERE id = ? AND tenant_id = ?"
+	return scanWebhook(r.db.QueryRowContext(ctx, r.dialect.bind(query), id, tenantFromContext(ctx)))
+}
+
+func (r WebhookRepositoryImpl) FindAllWebhooks(ctx context.Context) ([]Webhook, error) {
+	query := "SELECT " + webhookColumns + " FROM webhooks WHERE tenant_id = ? ORDER BY id"
+	rows, err := r.db.QueryContext(ctx, r.dialect.bind(query), tenantFromContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		webhook, err := scanWebhook(rows)
+		if err != nil {
+			return nil, err
+		}
+		webhooks = append(webhooks, webhook)
+	}
+	return webhooks, rows.Err()
+}
+
+func (r WebhookRepositoryImpl) UpdateWebhook(ctx context.Context, webhook Webhook) (Webhook, error) {
+	query := "UPDATE webhooks SET url = ?, events = ?, brand = ?, secret = ? WHERE id = ? AND tenant_id = ?"
+	_, err := r.db.ExecContext(ctx, r.dialect.bind(query), webhook.URL, strings.Join(webhook.Events, ","), webhook.Brand, webhook.Secret,
+		webhook.ID, tenantFromContext(ctx))
+	if err != nil {
+		return Webhook{}, err
+	}
+	return webhook, nil
+}
+
+func (r WebhookRepositoryImpl) DeleteWebhook(ctx context.Context, id int) error {
+	query := "DELETE FROM webhooks WHERE id = ? AND tenant_id = ?"
+	_, err := r.db.ExecContext(ctx, r.dialect.bind(query), id, tenantFromContext(ctx))
+	return err
+}
+
+func (r WebhookRepositoryImpl) SaveDelivery(delivery WebhookDelivery) (WebhookDelivery, error) {
+	query := "INSERT INTO webhook_deliveries (tenant_id, webhook_id, event_id, event_type, payload, status, attempts, next_attempt_time, creation_time) VALUES (?, ?, ?, ?, ?, ?, 0, NOW(), NOW())"
+	deliveryID, err := r.dialect.insertID(context.Background(), r.db, query, delivery.Tenant, delivery.WebhookID, delivery.EventID,
+		delivery.EventType, string(delivery.Payload), DeliveryPending)
+	if r.dialect.isUniqueViolation(err) {
+		// queued by an earlier attempt to publish the event
+		query = "SELECT " + deliveryColumns + " FROM webhook_deliveries WHERE webhook_id = ? AND event_id = ?"
+		return scanDelivery(r.db.QueryRow(r.dialect.bind(query), delivery.WebhookID, delivery.EventID))
+	}
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	query = "SELECT " + deliveryColumns + " FROM webhook_deliveries WHERE id = ?"
+	return scanDelivery(r.db.QueryRow(r.dialect.bind(query), deliveryID))
+}
+
+func (r WebhookRepositoryImpl) FindDueDeliveries(now time.Time, limit int) ([]WebhookDelivery, error) {
+	query := "SELECT " + deliveryColumns + " FROM webhook_deliveries WHERE status = ? AND next_attempt_time <= ? ORDER BY id LIMIT ?"
+	return r.queryDeliveries(query, DeliveryPending, now.UTC(), limit)
+}
+
+func (r WebhookRepositoryImpl) FindDeliveriesByWebhook(ctx context.Context, webhookID int) ([]WebhookDelivery, error) {
+	query := "SELECT " + deliveryColumns + " FROM webhook_deliveries WHERE webhook_id = ? AND tenant_id = ? ORDER BY id DESC"
+	return r.queryDeliveries(query, webhookID, tenantFromContext(ctx))
+}
+
+func (r WebhookRepositoryImpl) queryDeliveries(query string, args ...any) ([]WebhookDelivery, error) {
+	rows, err := r.db.Query(r.dialect.bind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		delivery, err := scanDelivery(rows)
+		if err != nil {
+			return nil, err
+		}
+		deliveries = append(deliveries, delivery)
+	}
+	return deliveries, rows.Err()
+}
+
+func (r WebhookRepositoryImpl) UpdateDelivery(delivery WebhookDelivery) (WebhookDelivery, error) {
+	query := "UPDATE webhook_deliveries SET status = ?, attempts = ?, next_attempt_time = ?, last_status_code = ?, last_error = ? WHERE id = ?"
+	_, err := r.db.Exec(r.dialect.bind(query), delivery.Status, delivery.Attempts, delivery.NextAttemptTime.UTC(),
+		delivery.LastStatusCode, delivery.LastError, delivery.ID)
+	if err != nil {
+		return WebhookDelivery{}, err
+	}
+	return delivery, nil
+}
+
+func (r WebhookRepositoryImpl) TryLock(ctx context.Context) (func(), bool, error) {
+	return tryNamedLock(ctx, r.db, r.dialect, webhookWorkerLockName)
+}
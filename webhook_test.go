@@ -0,0 +1,445 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type webhookReceiver struct {
+	mu       sync.Mutex
+	status   int
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (wr *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.requests = append(wr.requests, r)
+	wr.bodies = append(wr.bodies, body)
+	w.WriteHeader(wr.status)
+}
+
+// testEventIDs number the events published by the tests, they are offset so they do not collide with outbox ids
+var testEventIDs atomic.Int64
+
+func publishTestEvent(t *testing.T, eventType string, device Device) {
+	t.Helper()
+	publishTenantEvent(t, DefaultTenant, eventType, device)
+}
+
+func publishTenantEvent(t *testing.T, tenant string, eventType string, device Device) {
+	t.Helper()
+	payload, err := json.Marshal(DeviceEvent{Type: eventType, Tenant: tenant, OccurredAt: time.Now(), Device: device})
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := OutboxEvent{ID: 1<<40 + testEventIDs.Add(1), DeviceID: device.ID, Type: eventType, Payload: payload}
+	err = WebhookPublisher{repo: webhookRepository}.Publish(context.Background(), event)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func createTestWebhook(t *testing.T, url string, brand string) Webhook {
+	t.Helper()
+	return createTenantWebhook(t, context.Background(), url, brand)
+}
+
+// createTenantWebhook subscribes url to device.created events of the tenant of ctx
+func createTenantWebhook(t *testing.T, ctx context.Context, url string, brand string) Webhook {
+	t.Helper()
+	webhook, err := webhookRepository.SaveWebhook(ctx, Webhook{
+		URL:    url,
+		Events: []string{EventDeviceCreated},
+		Brand:  brand,
+		Secret: "s3cret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { webhookRepository.DeleteWebhook(ctx, webhook.ID) })
+	return webhook
+}
+
+func Test_CrudWebhooksHandler(t *testing.T) {
+	t.Run("should add webhook", func(t *testing.T) {
+		webhookStub, err := json.Marshal(Webhook{
+			URL:    "http://localhost:9999/hook",
+			Events: []string{EventDeviceCreated, EventDeviceDeleted},
+			Secret: "s3cret",
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		req, err := http.NewRequest("POST", "/webhooks", bytes.NewReader(webhookStub))
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		handler := http.HandlerFunc(CrudWebhooksHandler)
+		handler.ServeHTTP(rr, req)
+		if rr.Code != http.StatusCreated {
+			t.Fatalf("expected status code %d, got %d", http.StatusCreated, rr.Code)
+		}
+		var webhookResponse Webhook
+		err = json.Unmarshal(rr.Body.Bytes(), &webhookResponse)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer webhookRepository.DeleteWebhook(context.Background(), webhookResponse.ID)
+		if webhookResponse.ID == 0 {
+			t.Errorf("expected id to be non zero, got %v", webhookResponse.ID)
+		}
+		if len(webhookResponse.Events) != 2 {
+			t.Errorf("expected 2 events, got %v", webhookResponse.Events)
+		}
+
+		req, err = http.NewRequest("GET", "/webhooks/"+strconv.Itoa(webhookResponse.ID), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr = httptest.NewRecorder()
+		http.HandlerFunc(CrudWebhookHandler).ServeHTTP(rr, req)
+		if rr.Code != http.StatusOK {
+			t.Errorf("expected status code %d, got %d", http.StatusOK, rr.Code)
+		}
+		if strings.Contains(rr.Body.String(), "s3cret") {
+			t.Errorf("expected secret to be hidden, got %v", rr.Body.String())
+		}
+	})
+
+	t.Run("should return 400 bad request for invalid url or event", func(t *testing.T) {
+		for _, webhook := range []Webhook{
+			{URL: "not a url", Secret: "s3cret"},
+			{URL: "http://localhost/hook", Events: []string{"device.exploded"}, Secret: "s3cret"},
+			{URL: "http://localhost/hook"},
+		} {
+			webhookStub, err := json.Marshal(webhook)
+			req, err := http.NewRequest("POST", "/webhooks", bytes.NewReader(webhookStub))
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(CrudWebhooksHandler).ServeHTTP(rr, req)
+			if rr.Code != http.StatusBadRequest {
+				t.Errorf("expected status code %d for %v, got %d", http.StatusBadRequest, webhook, rr.Code)
+			}
+		}
+	})
+
+	t.Run("should hide the webhooks of other tenants", func(t *testing.T) {
+		webhook := createTenantWebhook(t, withTenant(context.Background(), "webhook-tenant"), "http://localhost:9999/hook", "")
+		for _, path := range []string{"/webhooks/" + strconv.Itoa(webhook.ID), "/webhooks/" + strconv.Itoa(webhook.ID) + "/deliveries"} {
+			req, err := http.NewRequest("GET", path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			rr := httptest.NewRecorder()
+			http.HandlerFunc(CrudWebhookHandler).ServeHTTP(rr, req)
+			if rr.Code != http.StatusNotFound {
+				t.Errorf("expected status code %d for %v, got %d", http.StatusNotFound, path, rr.Code)
+			}
+		}
+		req, err := http.NewRequest("GET", "/webhooks", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(CrudWebhooksHandler).ServeHTTP(rr, req)
+		var webhooks []Webhook
+		if err := json.Unmarshal(rr.Body.Bytes(), &webhooks); err != nil {
+			t.Fatal(err)
+		}
+		for _, wh := range webhooks {
+			if wh.ID == webhook.ID {
+				t.Errorf("expected the webhook of another tenant to be hidden, got %v", webhooks)
+			}
+		}
+	})
+
+	t.Run("should return 404 not found", func(t *testing.T) {
+		req, err := http.NewRequest("DELETE", "/webhooks/100000", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		rr := httptest.NewRecorder()
+		http.HandlerFunc(CrudWebhookHandler).ServeHTTP(rr, req)
+		if rr.Code != http.StatusNotFound {
+			t.Errorf("expected status code %d, got %d", http.StatusNotFound, rr.Code)
+		}
+	})
+}
+
+func Test_WebhookWorker(t *testing.T) {
+	t.Run("should deliver signed payload to matching webhooks", func(t *testing.T) {
+		receiver := &webhookReceiver{status: http.StatusOK}
+		server := httptest.NewServer(receiver)
+		defer server.Close()
+		webhook := createTestWebhook(t, server.URL, "Webhook Brand")
+		otherBrand := createTestWebhook(t, server.URL, "Other Brand")
+
+		device := Device{ID: 42, Name: "Webhook Device", Brand: "Webhook Brand"}
+		publishTestEvent(t, EventDeviceCreated, device)
+		publishTestEvent(t, EventDeviceDeleted, device)
+		NewWebhookWorker(webhookRepository).ProcessDue(context.Background(), time.Now().Add(time.Second))
+
+		if len(receiver.requests) != 1 {
+			t.Fatalf("expected 1 delivery, got %d", len(receiver.requests))
+		}
+		req, body := receiver.requests[0], receiver.bodies[0]
+		if req.Header.Get("X-Webhook-Event") != EventDeviceCreated {
+			t.Errorf("expected event %v, got %v", EventDeviceCreated, req.Header.Get("X-Webhook-Event"))
+		}
+		timestamp, err := strconv.ParseInt(req.Header.Get("X-Webhook-Timestamp"), 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := "sha256=" + SignWebhookPayload("s3cret", timestamp, body)
+		if req.Header.Get("X-Webhook-Signature") != expected {
+			t.Errorf("expected signature %v, got %v", expected, req.Header.Get("X-Webhook-Signature"))
+		}
+		var event DeviceEvent
+		err = json.Unmarshal(body, &event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if event.Device.Name != device.Name {
+			t.Errorf("expected device %v, got %v", device.Name, event.Device.Name)
+		}
+
+		deliveries, err := webhookRepository.FindDeliveriesByWebhook(context.Background(), webhook.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != 1 || deliveries[0].Status != DeliveryDelivered {
+			t.Errorf("expected 1 delivered delivery, got %v", deliveries)
+		}
+		deliveries, err = webhookRepository.FindDeliveriesByWebhook(context.Background(), otherBrand.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != 0 {
+			t.Errorf("expected no deliveries for other brand, got %v", deliveries)
+		}
+	})
+
+	t.Run("should only deliver the events of the webhook's tenant", func(t *testing.T) {
+		receiver := &webhookReceiver{status: http.StatusOK}
+		server := httptest.NewServer(receiver)
+		defer server.Close()
+		ctx := withTenant(context.Background(), "webhook-tenant")
+		webhook := createTenantWebhook(t, ctx, server.URL, "")
+		defaultWebhook := createTestWebhook(t, server.URL, "Tenant Brand")
+
+		device := Device{ID: 44, Name: "Tenant Device", Brand: "Tenant Brand"}
+		publishTenantEvent(t, "webhook-tenant", EventDeviceCreated, device)
+		NewWebhookWorker(webhookRepository).ProcessDue(context.Background(), time.Now().Add(time.Second))
+
+		if len(receiver.requests) != 1 {
+			t.Fatalf("expected 1 delivery, got %d", len(receiver.requests))
+		}
+		deliveries, err := webhookRepository.FindDeliveriesByWebhook(ctx, webhook.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != 1 || deliveries[0].Status != DeliveryDelivered {
+			t.Errorf("expected 1 delivered delivery, got %v", deliveries)
+		}
+		deliveries, err = webhookRepository.FindDeliveriesByWebhook(context.Background(), webhook.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != 0 {
+			t.Errorf("expected the deliveries of another tenant's webhook to be hidden, got %v", deliveries)
+		}
+		deliveries, err = webhookRepository.FindDeliveriesByWebhook(context.Background(), defaultWebhook.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != 0 {
+			t.Errorf("expected no deliveries for the default tenant, got %v", deliveries)
+		}
+	})
+
+	t.Run("should retry with backoff and dead-letter failing deliveries", func(t *testing.T) {
+		receiver := &webhookReceiver{status: http.StatusInternalServerError}
+		server := httptest.NewServer(receiver)
+		defer server.Close()
+		webhook := createTestWebhook(t, server.URL, "")
+		worker := NewWebhookWorker(webhookRepository)
+
+		publishTestEvent(t, EventDeviceCreated, Device{ID: 43, Name: "Failing Device", Brand: "Test Brand"})
+		// TIMESTAMP columns round to whole seconds
+		now := time.Now().Add(time.Second).Truncate(time.Second)
+		worker.ProcessDue(context.Background(), now)
+
+		deliveries, err := webhookRepository.FindDeliveriesByWebhook(context.Background(), webhook.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != 1 {
+			t.Fatalf("expected 1 delivery, got %d", len(deliveries))
+		}
+		delivery := deliveries[0]
+		if delivery.Status != DeliveryPending || delivery.Attempts != 1 || delivery.LastStatusCode != http.StatusInternalServerError {
+			t.Errorf("expected pending delivery after 1 failed attempt, got %v", delivery)
+		}
+		if !delivery.NextAttemptTime.After(now) {
+			t.Errorf("expected next attempt after %v, got %v", now, delivery.NextAttemptTime)
+		}
+
+		// not due yet, nothing should be sent
+		worker.ProcessDue(context.Background(), now)
+		if len(receiver.requests) != 1 {
+			t.Errorf("expected 1 request before backoff elapsed, got %d", len(receiver.requests))
+		}
+
+		delivery.Attempts = webhookMaxAttempts - 1
+		delivery.NextAttemptTime = now
+		_, err = webhookRepository.UpdateDelivery(delivery)
+		if err != nil {
+			t.Fatal(err)
+		}
+		worker.ProcessDue(context.Background(), now)
+		deliveries, err = webhookRepository.FindDeliveriesByWebhook(context.Background(), webhook.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if deliveries[0].Status != DeliveryDead {
+			t.Errorf("expected delivery to be dead-lettered, got %v", deliveries[0].Status)
+		}
+	})
+
+	t.Run("should leave deliveries cut off by shutdown due", func(t *testing.T) {
+		var requests atomic.Int32
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			requests.Add(1)
+			// the server notices the client going away once the body is read
+			io.ReadAll(r.Body)
+			<-r.Context().Done()
+		}))
+		defer server.Close()
+		webhook := createTestWebhook(t, server.URL, "")
+		for id := 44; id < 47; id++ {
+			publishTestEvent(t, EventDeviceCreated, Device{ID: id, Name: "Slow Device", Brand: "Test Brand"})
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		NewWebhookWorker(webhookRepository).ProcessDue(ctx, time.Now().Add(time.Second))
+		if elapsed := time.Since(start); elapsed > 2*time.Second {
+			t.Errorf("expected the worker to stop with its context, took %v", elapsed)
+		}
+		if requests.Load() != 1 {
+			t.Errorf("expected no deliveries to be sent after the cut off one, got %d requests", requests.Load())
+		}
+		deliveries, err := webhookRepository.FindDeliveriesByWebhook(context.Background(), webhook.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, d := range deliveries {
+			if d.Status != DeliveryPending || d.Attempts != 0 {
+				t.Errorf("expected the delivery to stay due, got %v", d)
+			}
+		}
+	})
+
+	t.Run("should queue an event published again once and identify it to the receiver", func(t *testing.T) {
+		receiver := &webhookReceiver{status: http.StatusOK}
+		server := httptest.NewServer(receiver)
+		defer server.Close()
+		webhook := createTestWebhook(t, server.URL, "Republished Brand")
+		device := Device{ID: 46, Name: "Republished Device", Brand: "Republished Brand"}
+		payload, err := json.Marshal(DeviceEvent{Type: EventDeviceCreated, Tenant: DefaultTenant, OccurredAt: time.Now(), Device: device})
+		if err != nil {
+			t.Fatal(err)
+		}
+		event := OutboxEvent{ID: 1<<40 + testEventIDs.Add(1), DeviceID: device.ID, Type: EventDeviceCreated, Payload: payload}
+		// a relay retrying after a later publisher failed publishes the event again
+		for i := 0; i < 2; i++ {
+			if err := (WebhookPublisher{repo: webhookRepository}).Publish(context.Background(), event); err != nil {
+				t.Fatal(err)
+			}
+		}
+		deliveries, err := webhookRepository.FindDeliveriesByWebhook(context.Background(), webhook.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(deliveries) != 1 || deliveries[0].EventID != event.ID {
+			t.Fatalf("expected 1 delivery of event %v, got %v", event.ID, deliveries)
+		}
+
+		NewWebhookWorker(webhookRepository).ProcessDue(context.Background(), time.Now().Add(time.Second))
+		if len(receiver.requests) != 1 {
+			t.Fatalf("expected 1 request, got %d", len(receiver.requests))
+		}
+		if id := receiver.requests[0].Header.Get("X-Webhook-Event-ID"); id != strconv.FormatInt(event.ID, 10) {
+			t.Errorf("expected event id header %v, got %v", event.ID, id)
+		}
+		var received DeviceEvent
+		if err := json.Unmarshal(receiver.bodies[0], &received); err != nil {
+			t.Fatal(err)
+		}
+		if received.ID != event.ID {
+			t.Errorf("expected event id %v in the body, got %v", event.ID, received.ID)
+		}
+	})
+
+	t.Run("should send each delivery once while workers of several replicas run", func(t *testing.T) {
+		receiver := &webhookReceiver{status: http.StatusOK}
+		server := httptest.NewServer(receiver)
+		defer server.Close()
+		createTestWebhook(t, server.URL, "Replicated Brand")
+		publishTestEvent(t, EventDeviceCreated, Device{ID: 45, Name: "Replicated Device", Brand: "Replicated Brand"})
+
+		ctx := context.Background()
+		unlock, ok, err := webhookRepository.TryLock(ctx)
+		if err != nil || !ok {
+			t.Fatalf("expected to take the delivery lock, got %v, %v", ok, err)
+		}
+		NewWebhookWorker(webhookRepository).ProcessDue(ctx, time.Now().Add(time.Second))
+		if len(receiver.requests) != 0 {
+			t.Errorf("expected no delivery while another replica holds the lock, got %d", len(receiver.requests))
+		}
+		unlock()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				NewWebhookWorker(webhookRepository).ProcessDue(ctx, time.Now().Add(time.Second))
+			}()
+		}
+		wg.Wait()
+		NewWebhookWorker(webhookRepository).ProcessDue(ctx, time.Now().Add(time.Second))
+		if len(receiver.requests) != 1 {
+			t.Errorf("expected 1 delivery, got %d", len(receiver.requests))
+		}
+	})
+
+	t.Run("should back off exponentially up to the maximum", func(t *testing.T) {
+		if webhookBackoff(1) != webhookBaseBackoff {
+			t.Errorf("expected %v, got %v", webhookBaseBackoff, webhookBackoff(1))
+		}
+		if webhookBackoff(3) != 4*webhookBaseBackoff {
+			t.Errorf("expected %v, got %v", 4*webhookBaseBackoff, webhookBackoff(3))
+		}
+		if webhookBackoff(100) != webhookMaxBackoff {
+			t.Errorf("expected %v, got %v", webhookMaxBackoff, webhookBackoff(100))
+		}
+	})
+}